@@ -0,0 +1,131 @@
+package roletalk
+
+import (
+	"runtime"
+	"sort"
+	"time"
+)
+
+//AdminRole is reserved name of the built-in introspection role. It is served only if PeerOptions.Admin is set.
+//Remote peers call it with ordinary Destination.Request. Supported events:
+//
+//	ping          replies "pong"
+//	info          replies AdminInfo
+//	roles         replies list of active local roles
+//	units         replies []UnitSnapshot
+//	destinations  replies []DestinationSnapshot
+//	stats         replies AdminStats
+//	acquaintances replies []Acquaintance: addresses the peer has dialed, which it would introduce to friendly units
+const AdminRole = "$roletalk"
+
+//AdminOptions enables AdminRole on the Peer
+type AdminOptions struct {
+	//KeyIDs restricts access to units authenticated with one of the listed key ids (see Peer.AddKey).
+	//If empty, any connected unit is allowed to call AdminRole
+	KeyIDs []string
+}
+
+//AdminInfo is reply of AdminRole to "info" request
+type AdminInfo struct {
+	ID       string        `json:"id"`
+	Name     string        `json:"name"`
+	Friendly bool          `json:"friendly"`
+	Uptime   time.Duration `json:"uptime"`
+	Os       string        `json:"os"`
+	Runtime  string        `json:"runtime"`
+	Protocol string        `json:"protocol"`
+}
+
+//Acquaintance is remote peer the Peer has connected to by Address. It is reply of AdminRole to "acquaintances" request
+type Acquaintance struct {
+	Address string   `json:"address"`
+	ID      string   `json:"id"`
+	Name    string   `json:"name"`
+	Roles   []string `json:"roles"`
+}
+
+//AdminStats is reply of AdminRole to "stats" request
+type AdminStats struct {
+	Uptime           time.Duration `json:"uptime"`
+	Roles            int           `json:"roles"`
+	Destinations     int           `json:"destinations"`
+	Units            int           `json:"units"`
+	Connections      int           `json:"connections"`
+	InFlightRequests int           `json:"inFlightRequests"`
+	OpenStreams      int           `json:"openStreams"`
+	Goroutines       int           `json:"goroutines"`
+}
+
+func (peer *Peer) enableAdmin(opts AdminOptions) {
+	allowed := make(map[string]struct{})
+	for _, id := range opts.KeyIDs {
+		allowed[id] = struct{}{}
+	}
+	role := peer.Role(AdminRole)
+	role.OnRequest("", func(ctx *RequestContext) {
+		if len(allowed) == 0 {
+			return
+		}
+		if _, ok := allowed[ctx.conn.keyID]; ok == false {
+			peer.logger.Warn("admin request denied", "unit", ctx.unit.id, "event", ctx.event)
+			ctx.Reject("Access denied")
+		}
+	})
+	role.OnRequest("ping", func(ctx *RequestContext) {
+		ctx.Reply("pong")
+	})
+	role.OnRequest("info", func(ctx *RequestContext) {
+		ctx.Reply(AdminInfo{
+			ID:       peer.id,
+			Name:     peer.Name,
+			Friendly: peer.Friendly,
+			Uptime:   time.Since(peer.startTime),
+			Os:       runtime.GOOS,
+			Runtime:  "GO",
+			Protocol: protocolVersion,
+		})
+	})
+	role.OnRequest("roles", func(ctx *RequestContext) {
+		ctx.Reply(peer.ListRoles())
+	})
+	role.OnRequest("units", func(ctx *RequestContext) {
+		ctx.Reply(peer.Snapshot().Units)
+	})
+	role.OnRequest("destinations", func(ctx *RequestContext) {
+		ctx.Reply(peer.Snapshot().Destinations)
+	})
+	role.OnRequest("stats", func(ctx *RequestContext) {
+		ctx.Reply(peer.adminStats())
+	})
+	role.OnRequest("acquaintances", func(ctx *RequestContext) {
+		ctx.Reply(peer.acquaintances())
+	})
+}
+
+func (peer *Peer) acquaintances() []Acquaintance {
+	res := []Acquaintance{}
+	for addr, unit := range peer.addrUnits.getUnitMap() {
+		roles := unit.GetRoles()
+		sort.Strings(roles)
+		res = append(res, Acquaintance{Address: addr, ID: unit.id, Name: unit.name, Roles: roles})
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].Address < res[j].Address })
+	return res
+}
+
+func (peer *Peer) adminStats() AdminStats {
+	snap := peer.Snapshot()
+	stats := AdminStats{
+		Uptime:       snap.Uptime,
+		Roles:        len(snap.Roles),
+		Destinations: len(snap.Destinations),
+		Units:        len(snap.Units),
+		Goroutines:   runtime.NumGoroutine(),
+	}
+	for _, unit := range snap.Units {
+		stats.Connections += len(unit.Connections)
+		stats.InFlightRequests += len(unit.Requests)
+		stats.OpenStreams += len(unit.Streams)
+	}
+	return stats
+}
@@ -0,0 +1,196 @@
+package roletalk
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/klauspost/compress/snappy"
+	"github.com/klauspost/compress/zstd"
+)
+
+//Codecs of application-level compression
+const (
+	CodecZstd   = "zstd"   //CodecZstd compresses better, fits JSON and text payloads
+	CodecSnappy = "snappy" //CodecSnappy is faster and uses less CPU
+)
+
+//Compression configures compression of outgoing data. Zero value disables compression. Payloads smaller than Threshold are never compressed.
+//Incoming data is decompressed according to local settings: remote peer uses a codec only if the local peer has announced it
+type Compression struct {
+	Deflate   bool     `json:"deflate"`   //Deflate enables websocket permessage-deflate extension. It is used if both sides enable it
+	Codecs    []string `json:"codecs"`    //Codecs are application-level codecs in order of preference. The first one which remote side announces is used
+	Threshold int      `json:"threshold"` //Threshold is min size of payload to compress. Default is 1 KiB
+}
+
+func (c Compression) withDefaults() Compression {
+	if c.Threshold <= 0 {
+		c.Threshold = defCompressionThreshold
+	}
+	return c
+}
+
+//codec compresses payload of frames. id is written before compressed payload
+type codec struct {
+	id     byte
+	name   string
+	encode func(src []byte) []byte
+	//decode decompresses src if decompressed size does not exceed max
+	decode func(src []byte, max int64) ([]byte, error)
+}
+
+var codecs = []*codec{
+	{id: 1, name: CodecZstd, encode: zstdEncode, decode: zstdDecode},
+	{id: 2, name: CodecSnappy, encode: snappyEncode, decode: snappyDecode},
+}
+
+func codecByName(name string) *codec {
+	for _, c := range codecs {
+		if c.name == name {
+			return c
+		}
+	}
+	return nil
+}
+
+func codecByID(id byte) *codec {
+	for _, c := range codecs {
+		if c.id == id {
+			return c
+		}
+	}
+	return nil
+}
+
+//negotiateCodec returns the first of local codecs announced by remote side
+func negotiateCodec(local, remote []string) *codec {
+	for _, name := range local {
+		if hasFeature(remote, name) == true {
+			if c := codecByName(name); c != nil {
+				return c
+			}
+		}
+	}
+	return nil
+}
+
+//compressedSizeError is returned when decompressed payload exceeds SizeLimits.MaxMessage. size is 0 if it is not known
+type compressedSizeError struct {
+	size uint64
+	max  int64
+}
+
+func (e *compressedSizeError) Error() string {
+	if e.size == 0 {
+		return fmt.Sprintf("%v: decompressed payload exceeds %v bytes", errStrTooLarge, e.max)
+	}
+	return fmt.Sprintf("%v: decompressed payload of %v bytes exceeds %v bytes", errStrTooLarge, e.size, e.max)
+}
+
+//zstd encoder and decoders are shared by all peers and created on first use, since decoders run background goroutines
+var zstdOnce sync.Once
+var zstdEncoder *zstd.Encoder
+var zstdDecoders sync.Map //key: max decoded size, value: *zstd.Decoder
+
+func zstdEncode(src []byte) []byte {
+	zstdOnce.Do(func() { zstdEncoder, _ = zstd.NewWriter(nil) })
+	return zstdEncoder.EncodeAll(src, nil)
+}
+
+//zstdDecoder returns decoder which fails if decompressed data exceeds max bytes
+func zstdDecoder(max int64) *zstd.Decoder {
+	if d, ok := zstdDecoders.Load(max); ok == true {
+		return d.(*zstd.Decoder)
+	}
+	d, _ := zstd.NewReader(nil, zstd.WithDecoderMaxMemory(uint64(max)))
+	if actual, loaded := zstdDecoders.LoadOrStore(max, d); loaded == true {
+		d.Close()
+		return actual.(*zstd.Decoder)
+	}
+	return d
+}
+
+func zstdDecode(src []byte, max int64) ([]byte, error) {
+	var h zstd.Header
+	if err := h.Decode(src); err != nil {
+		return nil, err
+	}
+	if h.HasFCS == true && h.FrameContentSize > uint64(max) {
+		return nil, &compressedSizeError{size: h.FrameContentSize, max: max}
+	}
+	data, err := zstdDecoder(max).DecodeAll(src, nil)
+	if err == zstd.ErrDecoderSizeExceeded {
+		return nil, &compressedSizeError{max: max}
+	}
+	return data, err
+}
+
+func snappyEncode(src []byte) []byte {
+	return snappy.Encode(nil, src)
+}
+
+func snappyDecode(src []byte, max int64) ([]byte, error) {
+	n, err := snappy.DecodedLen(src)
+	if err != nil {
+		return nil, err
+	}
+	if int64(n) > max {
+		return nil, &compressedSizeError{size: uint64(n), max: max}
+	}
+	return snappy.Decode(nil, src)
+}
+
+//compress returns frame with compressed body if the connection has negotiated a codec and compression is worth it
+func (cl *connLocker) compress(f frame) (frame, bool) {
+	if cl.codec == nil || f.payload == false || len(f.body) < cl.compression.Threshold {
+		return f, false
+	}
+	body := cl.codec.encode(f.body)
+	if len(body)+1 >= len(f.body) {
+		return f, false
+	}
+	c := newFrame()
+	c.head = append(c.head, f.head...)
+	c.head[len(c.head)-1] |= flagCompressed
+	c.head = append(c.head, cl.codec.id)
+	c.body = body
+	c.payload = true
+	if f.progress != nil {
+		//progress is reported in bytes of uncompressed payload, proportionally to compressed bytes written
+		progress, size := f.progress, len(f.body)
+		c.progress = func(sent, total int) {
+			if sent == total {
+				sent = size
+			} else {
+				sent = int(int64(sent) * int64(size) / int64(total))
+			}
+			progress(sent, size)
+		}
+	}
+	return c, true
+}
+
+//decompress returns payload of frame received over conn. Payload is decompressed if data type has flagCompressed. Violations close the connection
+func (peer *Peer) decompress(unit *Unit, conn *connLocker, t Datatype, raw []byte) (Datatype, []byte, error) {
+	if byte(t)&flagCompressed == 0 {
+		return t, raw, nil
+	}
+	t = Datatype(byte(t) &^ flagCompressed)
+	var c *codec
+	if len(raw) > 0 {
+		c = codecByID(raw[0])
+	}
+	if c == nil || hasFeature(conn.compression.Codecs, c.name) == false {
+		err := fmt.Errorf("payload is compressed by codec which was not negotiated")
+		go peer.closeOnViolation(unit, conn, errWrongDataType, err.Error())
+		return t, nil, err
+	}
+	data, err := c.decode(raw[1:], peer.sizeLimits.MaxMessage)
+	if err != nil {
+		code := errIncorrectMessageStructure
+		if _, ok := err.(*compressedSizeError); ok == true {
+			code = errMessageTooBig
+		}
+		go peer.closeOnViolation(unit, conn, code, err.Error())
+	}
+	return t, data, err
+}
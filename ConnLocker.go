@@ -2,53 +2,248 @@ package roletalk
 
 import (
 	"io"
+	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gorilla/websocket"
 )
 
 type connLocker struct {
-	conn         *websocket.Conn
-	mx           sync.Mutex
-	locked       bool
-	lockedMx     sync.RWMutex
+	conn     *websocket.Conn
+	lanes    writeLanes
+	lockedMx sync.RWMutex
+	unitID   string
+	metrics  Collector
+	keyID    string //id of the preshared key remote peer has proved during auth. Empty if local peer has no keys
+	done     chan struct{}
+	once     sync.Once
+	released int32
+	cw       countingWriter //cw is reused by the writer holding the connection
+	cr       countingReader //cr is reused by the only reading goroutine
+	//compression is local configuration of the connection. codec is negotiated during auth, nil if payloads are not compressed
+	compression Compression
+	codec       *codec
+	pong        chan struct{} //pong receives pongs to heartbeat pings, which have empty payload
+	probes      sync.Map      //key: payload of ping sent by probeRTT, value: *rttProbe
+	probeSeq    uint64
+}
+
+//rttProbe is ping waiting for pong
+type rttProbe struct {
+	start time.Time
+	done  func(rtt time.Duration)
 }
 
 func createConnLocker(conn *websocket.Conn) *connLocker {
-	return &connLocker{conn: conn}
+	cl := &connLocker{conn: conn, done: make(chan struct{}), pong: make(chan struct{}, 1)}
+	cl.cw.count = cl.countSent
+	cl.cr.count = cl.countReceived
+	conn.SetPongHandler(cl.handlePong)
+	return cl
 }
 
-func (cl *connLocker) isLocked() bool {
-	var locked bool
-	cl.lockedMx.RLock()
-	locked = cl.locked
-	cl.lockedMx.RUnlock()
-	return locked
+//probeRTT sends ping with unique payload. done is called with round trip time by the goroutine reading the connection when pong arrives, so it should not block.
+//Remote side echoes payload of ping as required by RFC 6455, so it works with any websocket peer
+func (cl *connLocker) probeRTT(done func(rtt time.Duration)) error {
+	key := strconv.FormatUint(atomic.AddUint64(&cl.probeSeq, 1), 36)
+	cl.probes.Store(key, &rttProbe{start: time.Now(), done: done})
+	err := cl.WriteControl(websocket.PingMessage, []byte(key), time.Now().Add(heartBeatTimeout))
+	if err != nil {
+		cl.probes.Delete(key)
+	}
+	return err
 }
 
-func (cl *connLocker) Lock() {
+func (cl *connLocker) handlePong(appData string) error {
+	if appData == "" {
+		select {
+		case cl.pong <- struct{}{}:
+		default:
+		}
+		return nil
+	}
+	if p, ok := cl.probes.Load(appData); ok == true {
+		cl.probes.Delete(appData)
+		probe := p.(*rttProbe)
+		probe.done(time.Since(probe.start))
+	}
+	return nil
+}
+
+//close closes underlying connection. Goroutines serving the connection stop on done. It is safe to call close several times
+func (cl *connLocker) close() {
+	cl.once.Do(func() {
+		close(cl.done)
+		cl.conn.Close()
+	})
+}
+
+//writeLanes hands the connection over to waiting writers by priority, FIFO within the same priority.
+//A lane which has been passed over maxLaneBypass times in a row gets the connection, so lower priorities are not starved
+type writeLanes struct {
+	mx      sync.Mutex
+	busy    bool
+	waiting [priorityLanes][]chan struct{}
+	skipped [priorityLanes]int //skipped counts handoffs to other lanes since the lane has got the connection last time while having waiters
+}
+
+func (wl *writeLanes) acquire(p Priority) {
+	wl.mx.Lock()
+	if wl.busy == false {
+		wl.busy = true
+		wl.mx.Unlock()
+		return
+	}
+	ch := make(chan struct{})
+	lane := p.lane()
+	wl.waiting[lane] = append(wl.waiting[lane], ch)
+	wl.mx.Unlock()
+	<-ch
+}
+
+//release passes the connection to the first writer of the highest non-empty lane, or of the lane which has been passed over too many times
+func (wl *writeLanes) release() {
+	wl.mx.Lock()
+	next := -1
+	for lane := priorityLanes - 1; lane >= 0; lane-- {
+		if len(wl.waiting[lane]) == 0 {
+			continue
+		}
+		if next == -1 || (wl.skipped[lane] >= maxLaneBypass && wl.skipped[lane] >= wl.skipped[next]) {
+			next = lane
+		}
+	}
+	if next == -1 {
+		wl.busy = false
+		wl.mx.Unlock()
+		return
+	}
+	for lane := range wl.skipped {
+		if lane == next || len(wl.waiting[lane]) == 0 {
+			wl.skipped[lane] = 0
+		} else {
+			wl.skipped[lane]++
+		}
+	}
+	ch := wl.waiting[next][0]
+	wl.waiting[next][0] = nil
+	wl.waiting[next] = wl.waiting[next][1:]
+	wl.mx.Unlock()
+	close(ch)
+}
+
+func (wl *writeLanes) isBusy() bool {
+	wl.mx.Lock()
+	defer wl.mx.Unlock()
+	return wl.busy
+}
+
+//closeAfter closes underlying connection if it is still open after d. It is used to give remote side time to confirm close frame
+func (cl *connLocker) closeAfter(d time.Duration) {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		cl.close()
+	case <-cl.done:
+	}
+}
+
+//release returns true only for the first call. It guards unit's cleanup of the connection
+func (cl *connLocker) release() bool {
+	return atomic.CompareAndSwapInt32(&cl.released, 0, 1)
+}
+
+//bindMetrics starts counting transferred bytes for the unit. Auth handshake is not counted
+func (cl *connLocker) bindMetrics(unitID string, metrics Collector) {
 	cl.lockedMx.Lock()
-	cl.locked = true
+	cl.unitID = unitID
+	cl.metrics = metrics
 	cl.lockedMx.Unlock()
-	cl.mx.Lock()
+}
+
+func (cl *connLocker) getMetrics() (string, Collector) {
+	cl.lockedMx.RLock()
+	defer cl.lockedMx.RUnlock()
+	return cl.unitID, cl.metrics
+}
+
+func (cl *connLocker) countSent(n int) {
+	if unitID, metrics := cl.getMetrics(); metrics != nil {
+		metrics.BytesSent(unitID, n)
+	}
+}
+
+func (cl *connLocker) countReceived(n int) {
+	if unitID, metrics := cl.getMetrics(); metrics != nil {
+		metrics.BytesReceived(unitID, n)
+	}
+}
+
+func (cl *connLocker) isLocked() bool {
+	return cl.lanes.isBusy()
+}
+
+//Lock takes the connection for writing with PriorityNormal
+func (cl *connLocker) Lock() {
+	cl.lanes.acquire(PriorityNormal)
+}
+
+//lockPriority takes the connection for writing. Writers waiting with higher priority get the connection first
+func (cl *connLocker) lockPriority(p Priority) {
+	cl.lanes.acquire(p)
 }
 
 func (cl *connLocker) Unlock() {
-	cl.mx.Unlock()
-	cl.lockedMx.Lock()
-	cl.locked = false
-	cl.lockedMx.Unlock()
+	cl.lanes.release()
 }
 
 func (cl *connLocker) WriteMessage(messageType int, data []byte) error {
+	return cl.writeMessagePriority(messageType, data, PriorityNormal)
+}
+
+func (cl *connLocker) writeMessagePriority(messageType int, data []byte, p Priority) error {
 	var err error
-	cl.Lock()
+	cl.lockPriority(p)
 	err = cl.conn.WriteMessage(messageType, data)
 	cl.Unlock()
+	if err == nil {
+		cl.countSent(len(data))
+	}
+	return err
+}
+
+//writeFrame writes header and body of f directly to websocket writer as one message
+func (cl *connLocker) writeFrame(f frame, p Priority) error {
+	cl.lockPriority(p)
+	err := cl.writeFrameLocked(f)
+	cl.Unlock()
+	if err == nil {
+		cl.countSent(f.size())
+	}
 	return err
 }
 
+func (cl *connLocker) writeFrameLocked(f frame) error {
+	//permessage-deflate is applied only if negotiated by websocket handshake
+	cl.conn.EnableWriteCompression(cl.compression.Deflate == true && f.size() >= cl.compression.Threshold)
+	w, err := cl.conn.NextWriter(websocket.BinaryMessage)
+	if err != nil {
+		return err
+	}
+	if _, err = w.Write(f.head); err != nil {
+		w.Close()
+		return err
+	}
+	if _, err = w.Write(f.body); err != nil {
+		w.Close()
+		return err
+	}
+	return w.Close()
+}
+
 func (cl *connLocker) ReadMessage() (messageType int, p []byte, err error) {
 	cl.Lock()
 	messageType, p, err = cl.conn.ReadMessage()
@@ -56,18 +251,25 @@ func (cl *connLocker) ReadMessage() (messageType int, p []byte, err error) {
 	return
 }
 
+//NextWriter returns writer counting sent bytes. It should be called only by the holder of the connection's lock
 func (cl *connLocker) NextWriter(messageType int) (io.WriteCloser, error) {
-	return cl.conn.NextWriter(messageType)
+	w, err := cl.conn.NextWriter(messageType)
+	if err != nil {
+		return nil, err
+	}
+	cl.cw.WriteCloser = w
+	return &cl.cw, nil
 }
 
 func (cl *connLocker) NextReader() (messageType int, r io.Reader, err error) {
-	return cl.conn.NextReader()
+	messageType, r, err = cl.conn.NextReader()
+	if err != nil {
+		return
+	}
+	cl.cr.Reader = r
+	return messageType, &cl.cr, nil
 }
 
 func (cl *connLocker) WriteControl(messageType int, data []byte, deadline time.Time) error {
 	return cl.conn.WriteControl(messageType, data, deadline)
 }
-
-func (cl *connLocker) SetPongHandler(h func(appData string) error) {
-	cl.conn.SetPongHandler(h)
-}
@@ -1,9 +1,12 @@
 package roletalk
 
 import (
+	"bytes"
 	"errors"
 	"io"
+	"math"
 	"sync"
+	"time"
 
 	"github.com/gorilla/websocket"
 )
@@ -18,15 +21,16 @@ type OriginData struct {
 //Data option is allowed to be changed by middleware. To get original data call OriginData().
 //Note: MessageContext has no relation to type Context (https://golang.org/pkg/context/#Context)
 type MessageContext struct {
-	conn    *connLocker
-	unit    *Unit
-	role    string
-	event   string
-	Data    interface{} //Payload of message. Feel free to be change it on your needs
-	origin  OriginData
-	w       byte
-	raw     []byte
-	channel correlation //specific for stream responses. Used here to prevent code complication
+	conn      *connLocker
+	unit      *Unit
+	role      string
+	event     string
+	Data      interface{} //Payload of message. Feel free to be change it on your needs
+	origin    OriginData
+	w         byte
+	raw       []byte
+	channel   correlation //specific for stream responses. Used here to prevent code complication
+	resumable bool        //resumable is true if stream request asks for resumable stream
 }
 
 //Role returns the role which message is addressed to
@@ -62,18 +66,21 @@ func (ctx *MessageContext) OriginData() OriginData {
 type RequestContext struct {
 	*MessageContext
 
-	Res  interface{}
-	Err  error
-	corr correlation
-	r    bool
-	cbs  []RequestHandler
+	Res      interface{}
+	Err      error
+	Priority Priority //Priority of the response and of frames of the stream created by Reply. Default is PriorityNormal
+	//OnProgress is called with number of response payload bytes written and payload size, in uncompressed bytes like EmitOptions.OnProgress. Large responses are fragmented if the unit supports it, so it is called after each fragment
+	OnProgress func(sent, total int)
+	corr       correlation
+	r          bool
+	cbs        []RequestHandler
 }
 
 //Reply stops middleware flow and responds to the message. If data argument is provided, it overrides Data option
 func (ctx *RequestContext) Reply(data interface{}) error {
 	var t byte
 	var d interface{}
-	var res []byte
+	var res frame
 	ctx.r = true
 	tRej := typeReject
 	tRes := typeResolve
@@ -90,13 +97,15 @@ func (ctx *RequestContext) Reply(data interface{}) error {
 		d = ctx.Res
 		t = tRes
 	}
-	b, e := markDataType(d)
+	dt, b, e := encodeData(d)
 	if e != nil {
 		return e
 	}
 
-	res = serializeResponse(t, ctx.corr, b)
-	_, err := ctx.Unit().writeMsgToSomeConnection(res)
+	res = responseFrame(t, ctx.corr, dt, b)
+	res.progress = ctx.OnProgress
+	_, err := ctx.Unit().writeMsgToSomeConnection(res, ctx.Priority)
+	res.release()
 
 	return err
 }
@@ -114,11 +123,27 @@ func (ctx *RequestContext) Reject(data interface{}) error {
 		return errors.New("data argument should be error, string or nil")
 	}
 	ctx.runCallbacks()
-	b, err := markDataType(ctx.Err)
+	dt, b, err := encodeData(ctx.Err)
+	if err != nil {
+		return err
+	}
+	res := responseFrame(typeReject, ctx.corr, dt, b)
+	_, err = ctx.Unit().writeMsgToSomeConnection(res, ctx.Priority)
+	res.release()
+	return err
+}
+
+//rejectRateLimited responds with structured rejection, which the requester turns into RateLimitedError
+func (ctx *RequestContext) rejectRateLimited(retryAfter time.Duration) error {
+	ctx.r = true
+	ms := int64(math.Ceil(float64(retryAfter) / float64(time.Millisecond)))
+	dt, b, err := encodeData(rejection{Code: rejectCodeRateLimited, Message: "Rate limited", RetryAfterMs: ms})
 	if err != nil {
 		return err
 	}
-	_, err = ctx.Unit().writeMsgToSomeConnection(serializeResponse(typeReject, ctx.corr, b))
+	res := responseFrame(typeReject, ctx.corr, dt, b)
+	_, err = ctx.Unit().writeMsgToSomeConnection(res, ctx.Priority)
+	res.release()
 	return err
 }
 
@@ -143,16 +168,16 @@ func (ctx *RequestContext) runCallbacks() {
 //ReaderRequestContext is context for incoming request to establish binary stream readable on this end
 type ReaderRequestContext struct {
 	*RequestContext
-	cbs []ReadableRequestHandler
+	cbs    []ReadableRequestHandler
+	Window StreamWindow //Window configures flow control of the stream. It should be set before Reply
 }
 
 //Reply stops middleware flow and responds to the message. If data argument is provided, it overwrites im.Data
 func (ctx *ReaderRequestContext) Reply(data interface{}) (*Readable, error) {
 	var t byte
 	var d interface{}
-	var res []byte
+	var res frame
 	var channel correlation
-	// var sc *streamChannel
 
 	ctx.r = true
 
@@ -169,27 +194,26 @@ func (ctx *ReaderRequestContext) Reply(data interface{}) (*Readable, error) {
 		d = ctx.Res
 		t = typeStreamResolve
 	}
-	b, e := markDataType(d)
+	dt, b, e := encodeData(d)
 	if e != nil {
 		return nil, e
 	}
 
-	channel, _ = ctx.Unit().streamCtr.createStream()
-	res = serializeStreamResponse(t, ctx.corr, channel, b)
-	conn, err := ctx.Unit().writeMsgToSomeConnection(res)
+	channel, sc := ctx.Unit().streamCtr.createStream(ctx.resumable)
+	res = streamResponseFrame(t, ctx.corr, channel, dt, b)
+	conn, err := ctx.Unit().writeMsgToSomeConnection(res, ctx.Priority)
+	res.release()
 	if err != nil {
 		ctx.Unit().streamCtr.delete(channel)
 		return nil, err
 	}
-	readable := &Readable{
-		unit:      ctx.Unit(),
-		conn:      conn,
-		c:         channel,
-		pref:      createStreamPrefix(channel, streamByteQuota),
-		quotaRem:  defQuotaSizeBytes,
-		quotaSize: defQuotaSizeBytes,
-	}
+	readable := newReadable(ctx.Unit(), channel, ctx.channel, sc, ctx.Priority, ctx.Window)
 	ctx.unit.streamCtr.bindConn(conn, channel)
+	if ctx.Err != nil {
+		ctx.unit.streamCtr.finish(channel)
+	} else {
+		readable.open()
+	}
 	return readable, nil
 }
 
@@ -213,7 +237,7 @@ func (ctx *WriterRequestContext) Then(cb func(ctx *WriterRequestContext)) {
 func (ctx *WriterRequestContext) Reply(data interface{}) (*Writable, error) {
 	var t byte
 	var d interface{}
-	var res []byte
+	var res frame
 	var channel correlation
 	var sc *streamChannel
 
@@ -232,172 +256,453 @@ func (ctx *WriterRequestContext) Reply(data interface{}) (*Writable, error) {
 		d = ctx.Res
 		t = typeStreamResolve
 	}
-	b, e := markDataType(d)
+	dt, b, e := encodeData(d)
 	if e != nil {
 		return nil, e
 	}
 
-	channel, sc = ctx.Unit().streamCtr.createStream()
-	res = serializeStreamResponse(t, ctx.corr, channel, b)
-	conn, err := ctx.Unit().writeMsgToSomeConnection(res)
+	channel, sc = ctx.Unit().streamCtr.createStream(ctx.resumable)
+	res = streamResponseFrame(t, ctx.corr, channel, dt, b)
+	conn, err := ctx.Unit().writeMsgToSomeConnection(res, ctx.Priority)
+	res.release()
 	if err != nil {
 		ctx.Unit().streamCtr.delete(channel)
 		return nil, err
 	}
-	writable := &Writable{unit: ctx.Unit(), conn: conn, pref: createStreamPrefix(channel, streamByteChunk), streamChannel: sc, quotaRem: defQuotaSizeBytes}
+	writable := newWritable(ctx.Unit(), channel, ctx.channel, sc, ctx.Priority)
 	ctx.unit.streamCtr.bindConn(conn, channel)
+	if ctx.Err != nil {
+		ctx.unit.streamCtr.finish(channel)
+	}
 	return writable, nil
 }
 
 //Readable implements Reader
 type Readable struct {
-	unit      *Unit
-	conn      *connLocker
-	c         correlation
-	pref      []byte
-	quotaRem  int
-	quotaSize int
-	quotaMx   sync.RWMutex
+	unit          *Unit
+	streamChannel *streamChannel
+	c             correlation //c is local channel of the stream
+	pref          []byte      //pref addresses frames to remote channel of the stream
+	quotaRem      int         //quotaRem is quota granted to remote writer and not used yet
+	quotaSize     int         //quotaSize is current window
+	quotaMx       sync.RWMutex
+	window        StreamWindow
+	consumed      int   //consumed is number of bytes read since RTT probe has been sent
+	probing       bool  //probing is true while RTT probe waits for pong
+	err           error //err is returned by all calls of Read after the stream has been finished
+	priority      Priority
+	release       func() //release replaces finishing of the stream if it is shared with Writable of Duplex
+	deadline      deadline
+	endOnce       sync.Once //endOnce prevents sending error to remote side twice
 }
 
 func (r *Readable) Read(p []byte) (n int, err error) {
+	if r.err != nil {
+		return 0, r.err
+	}
+	if r.deadline.exceeded() == true {
+		return 0, ErrDeadlineExceeded
+	}
 	unit := r.unit
 	streamCtr := &unit.streamCtr
 	c := r.c
 	sc, ok := streamCtr.getStreamChannel(c)
 	if ok == false {
-		return 0, errors.New("Stream closed")
+		return 0, r.closedErr()
 	}
 	buf := &sc.buf
+	//channel is not looked up again after waiting, since it could be finished by destroying the stream
+	for {
+		sc.mx.Lock()
+		n, err = buf.Read(p)
+		scErr := sc.err
+		sc.mx.Unlock()
+		switch {
+		case n != 0:
+			if grant := r.consume(n); grant > 0 {
+				go r.addQuota(grant)
+			}
+			return n, nil
+		case scErr != nil:
+			r.err = scErr
+			r.finish()
+			return 0, scErr
+		case err != io.EOF:
+			return 0, err
+		}
+		if sc.resume != nil {
+			//remote writer releases retained data, it could be waiting for it
+			unit.ackStream(sc, 0, false)
+		}
+		select {
+		case <-sc.signal:
+		case <-r.deadline.wait():
+			return 0, ErrDeadlineExceeded
+		}
+	}
+}
+
+//WriteTo implements io.WriterTo. It writes data to w as soon as it has been received, without copying it to intermediate buffer, until the stream is finished.
+//Remote end of the stream is not destroyed if w fails
+func (r *Readable) WriteTo(w io.Writer) (n int64, err error) {
+	if r.err != nil {
+		if r.err == io.EOF {
+			return 0, nil
+		}
+		return 0, r.err
+	}
+	sc, ok := r.unit.streamCtr.getStreamChannel(r.c)
+	if ok == false {
+		return 0, r.closedErr()
+	}
+	//received data is swapped with spare buffer, so w is not called under lock of the stream
+	var spare bytes.Buffer
+	for {
+		if r.deadline.exceeded() == true {
+			return n, ErrDeadlineExceeded
+		}
+		sc.mx.Lock()
+		if sc.buf.Len() > 0 {
+			sc.buf, spare = spare, sc.buf
+		}
+		scErr := sc.err
+		sc.mx.Unlock()
+		if m := spare.Len(); m > 0 {
+			written, werr := w.Write(spare.Bytes())
+			n += int64(written)
+			spare.Reset()
+			if grant := r.consume(m); grant > 0 {
+				go r.addQuota(grant)
+			}
+			if werr != nil {
+				return n, werr
+			}
+			continue
+		}
+		if scErr != nil {
+			r.err = scErr
+			r.finish()
+			if scErr == io.EOF {
+				return n, nil
+			}
+			return n, scErr
+		}
+		if sc.resume != nil {
+			r.unit.ackStream(sc, 0, false)
+		}
+		select {
+		case <-sc.signal:
+		case <-r.deadline.wait():
+			return n, ErrDeadlineExceeded
+		}
+	}
+}
+
+//Close stops reading and destroys the stream, so remote Writable gets io.ErrClosedPipe. Blocked Read returns io.ErrClosedPipe.
+//If remote side has finished the stream already, received data is discarded and nothing is sent
+func (r *Readable) Close() error {
+	sc := r.streamChannel
 	sc.mx.Lock()
-	n, err = buf.Read(p)
-	scErr := sc.err
+	finished := sc.err != nil
+	sc.buf.Reset()
 	sc.mx.Unlock()
-	switch {
-	case n != 0:
-		q := r.addRemQuota(-n)
-		if float64(q) < float64(r.quotaSize)*defStreamQuotaThreshold {
-			go r.addQuota(r.quotaSize - q)
-		}
-		return n, nil
-	case scErr != nil:
-		return 0, scErr
-	case err != io.EOF:
-		return 0, err
-	default:
-		<-sc.signal
-		return r.Read(p)
+	if finished == true {
+		r.finish()
+		return nil
 	}
+	sc.fail(io.ErrClosedPipe)
+	return r.Destroy(io.ErrClosedPipe)
+}
+
+//closedErr returns error of finished stream for calls made after the local channel has been released
+func (r *Readable) closedErr() error {
+	if err := r.streamChannel.getErr(); err != nil {
+		return err
+	}
+	return errors.New("Stream closed")
 }
 
 func (r *Readable) addQuota(q int) (err error) {
 	var writer io.WriteCloser
-	r.addRemQuota(q)
+	if r.streamChannel.resume != nil {
+		return r.unit.ackStream(r.streamChannel, q, true)
+	}
 	quotaSlice := serializeInt(q)
-	r.conn.Lock()
-	writer, err = r.conn.NextWriter(websocket.BinaryMessage)
+	conn := r.streamChannel.getConn()
+	//quota is flow control, the remote writer is stalled until it gets it
+	conn.lockPriority(PriorityControl)
+	writer, err = conn.NextWriter(websocket.BinaryMessage)
 	if err != nil {
-		r.conn.Unlock()
+		conn.Unlock()
 		return err
 	}
 	if _, err = writer.Write(r.pref); err != nil {
-		r.conn.Unlock()
+		conn.Unlock()
 		return err
 	}
 	if _, err = writer.Write(quotaSlice); err != nil {
-		r.conn.Unlock()
+		conn.Unlock()
 		return err
 	}
 	writer.Close()
-	r.conn.Unlock()
+	conn.Unlock()
 	return
 }
 
-//Destroy sends err end and closes stream
-func (r *Readable) Destroy(err error) error {
-	errMsg := append(r.pref[0:len(r.pref)-1], streamByteError)
-	errMsg = append(errMsg, []byte(err.Error())...)
-	return r.unit.writeToConn(r.conn, errMsg)
+//finish releases local channel of the stream
+func (r *Readable) finish() {
+	if r.release != nil {
+		r.release()
+		return
+	}
+	r.unit.streamCtr.finish(r.c)
+}
+
+//SetDeadline is the same as SetReadDeadline
+func (r *Readable) SetDeadline(t time.Time) error {
+	return r.SetReadDeadline(t)
 }
 
-func (r *Readable) addRemQuota(n int) int {
-	r.quotaMx.Lock()
-	q := r.quotaRem + n
-	r.quotaRem = q
-	r.quotaMx.Unlock()
-	return q
+//SetReadDeadline sets deadline for pending and future Read calls. After deadline has passed Read returns ErrDeadlineExceeded, the stream stays open. Zero t means no deadline
+func (r *Readable) SetReadDeadline(t time.Time) error {
+	r.deadline.set(t)
+	return nil
 }
 
-func (r *Readable) getRemQuota(n int) int {
-	r.quotaMx.RLock()
-	q := r.quotaRem
-	r.quotaMx.RUnlock()
-	return q
+//destroyOnTimeout fails local channel and sends err to remote side
+func (r *Readable) destroyOnTimeout(kind StreamTimeoutKind, err error) {
+	r.unit.peer.metrics.StreamTimeout(r.unit.id, kind)
+	r.unit.streamCtr.setErr(r.c, err)
+	r.Destroy(err)
+}
+
+//Destroy sends err end and closes stream. Only the first call has effect
+func (r *Readable) Destroy(err error) (res error) {
+	r.endOnce.Do(func() {
+		r.finish()
+		errMsg := append(r.pref[0:len(r.pref)-1], streamByteError)
+		errMsg = append(errMsg, []byte(err.Error())...)
+		conn := r.streamChannel.getConn()
+		if conn == nil {
+			//resumable stream waits for connection, remote side learns about destroying when resuming fails
+			res = errors.New(errConnClosed)
+			return
+		}
+		res = r.unit.writeToConn(conn, rawFrame(errMsg), r.priority)
+	})
+	return
 }
 
 //Writable implement WriteCLoser
 type Writable struct {
-	unit *Unit
-	conn *connLocker
-	// c             correlation
-	pref          []byte
+	unit          *Unit
+	c             correlation //c is local channel of the stream
+	pref          []byte      //pref addresses frames to remote channel of the stream
 	streamChannel *streamChannel
 	quotaRem      int
+	priority      Priority
+	release       func() //release replaces finishing of the stream if it is shared with Readable of Duplex
+	deadline      deadline
+	endOnce       sync.Once //endOnce prevents sending end of the stream twice, since remote channel could be reused by then
+}
+
+//newWritable creates writable end of a stream
+func newWritable(unit *Unit, channel, remote correlation, sc *streamChannel, p Priority) *Writable {
+	sc.establish(remote, p)
+	return &Writable{unit: unit, c: channel, pref: createStreamPrefix(remote, streamByteChunk), streamChannel: sc, quotaRem: defQuotaSizeBytes, priority: p}
 }
 
+//Write splits p into chunks limited by stream quota and maxStreamChunk, so frames of other messages can be written in between.
+//It blocks while remote side has no quota
 func (w *Writable) Write(p []byte) (n int, err error) {
+	for len(p) > 0 {
+		var m int
+		m, err = w.writeChunk(p)
+		n += m
+		if err != nil {
+			return
+		}
+		p = p[m:]
+	}
+	return
+}
+
+func (w *Writable) writeChunk(p []byte) (n int, err error) {
 	var writer io.WriteCloser
-	var quota int
-	err = w.streamChannel.getErr()
+	size, err := w.waitQuota()
 	if err != nil {
-		return 0, w.streamChannel.err
-	}
-	w.streamChannel.mx.Lock()
-	quota = w.streamChannel.quota
-	w.streamChannel.mx.Unlock()
-	w.quotaRem += quota
-	select {
-	case <-w.streamChannel.signal:
-		if err = w.streamChannel.err; err != nil {
-			return 0, err
-		}
-	default:
+		return 0, err
+	}
+	if size > len(p) {
+		size = len(p)
 	}
-	if w.quotaRem <= 0 {
-		<-w.streamChannel.signal
-		return w.Write(p)
+	if w.streamChannel.resume != nil {
+		return w.writeSeqChunk(p[:size])
 	}
 
-	w.conn.Lock()
-	writer, err = w.conn.NextWriter(websocket.BinaryMessage)
+	conn := w.streamChannel.getConn()
+	conn.lockPriority(w.priority)
+	writer, err = conn.NextWriter(websocket.BinaryMessage)
 	if err != nil {
-		w.conn.Unlock()
+		conn.Unlock()
 		return 0, err
 	}
 	if _, err = writer.Write(w.pref); err != nil {
-		w.conn.Unlock()
+		conn.Unlock()
 		return 0, err
 	}
-	if n, err = writer.Write(p); err != nil {
-		w.conn.Unlock()
+	if n, err = writer.Write(p[:size]); err != nil {
+		conn.Unlock()
 		return 0, err
 	}
 	err = writer.Close()
-	w.conn.Unlock()
+	conn.Unlock()
 	w.quotaRem -= n
+	w.streamChannel.touch()
 	return
 }
 
+//ReadFrom implements io.ReaderFrom. Data is read from src straight into chunks sized to quota granted by remote reader, so nothing is buffered twice.
+//It returns after src has reached io.EOF without closing the stream
+func (w *Writable) ReadFrom(src io.Reader) (n int64, err error) {
+	var size, m, written int
+	var rerr error
+	buf := make([]byte, maxStreamChunk)
+	for {
+		if size, err = w.waitQuota(); err != nil {
+			return
+		}
+		m, rerr = src.Read(buf[:size])
+		if m > 0 {
+			written, err = w.Write(buf[:m])
+			n += int64(written)
+			if err != nil {
+				return
+			}
+		}
+		if rerr == io.EOF {
+			return n, nil
+		}
+		if rerr != nil {
+			return n, rerr
+		}
+	}
+}
+
+//waitQuota waits until remote reader has granted quota and returns size of chunk which can be written
+func (w *Writable) waitQuota() (size int, err error) {
+	var stall <-chan time.Time
+	for {
+		if w.deadline.exceeded() == true {
+			return 0, ErrDeadlineExceeded
+		}
+		if err = w.streamChannel.getWriteErr(); err != nil {
+			w.finish()
+			return 0, err
+		}
+		size, suspended := w.available()
+		if size > 0 {
+			return size, nil
+		}
+		//suspended stream waits for connection rather than for quota
+		if suspended == false && stall == nil && w.unit.peer.stallTimeout > 0 {
+			timer := time.NewTimer(w.unit.peer.stallTimeout)
+			defer timer.Stop()
+			stall = timer.C
+		}
+		select {
+		case <-w.streamChannel.quotaSignal:
+		case <-w.deadline.wait():
+			return 0, ErrDeadlineExceeded
+		case <-stall:
+			w.destroyOnTimeout(StreamStalled, ErrStreamStalled)
+			return 0, ErrStreamStalled
+		}
+	}
+}
+
+//available returns size of chunk which can be written now. Resumable stream has nothing available while it is suspended
+func (w *Writable) available() (size int, suspended bool) {
+	sc := w.streamChannel
+	sc.mx.Lock()
+	if res := sc.resume; res != nil {
+		if res.suspended == true || sc.conn == nil {
+			sc.mx.Unlock()
+			return 0, true
+		}
+		size = int(int64(defQuotaSizeBytes) + res.quota - res.sent)
+		if room := w.unit.peer.resume.Buffer - len(res.retained); size > room {
+			size = room
+		}
+	} else {
+		w.quotaRem += sc.quota
+		sc.quota = 0
+		size = w.quotaRem
+	}
+	sc.mx.Unlock()
+	if size > maxStreamChunk {
+		size = maxStreamChunk
+	}
+	return size, false
+}
+
+//SetDeadline is the same as SetWriteDeadline
+func (w *Writable) SetDeadline(t time.Time) error {
+	return w.SetWriteDeadline(t)
+}
+
+//SetWriteDeadline sets deadline for pending and future Write calls. After deadline has passed Write returns ErrDeadlineExceeded, the stream stays open.
+//Part of data could be written before. Zero t means no deadline
+func (w *Writable) SetWriteDeadline(t time.Time) error {
+	w.deadline.set(t)
+	return nil
+}
+
+//destroyOnTimeout fails local channel and sends err to remote side. Readable end of Duplex gets err too
+func (w *Writable) destroyOnTimeout(kind StreamTimeoutKind, err error) {
+	w.unit.peer.metrics.StreamTimeout(w.unit.id, kind)
+	w.streamChannel.fail(err)
+	w.Destroy(err)
+}
+
+//finish releases local channel of the stream
+func (w *Writable) finish() {
+	if w.release != nil {
+		w.release()
+		return
+	}
+	w.unit.streamCtr.finish(w.c)
+}
+
 //Close successfully
 func (w *Writable) Close() error {
-	errMsg := append(w.pref[0:len(w.pref)-1], streamByteFinish)
-	err := w.unit.writeToConn(w.conn, errMsg)
-	return err
+	return w.end(streamByteFinish, nil)
+}
+
+//CloseWithError closes the stream like io.PipeWriter does: remote Readable gets err instead of io.EOF. Nil err closes the stream successfully
+func (w *Writable) CloseWithError(err error) error {
+	if err == nil {
+		return w.Close()
+	}
+	return w.Destroy(err)
 }
 
 //Destroy sends err end and closes stream
 func (w *Writable) Destroy(err error) error {
-	errMsg := append(w.pref[0:len(w.pref)-1], streamByteError)
-	errMsg = append(errMsg, []byte(err.Error())...)
-	return w.unit.writeToConn(w.conn, errMsg)
+	return w.end(streamByteError, []byte(err.Error()))
+}
+
+//end finishes the stream and sends end frame of type b to remote side. Only the first call has effect
+func (w *Writable) end(b byte, payload []byte) (err error) {
+	w.endOnce.Do(func() {
+		if w.streamChannel.resume != nil {
+			err = w.endSeq(b, payload)
+			return
+		}
+		w.finish()
+		msg := append(w.pref[0:len(w.pref)-1], b)
+		msg = append(msg, payload...)
+		err = w.unit.writeToConn(w.streamChannel.getConn(), rawFrame(msg), w.priority)
+	})
+	return
 }
@@ -1,6 +1,7 @@
 package roletalk
 
 import (
+	"context"
 	"sync"
 	"time"
 )
@@ -16,6 +17,7 @@ type Destination struct {
 	unitIndex     uint32
 	closeHandlers []func()
 	unitHandlers  []unitHandler
+	limiter       destLimiter
 }
 
 //Name returns Destination's name
@@ -57,57 +59,46 @@ func (dest *Destination) Ready() bool {
 
 //Send sends one-way message to remote peer (Unit). Returns error if message has not been written to underlying connection
 func (dest *Destination) Send(event string, opts EmitOptions) error {
-	var unit *Unit
-	var err error
-	if opts.Unit != nil {
-		unit = opts.Unit
-	} else {
-		if unit, err = dest.nextUnit(); err != nil {
-			return err
-		}
+	unit, _, err := dest.acquire(opts, false, time.Time{})
+	if err != nil {
+		return err
 	}
-	return unit.send(emitStruct{event: event, role: dest.name, timeout: opts.Timeout, data: opts.Data})
+	return unit.send(emitStruct{event: event, role: dest.name, timeout: opts.Timeout, data: opts.Data, priority: opts.Priority, progress: opts.OnProgress})
 }
 
 //Request emits request message to remote peer (Unit). Returns error if remote peer rejected the request or request timed out, otherwise returns response context
 func (dest *Destination) Request(event string, opts EmitOptions) (res *MessageContext, err error) {
-	var unit *Unit
-	if opts.Unit != nil {
-		unit = opts.Unit
-	} else {
-		if unit, err = dest.nextUnit(); err != nil {
-			return
-		}
+	start := time.Now()
+	unit, release, err := dest.acquire(opts, true, start.Add(timeoutLeft(opts.Timeout, start)))
+	if err != nil {
+		return
 	}
-	return unit.request(emitStruct{event: event, role: dest.name, timeout: opts.Timeout, data: opts.Data, ignoreUnitClose: opts.IgnoreUnitClose})
+	defer release()
+	return unit.request(emitStruct{event: event, role: dest.name, timeout: timeoutLeft(opts.Timeout, start), data: opts.Data, ignoreUnitClose: opts.IgnoreUnitClose, priority: opts.Priority, progress: opts.OnProgress})
 }
 
 //NewReader requests for creating binary stream session and returns its readable end.
 //Returns error if remote peer rejected the request or request timed out
 func (dest *Destination) NewReader(event string, opts EmitOptions) (res *MessageContext, r *Readable, err error) {
-	var unit *Unit
-	if opts.Unit != nil {
-		unit = opts.Unit
-	} else {
-		if unit, err = dest.nextUnit(); err != nil {
-			return
-		}
+	start := time.Now()
+	unit, release, err := dest.acquire(opts, true, start.Add(timeoutLeft(opts.Timeout, start)))
+	if err != nil {
+		return
 	}
-	return unit.newReader(emitStruct{event: event, role: dest.name, timeout: opts.Timeout, data: opts.Data, ignoreUnitClose: opts.IgnoreUnitClose})
+	defer release()
+	return unit.newReader(emitStruct{event: event, role: dest.name, timeout: timeoutLeft(opts.Timeout, start), data: opts.Data, ignoreUnitClose: opts.IgnoreUnitClose, priority: opts.Priority, progress: opts.OnProgress, idleTimeout: opts.IdleTimeout, window: opts.Window, resumable: opts.Resumable})
 }
 
 //NewWriter requests for creating binary stream session and returns its writable end.
 //Returns error if remote peer rejected the request or request timed out
 func (dest *Destination) NewWriter(event string, opts EmitOptions) (res *MessageContext, writable *Writable, err error) {
-	var unit *Unit
-	if opts.Unit != nil {
-		unit = opts.Unit
-	} else {
-		if unit, err = dest.nextUnit(); err != nil {
-			return
-		}
+	start := time.Now()
+	unit, release, err := dest.acquire(opts, true, start.Add(timeoutLeft(opts.Timeout, start)))
+	if err != nil {
+		return
 	}
-	return unit.newWriter(emitStruct{event: event, role: dest.name, timeout: opts.Timeout, data: opts.Data, ignoreUnitClose: opts.IgnoreUnitClose})
+	defer release()
+	return unit.newWriter(emitStruct{event: event, role: dest.name, timeout: timeoutLeft(opts.Timeout, start), data: opts.Data, ignoreUnitClose: opts.IgnoreUnitClose, priority: opts.Priority, progress: opts.OnProgress, idleTimeout: opts.IdleTimeout, resumable: opts.Resumable})
 }
 
 //OnClose adds handler function f which runs synchronosly with other close handlers in FIFO order when last Unit gets disconnected
@@ -127,9 +118,22 @@ func (dest *Destination) OnUnit(f func(unit *Unit)) {
 //EmitOptions determines Data to send and additional transfer options. All fields are optional.
 //Specify Unit to send data to; Timeout for callback (Timeout option is ignored for Send and Broadcast methods);
 //If IgnoreUnitClose is true, request will not be rejected internally when communicated unit disconnects, but timeout will still has its place.
+//Context bounds waiting for capacity when DestinationLimits are reached. Time spent waiting counts against Timeout.
+//Priority applies to the message and to frames of the stream created by NewReader or NewWriter.
+//OnProgress is called with number of payload bytes written and payload size. If the payload is compressed, written compressed bytes are scaled to the uncompressed size. Large payloads are fragmented if the unit supports it, so OnProgress is called after each fragment; otherwise once.
+//IdleTimeout destroys stream created by NewReader, NewWriter or NewDuplex if no data has been transferred in either direction within it. Both ends get ErrStreamIdle. Zero disables it.
+//Window configures flow control of stream created by NewReader or NewDuplex. Window of stream created by NewWriter is configured by remote reader with ReaderRequestContext.Window.
+//Resumable makes stream survive loss of the connection carrying it: it continues over another connection of the unit or after the unit reconnects (see PeerOptions.StreamResume).
+//Writers of resumable stream retain data until it is acknowledged, so it costs memory. It fails with ErrResumeUnsupported if the unit does not support it.
 type EmitOptions struct {
 	Data            interface{}
 	Unit            *Unit
 	Timeout         time.Duration
 	IgnoreUnitClose bool
+	Context         context.Context
+	Priority        Priority
+	OnProgress      func(sent, total int)
+	IdleTimeout     time.Duration
+	Window          StreamWindow
+	Resumable       bool
 }
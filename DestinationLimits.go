@@ -0,0 +1,177 @@
+package roletalk
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+//ErrDestinationSaturated is returned by Destination's emitting methods when DestinationLimits are reached and FailFast is set,
+//or when waiting for capacity has exceeded request's Timeout
+var ErrDestinationSaturated = errors.New("Destination saturated: client-side limit reached")
+
+//DestinationLimits restricts outgoing communication of a Destination to protect fragile remote roles. Zero value means no limits.
+//A request is in flight until its response is received. For NewReader and NewWriter it is until the stream is accepted or rejected
+type DestinationLimits struct {
+	MaxInFlight        int       `json:"maxInFlight"`        //MaxInFlight is max number of requests in flight to all units. 0 means no limit
+	MaxInFlightPerUnit int       `json:"maxInFlightPerUnit"` //MaxInFlightPerUnit is max number of requests in flight to each unit. Saturated units are skipped by load balancing
+	Rate               RateLimit `json:"rate"`               //Rate limits messages and requests sent by the Destination
+	FailFast           bool      `json:"failFast"`           //FailFast makes emitting methods return ErrDestinationSaturated instead of waiting for capacity
+}
+
+//SetLimits replaces client-side limits of the Destination. Requests which are already in flight are counted against new limits
+func (dest *Destination) SetLimits(limits DestinationLimits) {
+	l := &dest.limiter
+	l.mx.Lock()
+	l.limits = limits
+	l.bucket = nil
+	if limits.Rate.Rate > 0 {
+		l.bucket = newBucket(limits.Rate, time.Now())
+	}
+	if l.perUnit == nil {
+		l.perUnit = make(map[*Unit]int)
+	}
+	l.wake()
+	l.mx.Unlock()
+}
+
+//Limits returns client-side limits of the Destination
+func (dest *Destination) Limits() DestinationLimits {
+	dest.limiter.mx.Lock()
+	defer dest.limiter.mx.Unlock()
+	return dest.limiter.limits
+}
+
+//destLimiter counts requests in flight and holds send rate bucket of a Destination
+type destLimiter struct {
+	mx       sync.Mutex
+	limits   DestinationLimits
+	bucket   *bucket
+	inFlight int
+	perUnit  map[*Unit]int
+	released chan struct{} //released is closed and replaced when capacity may have become available
+}
+
+//wake releases waiters so they check limits again. Should be called under mx
+func (l *destLimiter) wake() {
+	if l.released != nil {
+		close(l.released)
+	}
+	l.released = make(chan struct{})
+}
+
+func (l *destLimiter) enabled(request bool) bool {
+	if l.bucket != nil {
+		return true
+	}
+	return request == true && (l.limits.MaxInFlight > 0 || l.limits.MaxInFlightPerUnit > 0)
+}
+
+func (l *destLimiter) unitFree(unit *Unit) bool {
+	return l.limits.MaxInFlightPerUnit <= 0 || l.perUnit[unit] < l.limits.MaxInFlightPerUnit
+}
+
+func (l *destLimiter) release(unit *Unit) {
+	l.mx.Lock()
+	l.inFlight--
+	if l.perUnit[unit]--; l.perUnit[unit] <= 0 {
+		delete(l.perUnit, unit)
+	}
+	l.wake()
+	l.mx.Unlock()
+}
+
+//acquire chooses a unit within the Destination's limits and takes a token of send rate.
+//If request is true, the returned release function must be called when the request is over.
+//Waiting is bounded by opts.Context and, for requests, by the deadline
+func (dest *Destination) acquire(opts EmitOptions, request bool, deadline time.Time) (*Unit, func(), error) {
+	l := &dest.limiter
+	var cancel <-chan struct{}
+	if opts.Context != nil {
+		cancel = opts.Context.Done()
+	}
+	var expired <-chan time.Time
+	for {
+		l.mx.Lock()
+		if l.enabled(request) == false {
+			l.mx.Unlock()
+			unit, err := dest.pickUnit(opts.Unit, nil)
+			return unit, func() {}, err
+		}
+		var wait time.Duration
+		if l.bucket != nil {
+			wait = l.bucket.refill(time.Now())
+		}
+		var unit *Unit
+		if wait == 0 && (request == false || l.limits.MaxInFlight <= 0 || l.inFlight < l.limits.MaxInFlight) {
+			var usable func(*Unit) bool
+			if request == true {
+				usable = l.unitFree
+			}
+			var err error
+			if unit, err = dest.pickUnit(opts.Unit, usable); err != nil {
+				l.mx.Unlock()
+				return nil, nil, err
+			}
+		}
+		if unit != nil {
+			if l.bucket != nil {
+				l.bucket.tokens--
+			}
+			if request == false {
+				l.mx.Unlock()
+				return unit, func() {}, nil
+			}
+			l.inFlight++
+			l.perUnit[unit]++
+			l.mx.Unlock()
+			var once sync.Once
+			return unit, func() { once.Do(func() { l.release(unit) }) }, nil
+		}
+		if l.limits.FailFast == true {
+			l.mx.Unlock()
+			return nil, nil, ErrDestinationSaturated
+		}
+		released := l.released
+		l.mx.Unlock()
+		if expired == nil && request == true {
+			timer := time.NewTimer(time.Until(deadline))
+			defer timer.Stop()
+			expired = timer.C
+		}
+		var retry <-chan time.Time
+		var timer *time.Timer
+		if wait > 0 {
+			timer = time.NewTimer(wait)
+			retry = timer.C
+		}
+		var err error
+		select {
+		case <-released:
+		case <-retry:
+		case <-expired:
+			err = ErrDestinationSaturated
+		case <-cancel:
+			err = opts.Context.Err()
+		case <-dest.peer.done:
+			err = errPeerShutdown
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+}
+
+//pickUnit returns the unit if it is specified and usable, otherwise next usable unit. Returns nil unit if none of units is usable
+func (dest *Destination) pickUnit(unit *Unit, usable func(*Unit) bool) (*Unit, error) {
+	if unit == nil {
+		return dest.nextUnit(usable)
+	}
+	if usable == nil || usable(unit) == true {
+		return unit, nil
+	}
+	return nil, nil
+}
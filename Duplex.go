@@ -0,0 +1,210 @@
+package roletalk
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+//ErrDuplexUnsupported is returned by NewDuplex if the unit has not announced support of duplex streams, e.g. it runs older version of roletalk
+var ErrDuplexUnsupported = errors.New("Unit does not support duplex streams")
+
+var errDuplexClosed = errors.New("Stream closed")
+
+//Duplex is bidirectional binary stream. It implements net.Conn, so protocols built on top of net.Conn (HTTP, gRPC) can run over it.
+//Each direction has its own flow control quota, so a stalled reader on one side does not block writing in the opposite direction
+type Duplex struct {
+	r     *Readable
+	w     *Writable
+	role  string
+	event string
+}
+
+//StreamAddr is address of an end of duplex stream. It implements net.Addr
+type StreamAddr struct {
+	ID    string //ID of the peer or unit
+	Role  string
+	Event string
+}
+
+//Network returns "roletalk"
+func (a StreamAddr) Network() string {
+	return "roletalk"
+}
+
+func (a StreamAddr) String() string {
+	return fmt.Sprintf("%v/%v/%v", a.ID, a.Role, a.Event)
+}
+
+//newDuplex creates ends of the stream which share local channel. The channel is finished when both ends are done
+func newDuplex(unit *Unit, role, event string, channel, remote correlation, sc *streamChannel, p Priority, window StreamWindow) *Duplex {
+	halves := int32(2)
+	release := func() {
+		if atomic.AddInt32(&halves, -1) == 0 {
+			unit.streamCtr.finish(channel)
+		}
+	}
+	var rOnce, wOnce sync.Once
+	r := newReadable(unit, channel, remote, sc, p, window)
+	r.release = func() { rOnce.Do(release) }
+	w := newWritable(unit, channel, remote, sc, p)
+	w.release = func() { wOnce.Do(release) }
+	return &Duplex{
+		r:     r,
+		w:     w,
+		role:  role,
+		event: event,
+	}
+}
+
+//Read reads data written by remote side. It returns io.EOF after remote side has called CloseWrite or Close
+func (d *Duplex) Read(p []byte) (int, error) {
+	return d.r.Read(p)
+}
+
+//Write writes p to remote side. It blocks while remote side has no quota
+func (d *Duplex) Write(p []byte) (int, error) {
+	return d.w.Write(p)
+}
+
+//WriteTo writes data received from remote side to w until remote side has closed writing. See Readable.WriteTo
+func (d *Duplex) WriteTo(w io.Writer) (int64, error) {
+	return d.r.WriteTo(w)
+}
+
+//ReadFrom writes data read from src to remote side until src reaches io.EOF. See Writable.ReadFrom
+func (d *Duplex) ReadFrom(src io.Reader) (int64, error) {
+	return d.w.ReadFrom(src)
+}
+
+//CloseWrite closes writing direction of the stream. Remote side reads io.EOF, while local side still can read
+func (d *Duplex) CloseWrite() error {
+	return d.w.Close()
+}
+
+//Close closes writing direction and stops reading. Blocked Read and Write return error. Data sent by remote side afterwards is discarded
+func (d *Duplex) Close() error {
+	d.w.streamChannel.fail(errDuplexClosed)
+	err := d.CloseWrite()
+	d.r.finish()
+	return err
+}
+
+//Destroy sends err to remote side and closes both directions of the stream
+func (d *Duplex) Destroy(err error) error {
+	d.w.endOnce.Do(d.w.finish)
+	return d.r.Destroy(err)
+}
+
+//LocalAddr returns address of local peer
+func (d *Duplex) LocalAddr() net.Addr {
+	return StreamAddr{ID: d.r.unit.peer.id, Role: d.role, Event: d.event}
+}
+
+//RemoteAddr returns address of the unit
+func (d *Duplex) RemoteAddr() net.Addr {
+	return StreamAddr{ID: d.r.unit.id, Role: d.role, Event: d.event}
+}
+
+//SetDeadline sets read and write deadlines. Zero t means no deadline
+func (d *Duplex) SetDeadline(t time.Time) error {
+	d.r.SetReadDeadline(t)
+	return d.w.SetWriteDeadline(t)
+}
+
+//SetReadDeadline sets deadline for pending and future Read calls. See Readable.SetReadDeadline
+func (d *Duplex) SetReadDeadline(t time.Time) error {
+	return d.r.SetReadDeadline(t)
+}
+
+//SetWriteDeadline sets deadline for pending and future Write calls. See Writable.SetWriteDeadline
+func (d *Duplex) SetWriteDeadline(t time.Time) error {
+	return d.w.SetWriteDeadline(t)
+}
+
+//destroyOnTimeout fails both directions locally and sends err to remote side
+func (d *Duplex) destroyOnTimeout(kind StreamTimeoutKind, err error) {
+	d.r.unit.peer.metrics.StreamTimeout(d.r.unit.id, kind)
+	d.w.streamChannel.fail(err)
+	d.Destroy(err)
+}
+
+//NewDuplex requests for creating bidirectional binary stream session and returns its local end.
+//Returns ErrDuplexUnsupported if chosen unit does not support duplex streams, or error if remote peer rejected the request or request timed out
+func (dest *Destination) NewDuplex(event string, opts EmitOptions) (res *MessageContext, duplex *Duplex, err error) {
+	start := time.Now()
+	unit, release, err := dest.acquire(opts, true, start.Add(timeoutLeft(opts.Timeout, start)))
+	if err != nil {
+		return
+	}
+	defer release()
+	return unit.newDuplex(emitStruct{event: event, role: dest.name, timeout: timeoutLeft(opts.Timeout, start), data: opts.Data, ignoreUnitClose: opts.IgnoreUnitClose, priority: opts.Priority, progress: opts.OnProgress, idleTimeout: opts.IdleTimeout, window: opts.Window, resumable: opts.Resumable})
+}
+
+//Dial establishes duplex stream with a unit serving the destination and returns it as net.Conn. Remote side accepts it with Role.Listen or Role.OnDuplex
+func (dest *Destination) Dial(event string, opts EmitOptions) (net.Conn, error) {
+	_, duplex, err := dest.NewDuplex(event, opts)
+	if err != nil {
+		return nil, err
+	}
+	return duplex, nil
+}
+
+//DuplexRequestContext is context for incoming request to establish bidirectional binary stream
+type DuplexRequestContext struct {
+	*RequestContext
+	cbs    []DuplexRequestHandler
+	Window StreamWindow //Window configures flow control of readable direction of the stream. It should be set before Reply
+}
+
+//Then binds middleware to message context. Middleware runs in LIFO order
+func (ctx *DuplexRequestContext) Then(cb func(ctx *DuplexRequestContext)) {
+	ctx.cbs = append(ctx.cbs, cb)
+}
+
+//Reply stops middleware flow and responds to the message. If data argument is provided, it overwrites im.Data
+func (ctx *DuplexRequestContext) Reply(data interface{}) (*Duplex, error) {
+	var t byte
+	var d interface{}
+
+	ctx.r = true
+
+	if data != nil {
+		ctx.Res = data
+	}
+
+	ctx.runCallbacks()
+
+	if ctx.Err != nil {
+		d = ctx.Err
+		t = typeStreamReject
+	} else {
+		d = ctx.Res
+		t = typeStreamResolve
+	}
+	dt, b, e := encodeData(d)
+	if e != nil {
+		return nil, e
+	}
+
+	channel, sc := ctx.Unit().streamCtr.createStream(ctx.resumable)
+	res := streamResponseFrame(t, ctx.corr, channel, dt, b)
+	conn, err := ctx.Unit().writeMsgToSomeConnection(res, ctx.Priority)
+	res.release()
+	if err != nil {
+		ctx.Unit().streamCtr.delete(channel)
+		return nil, err
+	}
+	duplex := newDuplex(ctx.Unit(), ctx.role, ctx.event, channel, ctx.channel, sc, ctx.Priority, ctx.Window)
+	ctx.unit.streamCtr.bindConn(conn, channel)
+	if ctx.Err != nil {
+		ctx.unit.streamCtr.finish(channel)
+	} else {
+		duplex.r.open()
+	}
+	return duplex, nil
+}
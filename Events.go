@@ -0,0 +1,127 @@
+package roletalk
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+//EventType identifies lifecycle event of a Peer
+type EventType string
+
+const (
+	//EventConnOpened is emitted when authenticated connection has been bound to a unit
+	EventConnOpened EventType = "conn_opened"
+	//EventConnClosed is emitted when connection of a unit has been closed. CloseCode is set if remote side sent close frame
+	EventConnClosed EventType = "conn_closed"
+	//EventAuthSucceeded is emitted when connection has passed authentication
+	EventAuthSucceeded EventType = "auth_succeeded"
+	//EventAuthFailed is emitted when connection has not passed authentication or has incompatible protocol version
+	EventAuthFailed EventType = "auth_failed"
+	//EventUnitAdded is emitted when Peer gets new Unit
+	EventUnitAdded EventType = "unit_added"
+	//EventUnitRemoved is emitted when last connection of a Unit has been closed
+	EventUnitRemoved EventType = "unit_removed"
+	//EventUnitRolesChanged is emitted when remote peer announced new set of roles. See AddedRoles and RemovedRoles
+	EventUnitRolesChanged EventType = "unit_roles_changed"
+	//EventDestinationReady is emitted when Destination gets its first unit
+	EventDestinationReady EventType = "destination_ready"
+	//EventDestinationUnready is emitted when Destination loses its last unit
+	EventDestinationUnready EventType = "destination_unready"
+	//EventAcquaintReceived is emitted when unit introduced another peer
+	EventAcquaintReceived EventType = "acquaint_received"
+	//EventAcquaintFollowed is emitted when Peer decided to connect to the introduced peer
+	EventAcquaintFollowed EventType = "acquaint_followed"
+	//EventReconnectAttempt is emitted before Peer tries to reconnect to Address
+	EventReconnectAttempt EventType = "reconnect_attempt"
+	//EventReconnectSucceeded is emitted when Peer reconnected to Address
+	EventReconnectSucceeded EventType = "reconnect_succeeded"
+	//EventReconnectGaveUp is emitted when Peer stopped reconnecting to Address because the unit has been closed manually
+	EventReconnectGaveUp EventType = "reconnect_gave_up"
+)
+
+//Event describes lifecycle change of a Peer. Only fields related to Type are set
+type Event struct {
+	Type         EventType `json:"type"`
+	Time         time.Time `json:"time"`
+	UnitID       string    `json:"unitId,omitempty"`
+	UnitName     string    `json:"unitName,omitempty"`
+	Address      string    `json:"address,omitempty"`
+	Destination  string    `json:"destination,omitempty"`
+	AddedRoles   []string  `json:"addedRoles,omitempty"`
+	RemovedRoles []string  `json:"removedRoles,omitempty"`
+	CloseCode    int       `json:"closeCode,omitempty"`
+	Err          error     `json:"-"`
+}
+
+//Subscription delivers Peer's events to channel C. Events are never blocking the Peer: if C is full, event is dropped and counted
+type Subscription struct {
+	C       <-chan Event
+	c       chan Event
+	peer    *Peer
+	dropped uint64
+	once    sync.Once
+}
+
+//Subscribe creates Subscription with channel of provided buffer size. Call Close when subscription is not needed anymore
+func (peer *Peer) Subscribe(buffer int) *Subscription {
+	c := make(chan Event, buffer)
+	sub := &Subscription{C: c, c: c, peer: peer}
+	peer.eventsMx.Lock()
+	peer.subscribers[sub] = struct{}{}
+	peer.eventsMx.Unlock()
+	return sub
+}
+
+//Dropped returns number of events which were not delivered because channel was full
+func (sub *Subscription) Dropped() uint64 {
+	return atomic.LoadUint64(&sub.dropped)
+}
+
+//Close stops delivering events and closes channel C
+func (sub *Subscription) Close() {
+	sub.once.Do(func() {
+		sub.peer.eventsMx.Lock()
+		delete(sub.peer.subscribers, sub)
+		close(sub.c)
+		sub.peer.eventsMx.Unlock()
+	})
+}
+
+func (peer *Peer) emit(e Event) {
+	e.Time = time.Now()
+	peer.eventsMx.RLock()
+	for sub := range peer.subscribers {
+		select {
+		case sub.c <- e:
+		default:
+			atomic.AddUint64(&sub.dropped, 1)
+		}
+	}
+	peer.eventsMx.RUnlock()
+}
+
+func closeCode(err error) int {
+	var ce *websocket.CloseError
+	if errors.As(err, &ce) {
+		return ce.Code
+	}
+	return 0
+}
+
+func diffRoles(prev, next map[string]interface{}) (added, removed []string) {
+	for role := range next {
+		if _, ok := prev[role]; ok == false {
+			added = append(added, role)
+		}
+	}
+	for role := range prev {
+		if _, ok := next[role]; ok == false {
+			removed = append(removed, role)
+		}
+	}
+	return
+}
@@ -0,0 +1,143 @@
+package roletalk
+
+import (
+	"io"
+	"net"
+	"sync"
+)
+
+//Forwarder forwards TCP connections accepted on a local address to duplex streams of a destination, like ssh -L
+type Forwarder struct {
+	listener net.Listener
+	dest     *Destination
+	event    string
+	opts     EmitOptions
+	conns    map[net.Conn]struct{}
+	closed   bool
+	mx       sync.Mutex
+	wg       sync.WaitGroup
+}
+
+//Forward listens on TCP address and forwards each accepted connection to a duplex stream requested for event.
+//Remote side serves the streams with Role.ForwardTo or Role.Listen. Connection is closed if the stream can not be established
+func (dest *Destination) Forward(address, event string, opts EmitOptions) (*Forwarder, error) {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	f := &Forwarder{listener: listener, dest: dest, event: event, opts: opts, conns: make(map[net.Conn]struct{})}
+	f.wg.Add(1)
+	go f.serve()
+	return f, nil
+}
+
+//Addr returns local TCP address of the forwarder
+func (f *Forwarder) Addr() net.Addr {
+	return f.listener.Addr()
+}
+
+//Close stops listening and closes forwarded connections
+func (f *Forwarder) Close() error {
+	f.mx.Lock()
+	f.closed = true
+	for conn := range f.conns {
+		conn.Close()
+	}
+	f.mx.Unlock()
+	err := f.listener.Close()
+	f.wg.Wait()
+	return err
+}
+
+func (f *Forwarder) serve() {
+	defer f.wg.Done()
+	for {
+		conn, err := f.listener.Accept()
+		if err != nil {
+			return
+		}
+		if f.track(conn) == false {
+			conn.Close()
+			return
+		}
+		f.wg.Add(1)
+		go func() {
+			defer f.wg.Done()
+			defer f.untrack(conn)
+			stream, err := f.dest.Dial(f.event, f.opts)
+			if err != nil {
+				conn.Close()
+				return
+			}
+			if f.track(stream) == false {
+				stream.Close()
+				conn.Close()
+				return
+			}
+			defer f.untrack(stream)
+			pipe(conn, stream)
+		}()
+	}
+}
+
+//track registers connection to be closed by Close. Returns false if the forwarder is closed
+func (f *Forwarder) track(conn net.Conn) bool {
+	f.mx.Lock()
+	defer f.mx.Unlock()
+	if f.closed == true {
+		return false
+	}
+	f.conns[conn] = struct{}{}
+	return true
+}
+
+func (f *Forwarder) untrack(conn net.Conn) {
+	f.mx.Lock()
+	delete(f.conns, conn)
+	f.mx.Unlock()
+}
+
+//ForwardTo serves duplex streams requested for event by connecting them to TCP address, like sshd does for ssh -L.
+//Request is rejected if the address can not be dialed
+func (role *Role) ForwardTo(event, address string) {
+	role.OnDuplex(event, func(ctx *DuplexRequestContext) {
+		conn, err := net.Dial("tcp", address)
+		if err != nil {
+			ctx.Reject(err.Error())
+			return
+		}
+		stream, err := ctx.Reply(nil)
+		if err != nil {
+			conn.Close()
+			return
+		}
+		go pipe(stream, conn)
+	})
+}
+
+//closeWriter is implemented by connections which support half-close, such as *net.TCPConn and *Duplex
+type closeWriter interface {
+	CloseWrite() error
+}
+
+//pipe copies data between a and b in both directions until both are done, then closes them.
+//End of data in one direction is propagated by half-close if supported, error closes both connections
+func pipe(a, b net.Conn) {
+	var wg sync.WaitGroup
+	copyHalf := func(dst, src net.Conn) {
+		defer wg.Done()
+		_, err := io.Copy(dst, src)
+		if cw, ok := dst.(closeWriter); ok == true && err == nil {
+			cw.CloseWrite()
+			return
+		}
+		a.Close()
+		b.Close()
+	}
+	wg.Add(2)
+	go copyHalf(a, b)
+	go copyHalf(b, a)
+	wg.Wait()
+	a.Close()
+	b.Close()
+}
@@ -0,0 +1,236 @@
+package roletalk
+
+import (
+	"sync"
+)
+
+//OverflowPolicy defines what happens with incoming message or request when concurrency limit is reached and the queue is full
+type OverflowPolicy int
+
+const (
+	//OverflowReject rejects request with "Busy" error. Messages are dropped
+	OverflowReject OverflowPolicy = iota
+	//OverflowBlock waits for room in the queue. It stops reading from connections, so remote peers get TCP backpressure.
+	//Note that the Peer reads all connections with a few shared workers, so blocked role delays messages of other roles too
+	OverflowBlock
+	//OverflowDropOldest drops the oldest queued message (or rejects the oldest queued request with "Busy" error) and queues the new one.
+	//When Peer's queue is full, the oldest one is taken from the role with the lowest Priority. If the new one has lower priority than all queued ones, it is rejected instead
+	OverflowDropOldest
+)
+
+//Limits restricts number of concurrently running handlers. Set it globally with PeerOptions.Limits or per role with Role.SetLimits.
+//Zero value means no limits
+type Limits struct {
+	Concurrency int            `json:"concurrency"` //Concurrency is max number of handlers running at the same time. 0 means no limit
+	Queue       int            `json:"queue"`       //Queue is max number of messages and requests waiting for a free slot. 0 means no waiting
+	Overflow    OverflowPolicy `json:"overflow"`    //Overflow applies when the queue is full
+	Priority    int            `json:"priority"`    //Priority is used by Role.SetLimits only: when Peer's limit is reached, queued handlers of roles with higher priority run first
+}
+
+//SetLimits sets concurrency limits of the role's handlers. Handlers which are already queued are kept
+func (role *Role) SetLimits(limits Limits) {
+	s := role.peer.scheduler
+	s.mx.Lock()
+	role.limits = limits
+	s.dispatch()
+	s.cond.Broadcast()
+	s.mx.Unlock()
+}
+
+//Limits returns current concurrency limits of the role
+func (role *Role) Limits() Limits {
+	s := role.peer.scheduler
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	return role.limits
+}
+
+//task is incoming message or request waiting for its handlers. reject is called if task is not going to run
+type task struct {
+	role   *Role
+	run    func()
+	reject func(reason string)
+	seq    uint64
+}
+
+//scheduler runs tasks within Peer's and roles' limits. Fields of roles related to limits are guarded by scheduler's mx
+type scheduler struct {
+	mx      sync.Mutex
+	cond    *sync.Cond
+	limits  Limits
+	running int
+	queued  int
+	seq     uint64
+	waiting map[*Role]struct{} //roles with non-empty queue
+	closed  bool
+	metrics collector
+}
+
+func newScheduler(limits Limits, metrics collector) *scheduler {
+	s := &scheduler{limits: limits, metrics: metrics, waiting: make(map[*Role]struct{})}
+	s.cond = sync.NewCond(&s.mx)
+	return s
+}
+
+//submit runs, queues or rejects the task according to limits. It blocks only if OverflowBlock applies
+func (s *scheduler) submit(t *task) {
+	role := t.role
+	s.mx.Lock()
+	for {
+		if s.closed == true {
+			s.mx.Unlock()
+			t.reject(errStrShutdown)
+			return
+		}
+		if s.canRun(role) == true {
+			s.start(t)
+			s.mx.Unlock()
+			return
+		}
+		roleFull := role.limits.Concurrency > 0 && len(role.queue) >= role.limits.Queue
+		peerFull := s.limits.Concurrency > 0 && s.queued >= s.limits.Queue
+		if roleFull == false && peerFull == false {
+			s.enqueue(t)
+			s.mx.Unlock()
+			return
+		}
+		policy := s.limits.Overflow
+		if roleFull == true {
+			policy = role.limits.Overflow
+		}
+		switch policy {
+		case OverflowBlock:
+			s.cond.Wait()
+			continue
+		case OverflowDropOldest:
+			var oldest *task
+			if roleFull == true {
+				oldest = s.dequeue(role)
+			} else {
+				oldest = s.dequeueLowest(role)
+			}
+			if oldest == nil {
+				break
+			}
+			s.enqueue(t)
+			s.mx.Unlock()
+			oldest.reject(errStrBusy)
+			return
+		}
+		s.mx.Unlock()
+		t.reject(errStrBusy)
+		return
+	}
+}
+
+func (s *scheduler) canRun(role *Role) bool {
+	if role.limits.Concurrency > 0 && role.running >= role.limits.Concurrency {
+		return false
+	}
+	if s.limits.Concurrency > 0 && s.running >= s.limits.Concurrency {
+		return false
+	}
+	return true
+}
+
+func (s *scheduler) start(t *task) {
+	t.role.running++
+	s.running++
+	go func() {
+		defer s.finish(t)
+		t.run()
+	}()
+}
+
+func (s *scheduler) finish(t *task) {
+	s.mx.Lock()
+	t.role.running--
+	s.running--
+	s.dispatch()
+	s.cond.Broadcast()
+	s.mx.Unlock()
+}
+
+//dispatch starts queued tasks while there are free slots. Roles with higher priority go first, then older tasks
+func (s *scheduler) dispatch() {
+	for {
+		var next *Role
+		for role := range s.waiting {
+			if s.canRun(role) == false {
+				continue
+			}
+			if next == nil || role.limits.Priority > next.limits.Priority ||
+				role.limits.Priority == next.limits.Priority && role.queue[0].seq < next.queue[0].seq {
+				next = role
+			}
+		}
+		if next == nil {
+			return
+		}
+		s.start(s.dequeue(next))
+	}
+}
+
+func (s *scheduler) enqueue(t *task) {
+	s.seq++
+	t.seq = s.seq
+	t.role.queue = append(t.role.queue, t)
+	s.queued++
+	s.waiting[t.role] = struct{}{}
+	s.metrics.QueueDepth(t.role.name, len(t.role.queue))
+}
+
+func (s *scheduler) dequeue(role *Role) *task {
+	if len(role.queue) == 0 {
+		return nil
+	}
+	t := role.queue[0]
+	role.queue[0] = nil
+	role.queue = role.queue[1:]
+	s.queued--
+	if len(role.queue) == 0 {
+		delete(s.waiting, role)
+	}
+	s.metrics.QueueDepth(role.name, len(role.queue))
+	return t
+}
+
+//dequeueLowest dequeues the oldest task of the waiting role with the lowest priority, so a task of role can be queued instead.
+//It returns nil if role has lower priority than all waiting roles
+func (s *scheduler) dequeueLowest(role *Role) *task {
+	var lowest *Role
+	for r := range s.waiting {
+		if lowest == nil || r.limits.Priority < lowest.limits.Priority ||
+			r.limits.Priority == lowest.limits.Priority && r.queue[0].seq < lowest.queue[0].seq {
+			lowest = r
+		}
+	}
+	if lowest == nil || role.limits.Priority < lowest.limits.Priority {
+		return nil
+	}
+	return s.dequeue(lowest)
+}
+
+//close rejects queued tasks and all tasks submitted afterwards. Running tasks are not affected
+func (s *scheduler) close() {
+	s.mx.Lock()
+	s.closed = true
+	var rejected []*task
+	for role := range s.waiting {
+		for t := s.dequeue(role); t != nil; t = s.dequeue(role) {
+			rejected = append(rejected, t)
+		}
+	}
+	s.cond.Broadcast()
+	s.mx.Unlock()
+	for _, t := range rejected {
+		t.reject(errStrShutdown)
+	}
+}
+
+//load returns number of running and queued tasks of the role
+func (s *scheduler) load(role *Role) (running, queued int) {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	return role.running, len(role.queue)
+}
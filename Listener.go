@@ -0,0 +1,81 @@
+package roletalk
+
+import (
+	"errors"
+	"net"
+	"sync"
+)
+
+//ErrListenerClosed is returned by Listener.Accept after the listener has been closed
+var ErrListenerClosed = errors.New("Listener closed")
+
+//Listener implements net.Listener. It accepts duplex streams requested for an event of a role, so servers built on net.Listener (http.Serve, grpc.Server.Serve) can serve units
+type Listener struct {
+	role   *Role
+	event  string
+	conns  chan *Duplex
+	done   chan struct{}
+	closed bool
+	mx     sync.Mutex
+}
+
+//Listen returns Listener which accepts duplex streams requested for the event. Requests are rejected while backlog of not accepted streams is full or after the listener has been closed.
+//Only one listener should be created for an event
+func (role *Role) Listen(event string) *Listener {
+	l := &Listener{role: role, event: event, conns: make(chan *Duplex, defListenerBacklog), done: make(chan struct{})}
+	role.OnDuplex(event, l.handle)
+	return l
+}
+
+func (l *Listener) handle(ctx *DuplexRequestContext) {
+	l.mx.Lock()
+	defer l.mx.Unlock()
+	if l.closed == true {
+		ctx.Reject(ErrListenerClosed.Error())
+		return
+	}
+	if len(l.conns) == cap(l.conns) {
+		ctx.Reject("Listener backlog is full")
+		return
+	}
+	duplex, err := ctx.Reply(nil)
+	if err != nil {
+		return
+	}
+	l.conns <- duplex
+}
+
+//Accept waits for and returns the next duplex stream
+func (l *Listener) Accept() (net.Conn, error) {
+	select {
+	case <-l.done:
+		return nil, ErrListenerClosed
+	case duplex := <-l.conns:
+		return duplex, nil
+	}
+}
+
+//Close stops accepting streams. Streams which have not been accepted yet are closed, accepted ones are not affected
+func (l *Listener) Close() error {
+	l.mx.Lock()
+	if l.closed == true {
+		l.mx.Unlock()
+		return nil
+	}
+	l.closed = true
+	close(l.done)
+	l.mx.Unlock()
+	for {
+		select {
+		case duplex := <-l.conns:
+			duplex.Close()
+		default:
+			return nil
+		}
+	}
+}
+
+//Addr returns address of the listener
+func (l *Listener) Addr() net.Addr {
+	return StreamAddr{ID: l.role.peer.id, Role: l.role.name, Event: l.event}
+}
@@ -0,0 +1,18 @@
+package roletalk
+
+//Logger receives diagnostic events of a Peer. Set it with PeerOptions.Logger.
+//Arguments after msg are key-value pairs. The method set matches *slog.Logger (https://pkg.go.dev/log/slog), so it can be passed as is.
+//Events with unit's context have "unit" key with the unit's ID
+type Logger interface {
+	Debug(msg string, args ...interface{})
+	Info(msg string, args ...interface{})
+	Warn(msg string, args ...interface{})
+	Error(msg string, args ...interface{})
+}
+
+type nopLogger struct{}
+
+func (nopLogger) Debug(msg string, args ...interface{}) {}
+func (nopLogger) Info(msg string, args ...interface{})  {}
+func (nopLogger) Warn(msg string, args ...interface{})  {}
+func (nopLogger) Error(msg string, args ...interface{}) {}
@@ -0,0 +1,169 @@
+package roletalk
+
+import (
+	"io"
+	"time"
+)
+
+//RequestOutcome describes how an outgoing request has been finished. It is reported to Collector
+type RequestOutcome string
+
+const (
+	//OutcomeResolved means remote peer replied to the request
+	OutcomeResolved RequestOutcome = "resolved"
+	//OutcomeRejected means remote peer rejected the request
+	OutcomeRejected RequestOutcome = "rejected"
+	//OutcomeTimeout means response has not been received within timeout
+	OutcomeTimeout RequestOutcome = "timeout"
+	//OutcomeError means request has not been delivered or the unit got closed while waiting for response
+	OutcomeError RequestOutcome = "error"
+)
+
+//StreamTimeoutKind describes why a stream has been destroyed by timeout. It is reported to Collector
+type StreamTimeoutKind string
+
+const (
+	//StreamIdle means no data has been transferred within EmitOptions.IdleTimeout
+	StreamIdle StreamTimeoutKind = "idle"
+	//StreamStalled means remote side has not granted quota to the writer within PeerOptions.StreamStallTimeout
+	StreamStalled StreamTimeoutKind = "stalled"
+)
+
+//Collector receives metrics of a Peer. Set it with PeerOptions.Metrics.
+//Implementations must be safe for concurrent use and should not block, because methods are called on hot paths.
+//The interface is not extended, metrics added later are reported to optional interfaces (QueueCollector, RateLimitCollector, StreamTimeoutCollector) if Collector implements them.
+//See module github.com/xshkut/roletalk-go/promcollector for Prometheus adapter, it is separate so users of roletalk do not depend on Prometheus client
+type Collector interface {
+	//MessageSent is called when one-way message has been written to connection
+	MessageSent(role, event string)
+	//MessageReceived is called when one-way message has been received for a local role
+	MessageReceived(role, event string)
+	//RequestSent is called when request (including stream requests) has been written to connection
+	RequestSent(role, event string)
+	//RequestReceived is called when request (including stream requests) has been received for a local role
+	RequestReceived(role, event string)
+	//RequestFinished is called when outgoing request has been resolved, rejected, timed out or failed
+	RequestFinished(role, event string, outcome RequestOutcome, latency time.Duration)
+	//InFlightRequests reports number of requests waiting for response from the unit
+	InFlightRequests(unitID string, n int)
+	//OpenStreams reports number of stream channels opened with the unit
+	OpenStreams(unitID string, n int)
+	//BytesSent is called when n bytes have been written to a connection of the unit
+	BytesSent(unitID string, n int)
+	//BytesReceived is called when n bytes have been read from a connection of the unit
+	BytesReceived(unitID string, n int)
+	//ReconnectAttempt is called before Peer tries to reconnect to address
+	ReconnectAttempt(address string)
+	//HeartbeatFailure is called when connection of the unit did not respond to ping in time
+	HeartbeatFailure(unitID string)
+	//AuthFailure is called when connection has not passed authentication
+	AuthFailure()
+}
+
+//QueueCollector is optional interface of Collector which receives handler queue metrics (see Limits)
+type QueueCollector interface {
+	//QueueDepth reports number of incoming messages and requests of the role waiting for a free handler slot
+	QueueDepth(role string, n int)
+}
+
+//RateLimitCollector is optional interface of Collector which receives rate limit metrics (see RateLimits)
+type RateLimitCollector interface {
+	//RateLimited is called when incoming message has been dropped or request has been rejected by rate limit
+	RateLimited(role, event string)
+}
+
+//StreamTimeoutCollector is optional interface of Collector which receives stream timeout metrics
+type StreamTimeoutCollector interface {
+	//StreamTimeout is called when local side has destroyed a stream with the unit because it was idle or stalled
+	StreamTimeout(unitID string, kind StreamTimeoutKind)
+}
+
+//collector is Collector with all optional interfaces, which the Peer reports to
+type collector interface {
+	Collector
+	QueueCollector
+	RateLimitCollector
+	StreamTimeoutCollector
+}
+
+//extendedCollector adds no-op optional interfaces to Collector which does not implement them
+type extendedCollector struct {
+	Collector
+	QueueCollector
+	RateLimitCollector
+	StreamTimeoutCollector
+}
+
+//extendCollector detects optional interfaces of c
+func extendCollector(c Collector) collector {
+	if c == nil {
+		return nopCollector{}
+	}
+	if full, ok := c.(collector); ok == true {
+		return full
+	}
+	e := extendedCollector{Collector: c, QueueCollector: nopCollector{}, RateLimitCollector: nopCollector{}, StreamTimeoutCollector: nopCollector{}}
+	if q, ok := c.(QueueCollector); ok == true {
+		e.QueueCollector = q
+	}
+	if r, ok := c.(RateLimitCollector); ok == true {
+		e.RateLimitCollector = r
+	}
+	if st, ok := c.(StreamTimeoutCollector); ok == true {
+		e.StreamTimeoutCollector = st
+	}
+	return e
+}
+
+type nopCollector struct{}
+
+func (nopCollector) MessageSent(role, event string)                                        {}
+func (nopCollector) MessageReceived(role, event string)                                    {}
+func (nopCollector) RequestSent(role, event string)                                        {}
+func (nopCollector) RequestReceived(role, event string)                                    {}
+func (nopCollector) RequestFinished(role, event string, o RequestOutcome, d time.Duration) {}
+func (nopCollector) InFlightRequests(unitID string, n int)                                 {}
+func (nopCollector) OpenStreams(unitID string, n int)                                      {}
+func (nopCollector) BytesSent(unitID string, n int)                                        {}
+func (nopCollector) BytesReceived(unitID string, n int)                                    {}
+func (nopCollector) ReconnectAttempt(address string)                                       {}
+func (nopCollector) HeartbeatFailure(unitID string)                                        {}
+func (nopCollector) AuthFailure()                                                          {}
+func (nopCollector) QueueDepth(role string, n int)                                         {}
+func (nopCollector) RateLimited(role, event string)                                        {}
+func (nopCollector) StreamTimeout(unitID string, kind StreamTimeoutKind)                   {}
+
+func requestOutcome(cb *callback) RequestOutcome {
+	switch {
+	case cb.err == nil:
+		return OutcomeResolved
+	case cb.timeout:
+		return OutcomeTimeout
+	case cb.ctx != nil:
+		return OutcomeRejected
+	default:
+		return OutcomeError
+	}
+}
+
+type countingWriter struct {
+	io.WriteCloser
+	count func(n int)
+}
+
+func (cw *countingWriter) Write(p []byte) (n int, err error) {
+	n, err = cw.WriteCloser.Write(p)
+	cw.count(n)
+	return
+}
+
+type countingReader struct {
+	io.Reader
+	count func(n int)
+}
+
+func (cr *countingReader) Read(p []byte) (n int, err error) {
+	n, err = cr.Reader.Read(p)
+	cr.count(n)
+	return
+}
@@ -1,10 +1,10 @@
 package roletalk
 
 import (
+	"context"
 	"crypto/rand"
 	"crypto/tls"
 	"fmt"
-	"log"
 	"net"
 	"net/http"
 	"runtime"
@@ -37,6 +37,23 @@ type Peer struct {
 	unitHandlers    []unitHandler
 	roleHandlers    []roleHandler
 	lastRolesChange int
+	metrics         collector
+	logger          Logger
+	subscribers     map[*Subscription]struct{}
+	eventsMx        sync.RWMutex
+	admin           bool
+	done            chan struct{}
+	draining        bool
+	drainMx         sync.RWMutex
+	handlers        int64 //handlers counts in-flight handlers, including queued ones
+	terminateOnce   sync.Once
+	scheduler       *scheduler
+	sizeLimits      SizeLimits
+	compression     Compression
+	stallTimeout    time.Duration
+	resume          StreamResume
+	detached        map[string]*Unit //detached are disconnected units with suspended streams, they are revived if the unit connects again
+	detachedMx      sync.Mutex
 }
 
 //NewPeer creates Peer and initializes its internal state
@@ -50,17 +67,37 @@ func NewPeer(opts PeerOptions) *Peer {
 	name := opts.Name
 	friendly := opts.Friendly
 
-	peer := &Peer{id: id, Name: name, Friendly: friendly, startTime: time.Now()}
+	peer := &Peer{id: id, Name: name, Friendly: friendly, startTime: time.Now(), metrics: extendCollector(opts.Metrics), logger: opts.Logger}
+	if peer.logger == nil {
+		peer.logger = nopLogger{}
+	}
+	peer.scheduler = newScheduler(opts.Limits, peer.metrics)
+	peer.sizeLimits = opts.Sizes.withDefaults()
+	peer.compression = opts.Compression.withDefaults()
+	peer.stallTimeout = opts.StreamStallTimeout
+	if peer.stallTimeout == 0 {
+		peer.stallTimeout = defStreamStallTimeout
+	}
+	peer.resume = opts.StreamResume.withDefaults()
 	peer.incMsgChan = make(chan *MessageContext)
 	peer.destinations = make(map[string]*Destination)
 	peer.roles = make(map[string]*Role)
 	peer.units = make(map[string]*Unit)
+	peer.detached = make(map[string]*Unit)
 	peer.addrUnits = newAddressScheme()
+	peer.subscribers = make(map[*Subscription]struct{})
+	peer.done = make(chan struct{})
+	peer.alive.Add(1)
 
 	for i := 0; i < runtime.NumCPU(); i++ {
 		go peer.consumeIncomingMessages()
 	}
 
+	if opts.Admin != nil {
+		peer.admin = true
+		peer.enableAdmin(*opts.Admin)
+	}
+
 	return peer
 }
 
@@ -72,9 +109,17 @@ func (peer *Peer) Connect(urlStr string, opts ...ConnectOptions) (unit *Unit, er
 	if len(opts) > 0 {
 		options = opts[0]
 	}
+	if peer.isDraining() == true {
+		return nil, errPeerShutdown
+	}
 
-	dialer := websocket.DefaultDialer
+	dialer := *websocket.DefaultDialer
 	dialer.TLSClientConfig = &tls.Config{InsecureSkipVerify: options.InsecureTLS}
+	compression := peer.compression
+	if options.Compression != nil {
+		compression = options.Compression.withDefaults()
+	}
+	dialer.EnableCompression = compression.Deflate
 
 	if options.DoNotReconnect == false {
 		peer.addrUnits.store(urlStr, nil, nil)
@@ -87,11 +132,13 @@ func (peer *Peer) Connect(urlStr string, opts ...ConnectOptions) (unit *Unit, er
 	}
 
 	conn = createConnLocker(c)
+	conn.compression = compression
 	unit, err = peer.addConn(conn)
 	if err != nil {
 		err = errors.Wrap(err, "Cannot use connection to communicate")
 		goto errCase
 	}
+	peer.logger.Info("connected to remote peer", "unit", unit.id, "name", unit.name, "address", urlStr)
 
 	if options.DoNotReconnect == false {
 		peer.addrUnits.store(urlStr, conn, unit)
@@ -104,6 +151,7 @@ func (peer *Peer) Connect(urlStr string, opts ...ConnectOptions) (unit *Unit, er
 	return
 
 errCase:
+	peer.logger.Warn("cannot connect to remote peer", "address", urlStr, "error", err)
 	if options.DoNotReconnect == false {
 		go peer.startReconnCycle(urlStr, true)
 	}
@@ -116,7 +164,7 @@ func (peer *Peer) ListRoles() []string {
 	sl := make([]string, len(peer.roles))
 	i := 0
 	for key, role := range peer.roles {
-		if role.Active() == false {
+		if role.Active() == false || key == AdminRole && peer.admin == false {
 			continue
 		}
 		sl[i] = key
@@ -200,13 +248,21 @@ func (peer *Peer) Unit(id string) *Unit {
 }
 
 func (peer *Peer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	var upgrader = websocket.Upgrader{} // use default options
+	if peer.isDraining() == true {
+		http.Error(w, errPeerShutdown.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	var upgrader = websocket.Upgrader{EnableCompression: peer.compression.Deflate}
 	c, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
-		log.Print("upgrade: ", err)
+		peer.logger.Warn("cannot upgrade incoming connection", "remote", r.RemoteAddr, "error", err)
 		return
 	}
-	peer.InvolveConn(c)
+	unit, err := peer.InvolveConn(c)
+	if err != nil {
+		return
+	}
+	peer.logger.Info("accepted connection", "unit", unit.id, "name", unit.name, "remote", r.RemoteAddr)
 }
 
 //Listen to incoming connections. Creates new http.Server and blocks till it listens
@@ -227,14 +283,41 @@ func (peer *Peer) Listen(address string) (net.Addr, error) {
 	return listener.Addr(), nil
 }
 
-//Close all listeners and connections
+//Close all listeners and connections immediately. Use Shutdown to let in-flight requests and streams finish.
+//Background goroutines and timers of the Peer and its units exit; handlers which are still running are not interrupted.
+//Close is the same as Shutdown with done context, so the Peer cannot be used after Close: it does not listen, connect or serve roles anymore
 func (peer *Peer) Close() {
-	for _, server := range peer.servers {
-		server.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	peer.Shutdown(ctx)
+}
+
+//Shutdown gracefully stops the Peer. It closes listeners, disables all roles (remote destinations stop routing to the Peer) and rejects new incoming requests and connections.
+//Then it waits for in-flight handlers and opened streams to finish until ctx is done. Finally it closes all connections and stops background goroutines.
+//Returns ctx.Err() if the Peer has been closed before everything finished. The Peer cannot be used after Shutdown
+func (peer *Peer) Shutdown(ctx context.Context) error {
+	if peer.startDraining() == true {
+		peer.logger.Info("shutting down")
+		for _, server := range peer.servers {
+			server.Close()
+		}
+		peer.roleRWMutex.RLock()
+		roles := make([]*Role, 0, len(peer.roles))
+		for _, role := range peer.roles {
+			roles = append(roles, role)
+		}
+		peer.roleRWMutex.RUnlock()
+		for _, role := range roles {
+			role.setActive(false)
+		}
+		peer.broadcastRoles()
 	}
+	err := peer.drain(ctx)
+	peer.terminateOnce.Do(peer.terminate)
+	return err
 }
 
-//WaitForClose waits until all units (their underlying connections) and listeners will be closed. Could be used to prevent Main() from returning
+//WaitForClose waits until the Peer is closed (see Close and Shutdown) and all its listeners are stopped. Could be used to prevent Main() from returning
 func (peer *Peer) WaitForClose() {
 	peer.alive.Wait()
 }
@@ -260,7 +343,8 @@ func (peer *Peer) ID() string {
 
 //ConnectOptions specifies options for outgoing connection
 type ConnectOptions struct {
-	DoNotReconnect bool //set true if connection is not supposed to reconnect after abort
-	DoNotAcquaint  bool //set true if connection is not supposed to be introduced to remote peers nor to be acquainted with remote peers
-	InsecureTLS    bool //set true if TLS errors are supposed to be ignoredt
+	DoNotReconnect bool         //set true if connection is not supposed to reconnect after abort
+	DoNotAcquaint  bool         //set true if connection is not supposed to be introduced to remote peers nor to be acquainted with remote peers
+	InsecureTLS    bool         //set true if TLS errors are supposed to be ignoredt
+	Compression    *Compression //Compression overrides PeerOptions.Compression for the connection. Optional
 }
@@ -0,0 +1,42 @@
+package roletalk
+
+//Priority is a class of outgoing frames. When several frames wait for the same connection, frames with higher priority are written first.
+//Waiting frames of lower priority are not starved: after 16 frames of higher priority have been written ahead of them, the first of them is written.
+//Heartbeats are websocket control frames and are always written ahead of other frames
+type Priority int
+
+const (
+	//PriorityBulk is for traffic which may wait, e.g. large streams. Steady traffic of higher priorities delays it, but does not block it
+	PriorityBulk Priority = -1
+	//PriorityNormal is default priority
+	PriorityNormal Priority = 0
+	//PriorityHigh is for small latency-sensitive messages and requests
+	PriorityHigh Priority = 1
+	//PriorityControl is used for service messages (roles and acquaintance). It is not recommended for user traffic
+	PriorityControl Priority = 2
+)
+
+const priorityLanes = int(PriorityControl-PriorityBulk) + 1
+
+//lane returns index of the priority's write lane. Unknown priorities are clamped to the nearest known one
+func (p Priority) lane() int {
+	switch {
+	case p < PriorityBulk:
+		p = PriorityBulk
+	case p > PriorityControl:
+		p = PriorityControl
+	}
+	return int(p - PriorityBulk)
+}
+
+func (p Priority) String() string {
+	switch {
+	case p <= PriorityBulk:
+		return "bulk"
+	case p == PriorityNormal:
+		return "normal"
+	case p == PriorityHigh:
+		return "high"
+	}
+	return "control"
+}
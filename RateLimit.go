@@ -0,0 +1,182 @@
+package roletalk
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+)
+
+//RateLimit is a token bucket: Rate tokens are added per second up to Burst. Each incoming message or request takes one token.
+//Zero Rate means no limit
+type RateLimit struct {
+	Rate  float64 `json:"rate"`
+	Burst int     `json:"burst"` //Burst is capacity of the bucket. Values < 1 mean 1
+}
+
+//RateLimits configures rate limiting of incoming messages and requests of a Role. All matching limits apply.
+//Requests over the limit are rejected with RateLimitedError on the requesting side; messages are dropped and reported to Collector.RateLimited
+type RateLimits struct {
+	Role   RateLimit            //Role limits all messages and requests of the role
+	Events map[string]RateLimit //Events limits messages and requests by event
+	Unit   RateLimit            //Unit limits messages and requests of each remote unit separately
+	Units  map[string]RateLimit //Units overrides Unit for remote units by their ID or name
+}
+
+//RateLimitedError is returned by Destination.Request, NewReader and NewWriter when remote peer has rejected the request by rate limit
+type RateLimitedError struct {
+	RetryAfter time.Duration //RetryAfter is the time remote peer expects to accept the next request
+}
+
+func (e *RateLimitedError) Error() string {
+	return fmt.Sprintf("Rate limited, retry after %v", e.RetryAfter)
+}
+
+//SetRateLimits replaces rate limits of the role. Buckets start full
+func (role *Role) SetRateLimits(limits RateLimits) {
+	role.rates.set(limits)
+}
+
+//rejection is structured rejection sent as JSON, so the requester can recognize it
+type rejection struct {
+	Code         string `json:"code"`
+	Message      string `json:"message"`
+	RetryAfterMs int64  `json:"retryAfterMs,omitempty"`
+}
+
+const rejectCodeRateLimited = "RATE_LIMITED"
+
+//parseRejection turns data of reject response into error. Structured rejections are converted to typed errors
+func parseRejection(t Datatype, raw []byte) error {
+	if t == DatatypeJSON {
+		r := rejection{}
+		if json.Unmarshal(raw, &r) == nil && r.Code == rejectCodeRateLimited {
+			return &RateLimitedError{RetryAfter: time.Duration(r.RetryAfterMs) * time.Millisecond}
+		}
+	}
+	return errors.New(string(raw))
+}
+
+type bucket struct {
+	limit  RateLimit
+	tokens float64
+	last   time.Time
+}
+
+func newBucket(limit RateLimit, now time.Time) *bucket {
+	if limit.Burst < 1 {
+		limit.Burst = 1
+	}
+	return &bucket{limit: limit, tokens: float64(limit.Burst), last: now}
+}
+
+//refill adds tokens for time passed and returns time until the next token if the bucket is empty
+func (b *bucket) refill(now time.Time) time.Duration {
+	b.tokens = math.Min(float64(b.limit.Burst), b.tokens+now.Sub(b.last).Seconds()*b.limit.Rate)
+	b.last = now
+	if b.tokens >= 1 {
+		return 0
+	}
+	return time.Duration((1 - b.tokens) / b.limit.Rate * float64(time.Second))
+}
+
+//rateLimiter holds buckets of a role. Unit buckets are created on demand and deleted with the unit
+type rateLimiter struct {
+	mx     sync.Mutex
+	limits RateLimits
+	role   *bucket
+	events map[string]*bucket
+	units  map[string]*bucket
+}
+
+func (rl *rateLimiter) set(limits RateLimits) {
+	now := time.Now()
+	rl.mx.Lock()
+	defer rl.mx.Unlock()
+	rl.limits = limits
+	rl.role = nil
+	if limits.Role.Rate > 0 {
+		rl.role = newBucket(limits.Role, now)
+	}
+	rl.events = make(map[string]*bucket)
+	for event, limit := range limits.Events {
+		if limit.Rate > 0 {
+			rl.events[event] = newBucket(limit, now)
+		}
+	}
+	rl.units = make(map[string]*bucket)
+}
+
+//allow takes a token from every bucket matching the unit and the event. If any of them is empty, no tokens are taken
+//and the longest time until buckets get tokens is returned
+func (rl *rateLimiter) allow(unit *Unit, event string) (retryAfter time.Duration, ok bool) {
+	rl.mx.Lock()
+	defer rl.mx.Unlock()
+	if rl.role == nil && len(rl.events) == 0 && rl.unitLimit(unit).Rate <= 0 {
+		return 0, true
+	}
+	now := time.Now()
+	buckets := make([]*bucket, 0, 3)
+	if rl.role != nil {
+		buckets = append(buckets, rl.role)
+	}
+	if b, ok := rl.events[event]; ok == true {
+		buckets = append(buckets, b)
+	}
+	if b := rl.unitBucket(unit, now); b != nil {
+		buckets = append(buckets, b)
+	}
+	for _, b := range buckets {
+		if wait := b.refill(now); wait > retryAfter {
+			retryAfter = wait
+		}
+	}
+	if retryAfter > 0 {
+		return retryAfter, false
+	}
+	for _, b := range buckets {
+		b.tokens--
+	}
+	return 0, true
+}
+
+func (rl *rateLimiter) unitLimit(unit *Unit) RateLimit {
+	if limit, ok := rl.limits.Units[unit.id]; ok == true {
+		return limit
+	}
+	if limit, ok := rl.limits.Units[unit.name]; ok == true {
+		return limit
+	}
+	return rl.limits.Unit
+}
+
+func (rl *rateLimiter) unitBucket(unit *Unit, now time.Time) *bucket {
+	if b, ok := rl.units[unit.id]; ok == true {
+		return b
+	}
+	limit := rl.unitLimit(unit)
+	if limit.Rate <= 0 {
+		return nil
+	}
+	b := newBucket(limit, now)
+	rl.units[unit.id] = b
+	return b
+}
+
+func (rl *rateLimiter) forgetUnit(id string) {
+	rl.mx.Lock()
+	delete(rl.units, id)
+	rl.mx.Unlock()
+}
+
+//checkRate takes tokens for incoming message or request. It reports rate limited ones to Collector
+func (peer *Peer) checkRate(role *Role, ctx *MessageContext) (time.Duration, bool) {
+	retryAfter, ok := role.rates.allow(ctx.unit, ctx.event)
+	if ok == false {
+		peer.metrics.RateLimited(role.name, ctx.event)
+		peer.logger.Debug("rate limited", "unit", ctx.unit.id, "role", role.name, "event", ctx.event, "retryAfter", retryAfter)
+	}
+	return retryAfter, ok
+}
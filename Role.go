@@ -15,7 +15,12 @@ type Role struct {
 	mwRequest      *middlewareRequestMap
 	mwReader       *middlewareReaderRequestMap
 	mwWriter       *middlewareWriterRequestMap
+	mwDuplex       *middlewareDuplexRequestMap
 	statusHandlers []func()
+	limits         Limits
+	running        int
+	queue          []*task
+	rates          rateLimiter
 }
 
 //MessageHandler is function which handles incoming messages.
@@ -30,6 +35,9 @@ type ReadableRequestHandler func(im *ReaderRequestContext)
 //WritableRequestHandler is function which handles incoming requests.
 type WritableRequestHandler func(im *WriterRequestContext)
 
+//DuplexRequestHandler is function which handles incoming requests for duplex streams.
+type DuplexRequestHandler func(im *DuplexRequestContext)
+
 //ReaderHandler is function which handles incoming requests.
 // type ReaderHandler func(im *RequestContext)
 
@@ -38,28 +46,14 @@ type WritableRequestHandler func(im *WriterRequestContext)
 
 //Enable starts peer to serve the role; immediately shows the role to all connected units
 func (role *Role) Enable() {
-	role.stateMutex.Lock()
-	prev := role.active
-	role.active = true
-	role.stateMutex.Unlock()
-	if prev == false {
-		for _, h := range role.statusHandlers {
-			h()
-		}
+	if role.setActive(true) == true {
 		go role.peer.broadcastRoles()
 	}
 }
 
 //Disable stops peer to serve the role; immediately hides the role for all connected units
 func (role *Role) Disable() {
-	role.stateMutex.Lock()
-	prev := role.active
-	role.active = false
-	role.stateMutex.Unlock()
-	if prev == true {
-		for _, h := range role.statusHandlers {
-			h()
-		}
+	if role.setActive(false) == true {
 		go role.peer.broadcastRoles()
 	}
 }
@@ -95,6 +89,12 @@ func (role *Role) OnWriter(event string, handler func(ctx *WriterRequestContext)
 	role.mwWriter.set(event, handler)
 }
 
+//OnDuplex registers duplex stream handler for provided event. It does not support wildcard or regexp matching.
+//Providing empty string as event sets handler for all requests despite the event
+func (role *Role) OnDuplex(event string, handler func(ctx *DuplexRequestContext)) {
+	role.mwDuplex.set(event, handler)
+}
+
 //Name returns Role's name
 func (role *Role) Name() string {
 	return role.name
@@ -0,0 +1,95 @@
+package roletalk
+
+import (
+	"fmt"
+)
+
+//SizeLimits restricts sizes of incoming data. Zero fields take default values
+type SizeLimits struct {
+	MaxMessage      int64 `json:"maxMessage"`      //MaxMessage is max size of incoming websocket message in bytes, including reassembled fragmented ones. Larger messages close the connection with code 1009 (4008 if fragmented). Default is 32 MiB
+	MaxName         int   `json:"maxName"`         //MaxName is max length of role and event names in bytes. Default is 1024
+	MaxJSONDepth    int   `json:"maxJSONDepth"`    //MaxJSONDepth is max nesting of objects and arrays in incoming JSON data. Default is 64
+	MaxStreamBuffer int   `json:"maxStreamBuffer"` //MaxStreamBuffer is max number of received and not yet read bytes of a stream. It is at least stream quota (16 KiB). Default is 4 MiB
+	MaxReassembly   int64 `json:"maxReassembly"`   //MaxReassembly is max number of received bytes of fragmented messages being reassembled over one connection at once. It is at least MaxMessage. Exceeding it closes the connection with code 4008. Default is 64 MiB
+	DropOversize    bool  `json:"dropOversize"`    //DropOversize drops one-way messages over the limits instead of closing the connection with code 4008
+}
+
+func (l SizeLimits) withDefaults() SizeLimits {
+	if l.MaxMessage <= 0 {
+		l.MaxMessage = defMaxMessageBytes
+	}
+	if l.MaxReassembly <= 0 {
+		l.MaxReassembly = defMaxReassemblyBytes
+	}
+	if l.MaxReassembly < l.MaxMessage {
+		l.MaxReassembly = l.MaxMessage
+	}
+	if l.MaxName <= 0 {
+		l.MaxName = defMaxNameBytes
+	}
+	if l.MaxJSONDepth <= 0 {
+		l.MaxJSONDepth = defMaxJSONDepth
+	}
+	if l.MaxStreamBuffer <= 0 {
+		l.MaxStreamBuffer = defMaxStreamBufferBytes
+	}
+	if l.MaxStreamBuffer < defQuotaSizeBytes {
+		l.MaxStreamBuffer = defQuotaSizeBytes
+	}
+	return l
+}
+
+//check returns error if names or data of incoming message or request are over the limits.
+//Requests over the limits are rejected with the error, one-way messages are dropped or close the connection
+func (l SizeLimits) check(role, event string, t Datatype, data []byte) error {
+	if len(role) > l.MaxName {
+		return fmt.Errorf("%v: role name of %v bytes exceeds %v", errStrTooLarge, len(role), l.MaxName)
+	}
+	if len(event) > l.MaxName {
+		return fmt.Errorf("%v: event name of %v bytes exceeds %v", errStrTooLarge, len(event), l.MaxName)
+	}
+	if t == DatatypeJSON && jsonTooDeep(data, l.MaxJSONDepth) == true {
+		return fmt.Errorf("%v: JSON nesting exceeds %v", errStrTooLarge, l.MaxJSONDepth)
+	}
+	return nil
+}
+
+//jsonTooDeep returns true if objects and arrays of raw JSON are nested deeper than max. Brackets inside strings are skipped
+func jsonTooDeep(raw []byte, max int) bool {
+	depth := 0
+	inString := false
+	escaped := false
+	for _, b := range raw {
+		if inString == true {
+			switch {
+			case escaped == true:
+				escaped = false
+			case b == '\\':
+				escaped = true
+			case b == '"':
+				inString = false
+			}
+			continue
+		}
+		switch b {
+		case '"':
+			inString = true
+		case '{', '[':
+			if depth++; depth > max {
+				return true
+			}
+		case '}', ']':
+			depth--
+		}
+	}
+	return false
+}
+
+//oversize handles one-way message over the limits according to DropOversize
+func (peer *Peer) oversize(ctx *MessageContext, err error) {
+	if peer.sizeLimits.DropOversize == true {
+		peer.logger.Warn("oversize message dropped", "unit", ctx.unit.id, "role", ctx.role, "event", ctx.event, "error", err)
+		return
+	}
+	go peer.closeOnViolation(ctx.unit, ctx.conn, errMessageTooBig, err.Error())
+}
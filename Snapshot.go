@@ -0,0 +1,216 @@
+package roletalk
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"time"
+)
+
+//PeerSnapshot is serializable state of a Peer at the moment of Peer.Snapshot() call. It is intended for debugging
+type PeerSnapshot struct {
+	ID           string                `json:"id"`
+	Name         string                `json:"name"`
+	Friendly     bool                  `json:"friendly"`
+	Uptime       time.Duration         `json:"uptime"`
+	Roles        []RoleSnapshot        `json:"roles"`
+	Destinations []DestinationSnapshot `json:"destinations"`
+	Units        []UnitSnapshot        `json:"units"`
+	Addresses    []AddressSnapshot     `json:"addresses"`
+}
+
+//RoleSnapshot describes local Role
+type RoleSnapshot struct {
+	Name          string   `json:"name"`
+	Active        bool     `json:"active"`
+	MessageEvents []string `json:"messageEvents"`
+	RequestEvents []string `json:"requestEvents"`
+	ReaderEvents  []string `json:"readerEvents"`
+	WriterEvents  []string `json:"writerEvents"`
+	DuplexEvents  []string `json:"duplexEvents"`
+	Limits        Limits   `json:"limits"`
+	Running       int      `json:"running"` //Running is number of handlers being executed
+	Queued        int      `json:"queued"`  //Queued is number of messages and requests waiting for a free slot
+}
+
+//DestinationSnapshot describes Destination and IDs of units serving it
+type DestinationSnapshot struct {
+	Name  string   `json:"name"`
+	Ready bool     `json:"ready"`
+	Units []string `json:"units"`
+}
+
+//UnitSnapshot describes connected Unit
+type UnitSnapshot struct {
+	ID          string            `json:"id"`
+	Name        string            `json:"name"`
+	Friendly    bool              `json:"friendly"`
+	Meta        MetaInfo          `json:"meta"`
+	Roles       []string          `json:"roles"`
+	Connections []ConnSnapshot    `json:"connections"`
+	Requests    []RequestSnapshot `json:"pendingRequests"`
+	Streams     []StreamSnapshot  `json:"streams"`
+}
+
+//ConnSnapshot describes underlying connection of a unit
+type ConnSnapshot struct {
+	LocalAddr  string `json:"localAddr"`
+	RemoteAddr string `json:"remoteAddr"`
+}
+
+//RequestSnapshot describes request waiting for response
+type RequestSnapshot struct {
+	Correlation uint64        `json:"correlation"`
+	Age         time.Duration `json:"age"`
+}
+
+//StreamSnapshot describes opened stream channel
+type StreamSnapshot struct {
+	Channel       uint64 `json:"channel"`
+	BufferedBytes int    `json:"bufferedBytes"`
+	Quota         int    `json:"quota"`
+	Err           string `json:"err,omitempty"`
+}
+
+//AddressSnapshot describes address Peer has connected to and will reconnect to on abort. UnitID is empty while the address is not connected
+type AddressSnapshot struct {
+	Address string `json:"address"`
+	UnitID  string `json:"unitId,omitempty"`
+}
+
+//Snapshot returns current internal state of the Peer
+func (peer *Peer) Snapshot() PeerSnapshot {
+	snap := PeerSnapshot{
+		ID:       peer.id,
+		Name:     peer.Name,
+		Friendly: peer.Friendly,
+		Uptime:   time.Since(peer.startTime),
+	}
+
+	peer.roleRWMutex.RLock()
+	roles := make([]*Role, 0, len(peer.roles))
+	for _, role := range peer.roles {
+		roles = append(roles, role)
+	}
+	peer.roleRWMutex.RUnlock()
+	for _, role := range roles {
+		snap.Roles = append(snap.Roles, role.snapshot())
+	}
+	sort.Slice(snap.Roles, func(i, j int) bool { return snap.Roles[i].Name < snap.Roles[j].Name })
+
+	peer.destRWMutex.RLock()
+	for name, dest := range peer.destinations {
+		ds := DestinationSnapshot{Name: name, Ready: dest.Ready(), Units: []string{}}
+		for _, unit := range dest.Units() {
+			ds.Units = append(ds.Units, unit.id)
+		}
+		sort.Strings(ds.Units)
+		snap.Destinations = append(snap.Destinations, ds)
+	}
+	peer.destRWMutex.RUnlock()
+	sort.Slice(snap.Destinations, func(i, j int) bool { return snap.Destinations[i].Name < snap.Destinations[j].Name })
+
+	for _, unit := range peer.Units() {
+		snap.Units = append(snap.Units, unit.snapshot())
+	}
+	sort.Slice(snap.Units, func(i, j int) bool { return snap.Units[i].ID < snap.Units[j].ID })
+
+	snap.Addresses = peer.addrUnits.snapshot()
+	return snap
+}
+
+//SnapshotHandler returns http.Handler which serves Peer.Snapshot() as JSON. Mount it on administrative port only
+func (peer *Peer) SnapshotHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(peer.Snapshot()); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	})
+}
+
+func (role *Role) snapshot() RoleSnapshot {
+	running, queued := role.peer.scheduler.load(role)
+	return RoleSnapshot{
+		Name:          role.name,
+		Active:        role.Active(),
+		MessageEvents: role.mwMessage.events(),
+		RequestEvents: role.mwRequest.events(),
+		ReaderEvents:  role.mwReader.events(),
+		WriterEvents:  role.mwWriter.events(),
+		DuplexEvents:  role.mwDuplex.events(),
+		Limits:        role.Limits(),
+		Running:       running,
+		Queued:        queued,
+	}
+}
+
+func (unit *Unit) snapshot() UnitSnapshot {
+	roles := unit.GetRoles()
+	sort.Strings(roles)
+	us := UnitSnapshot{
+		ID:          unit.id,
+		Name:        unit.name,
+		Friendly:    unit.friendly,
+		Meta:        unit.meta,
+		Roles:       roles,
+		Connections: []ConnSnapshot{},
+		Requests:    unit.callbackCtr.snapshot(),
+		Streams:     unit.streamCtr.snapshot(),
+	}
+	unit.connections.Range(func(key, value interface{}) bool {
+		conn := key.(*connLocker)
+		us.Connections = append(us.Connections, ConnSnapshot{
+			LocalAddr:  conn.conn.LocalAddr().String(),
+			RemoteAddr: conn.conn.RemoteAddr().String(),
+		})
+		return true
+	})
+	return us
+}
+
+func (rcm *reqCallbackController) snapshot() []RequestSnapshot {
+	now := time.Now()
+	rcm.mx.RLock()
+	res := make([]RequestSnapshot, 0, len(rcm.m))
+	for corr, cw := range rcm.m {
+		res = append(res, RequestSnapshot{Correlation: uint64(corr), Age: now.Sub(cw.created)})
+	}
+	rcm.mx.RUnlock()
+	sort.Slice(res, func(i, j int) bool { return res[i].Correlation < res[j].Correlation })
+	return res
+}
+
+func (sm *streamController) snapshot() []StreamSnapshot {
+	sm.mx.RLock()
+	res := make([]StreamSnapshot, 0, len(sm.m))
+	for channel, sc := range sm.m {
+		sc.mx.Lock()
+		ss := StreamSnapshot{Channel: uint64(channel), BufferedBytes: sc.buf.Len(), Quota: sc.quota}
+		if sc.err != nil {
+			ss.Err = sc.err.Error()
+		}
+		sc.mx.Unlock()
+		res = append(res, ss)
+	}
+	sm.mx.RUnlock()
+	sort.Slice(res, func(i, j int) bool { return res[i].Channel < res[j].Channel })
+	return res
+}
+
+func (ca *addressScheme) snapshot() []AddressSnapshot {
+	ca.mx.RLock()
+	res := make([]AddressSnapshot, 0, len(ca.addresses))
+	for addr, uc := range ca.addresses {
+		as := AddressSnapshot{Address: addr}
+		if uc.unit != nil {
+			as.UnitID = uc.unit.id
+		}
+		res = append(res, as)
+	}
+	ca.mx.RUnlock()
+	sort.Slice(res, func(i, j int) bool { return res[i].Address < res[j].Address })
+	return res
+}
@@ -0,0 +1,540 @@
+package roletalk
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+//ErrResumeUnsupported is returned for streams requested with EmitOptions.Resumable if the unit has not announced support of resumable streams
+var ErrResumeUnsupported = errors.New("Unit does not support resumable streams")
+
+//StreamResume configures streams opened with EmitOptions.Resumable. Zero fields take defaults
+type StreamResume struct {
+	Timeout time.Duration `json:"timeout"` //Timeout is how long stream waits for a connection of the unit after losing its own. Stream fails afterwards. Default is 30 seconds
+	Buffer  int           `json:"buffer"`  //Buffer is max number of bytes writer retains until remote reader acknowledges them. Write blocks while it is full. Default is 4 MiB
+}
+
+func (r StreamResume) withDefaults() StreamResume {
+	if r.Timeout <= 0 {
+		r.Timeout = defStreamResumeTimeout
+	}
+	if r.Buffer <= 0 {
+		r.Buffer = defStreamResumeBuffer
+	}
+	return r
+}
+
+//resumeState is state of resumable stream, guarded by mutex of its streamChannel.
+//Offsets count bytes of data. End of the stream takes one more offset, like FIN of TCP, so its delivery is acknowledged too
+type resumeState struct {
+	pref       []byte //pref addresses frames to remote channel of the stream. It is nil until the stream has been established
+	priority   Priority
+	received   int64  //received is offset of remote writer's data accepted by local side
+	granted    int64  //granted is quota granted by local reader in total, default quota excluded
+	acksent    int64  //acksent is received offset sent to remote side last time
+	sent       int64  //sent is offset of local writer's data written to connections
+	acked      int64  //acked is offset of local writer's data received by remote side
+	quota      int64  //quota is quota granted by remote reader in total, default quota excluded
+	retained   []byte //retained is local writer's data from acked to sent. It is written again after resuming
+	end        []byte //end is stream byte and payload of end of local writer, once it has been ended
+	onEnd      func() //onEnd finishes local writer after remote side has received end of the stream
+	aborted    bool   //aborted is true if the stream has failed, so end of local writer is not waited for
+	waiting    bool   //waiting is true since connection has been lost until remote side has resumed the stream
+	resumeSent bool   //resumeSent is true if local side has sent resume frame while waiting
+	suspended  bool   //suspended holds writing until lost data has been written again
+	epoch      int    //epoch changes on each loss and resuming, so outdated retransmission does not let writer continue
+	cause      error  //cause is error of lost connection, the stream fails with it unless resumed in time
+	timer      *time.Timer
+	sendMx     sync.Mutex //sendMx keeps order of written data while lost data is written again
+}
+
+//establish sets remote channel of resumable stream. It has no effect for other streams
+func (sc *streamChannel) establish(remote correlation, p Priority) {
+	if sc.resume == nil {
+		return
+	}
+	sc.mx.Lock()
+	sc.resume.pref = createStreamPrefix(remote, streamByteAck)
+	sc.resume.priority = p
+	sc.mx.Unlock()
+}
+
+//suspend detaches established resumable stream from lost conn and starts waiting for resuming. It returns false for other streams
+func (sc *streamChannel) suspend(conn *connLocker, err error, timeout time.Duration) bool {
+	sc.mx.Lock()
+	defer sc.mx.Unlock()
+	res := sc.resume
+	if res == nil || res.pref == nil || res.aborted == true {
+		return false
+	}
+	if sc.conn != conn {
+		//the stream has been moved to another connection already
+		return true
+	}
+	sc.conn = nil
+	res.waiting = true
+	res.resumeSent = false
+	res.suspended = true
+	res.epoch++
+	res.cause = err
+	if res.timer == nil {
+		res.timer = time.AfterFunc(timeout, sc.giveUp)
+	}
+	return true
+}
+
+//giveUp fails the stream which has not been resumed in time. Writer which has been ended is finished
+func (sc *streamChannel) giveUp() {
+	sc.mx.Lock()
+	res := sc.resume
+	if res.waiting == false {
+		sc.mx.Unlock()
+		return
+	}
+	res.waiting = false
+	res.timer = nil
+	cause := res.cause
+	onEnd := res.abort()
+	sc.mx.Unlock()
+	sc.fail(cause)
+	if onEnd != nil {
+		onEnd()
+	}
+}
+
+//abandon fails suspended stream with err at once instead of waiting for resuming. It has no effect for other streams
+func (sc *streamChannel) abandon(err error) {
+	sc.mx.Lock()
+	res := sc.resume
+	if res == nil || res.waiting == false {
+		sc.mx.Unlock()
+		return
+	}
+	if res.timer != nil {
+		res.timer.Stop()
+	}
+	res.cause = err
+	sc.mx.Unlock()
+	sc.giveUp()
+}
+
+//abort marks failed stream and returns function finishing ended writer, if any
+func (res *resumeState) abort() (onEnd func()) {
+	res.aborted = true
+	onEnd = res.onEnd
+	res.onEnd = nil
+	return
+}
+
+//acknowledge releases data received by remote side and takes quota granted by it.
+//It returns function finishing local writer if remote side has received its end
+func (res *resumeState) acknowledge(received, quota int64) (onEnd func()) {
+	if received > res.acked {
+		trim := received - res.acked
+		if trim >= int64(len(res.retained)) {
+			//new slice is allocated, since retransmission could still read the old one
+			res.retained = nil
+		} else {
+			res.retained = res.retained[trim:]
+		}
+		res.acked = received
+	}
+	if quota > res.quota {
+		res.quota = quota
+	}
+	if res.end != nil && res.acked > res.sent {
+		onEnd = res.onEnd
+		res.onEnd = nil
+	}
+	return
+}
+
+//stop stops waiting for resuming of finished stream
+func (res *resumeState) stop() {
+	if res.timer != nil {
+		res.timer.Stop()
+		res.timer = nil
+	}
+	res.waiting = false
+}
+
+//resumeType marks data type of stream request as resumable
+func resumeType(t Datatype, resumable bool) Datatype {
+	if resumable == true {
+		return Datatype(byte(t) | flagResumable)
+	}
+	return t
+}
+
+//parseResumeType strips flagResumable from data type of stream request
+func parseResumeType(t Datatype) (Datatype, bool) {
+	return Datatype(byte(t) &^ flagResumable), byte(t)&flagResumable != 0
+}
+
+func encodeOffset(offset int64) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, uint64(offset))
+	return b
+}
+
+func decodeOffset(b []byte) int64 {
+	return int64(binary.BigEndian.Uint64(b))
+}
+
+//encodeAck encodes payload of ack and resume frames
+func encodeAck(received, granted int64) []byte {
+	return append(encodeOffset(received), encodeOffset(granted)...)
+}
+
+//writeStreamFrame writes frame of stream addressed by pref with control byte b. Connection is deleted on error, so resumable streams carried by it are suspended
+func (unit *Unit) writeStreamFrame(conn *connLocker, p Priority, pref []byte, b byte, parts ...[]byte) error {
+	conn.lockPriority(p)
+	writer, err := conn.NextWriter(websocket.BinaryMessage)
+	if err == nil {
+		_, err = writer.Write(append(pref[0:len(pref)-1:len(pref)-1], b))
+	}
+	for _, part := range parts {
+		if err == nil {
+			_, err = writer.Write(part)
+		}
+	}
+	if err == nil {
+		err = writer.Close()
+	}
+	conn.Unlock()
+	if err != nil {
+		unit.deleteConnection(conn, err)
+	}
+	return err
+}
+
+//ackStream sends offset of received data and quota granted in total to remote writer, so it releases retained data.
+//Unless always is true, it is sent only if data has been received since the last ack. Nothing is sent while the stream has no connection, resume frame carries the same
+func (unit *Unit) ackStream(sc *streamChannel, grant int, always bool) error {
+	res := sc.resume
+	sc.mx.Lock()
+	res.granted += int64(grant)
+	if res.pref == nil || (always == false && res.received == res.acksent) {
+		sc.mx.Unlock()
+		return nil
+	}
+	res.acksent = res.received
+	payload := encodeAck(res.received, res.granted)
+	pref := res.pref
+	conn := sc.conn
+	sc.mx.Unlock()
+	if conn == nil {
+		return nil
+	}
+	return unit.writeStreamFrame(conn, PriorityControl, pref, streamByteAck, payload)
+}
+
+//resumeStreams sends resume frames of suspended streams over available connections. Streams which can not be resumed yet wait for the next connection of the unit
+func (unit *Unit) resumeStreams() {
+	for _, channel := range unit.streamCtr.resumable() {
+		sc, ok := unit.streamCtr.getStreamChannel(channel)
+		if ok == false {
+			continue
+		}
+		res := sc.resume
+		sc.mx.Lock()
+		if res.waiting == false || res.resumeSent == true {
+			sc.mx.Unlock()
+			continue
+		}
+		res.resumeSent = true
+		res.acksent = res.received
+		msg := append(append([]byte{}, res.pref[0:len(res.pref)-1]...), streamByteResume)
+		msg = append(msg, encodeAck(res.received, res.granted)...)
+		sc.mx.Unlock()
+		conn, err := unit.writeMsgToSomeConnection(rawFrame(msg), PriorityControl)
+		if err != nil {
+			sc.mx.Lock()
+			res.resumeSent = false
+			sc.mx.Unlock()
+			return
+		}
+		unit.peer.logger.Debug("stream resume sent", "unit", unit.id, "channel", channel)
+		sc.mx.Lock()
+		move := res.waiting == true && sc.conn == nil
+		sc.mx.Unlock()
+		if move == true {
+			unit.streamCtr.moveConn(channel, sc, conn)
+		}
+	}
+}
+
+//resumeStream continues the stream over conn, which remote side has sent resume frame through.
+//Local side replies with its own resume frame unless it has sent one, then lost data is written again
+func (unit *Unit) resumeStream(conn *connLocker, channel correlation, sc *streamChannel, received, quota int64) {
+	res := sc.resume
+	sc.mx.Lock()
+	if res.pref == nil || res.aborted == true {
+		sc.mx.Unlock()
+		return
+	}
+	reply := res.resumeSent == false
+	res.stop()
+	res.resumeSent = false
+	res.suspended = true
+	res.epoch++
+	epoch := res.epoch
+	onEnd := res.acknowledge(received, quota)
+	res.acksent = res.received
+	payload := encodeAck(res.received, res.granted)
+	pref := res.pref
+	sc.mx.Unlock()
+	unit.streamCtr.moveConn(channel, sc, conn)
+	unit.peer.logger.Debug("stream resumed", "unit", unit.id, "channel", channel, "remote", conn.conn.RemoteAddr().String())
+	if onEnd != nil {
+		onEnd()
+	}
+	if reply == true && unit.writeStreamFrame(conn, PriorityControl, pref, streamByteResume, payload) != nil {
+		return
+	}
+	go unit.retransmit(sc, conn, epoch)
+}
+
+//retransmit writes data which remote side has not received, then lets local writer continue
+func (unit *Unit) retransmit(sc *streamChannel, conn *connLocker, epoch int) {
+	res := sc.resume
+	res.sendMx.Lock()
+	defer res.sendMx.Unlock()
+	sc.mx.Lock()
+	data, offset, sent, end := res.retained, res.acked, res.sent, res.end
+	pref, p := res.pref, res.priority
+	sc.mx.Unlock()
+	var err error
+	for len(data) > 0 && err == nil {
+		size := len(data)
+		if size > maxStreamChunk {
+			size = maxStreamChunk
+		}
+		err = unit.writeStreamFrame(conn, p, pref, streamByteSeqChunk, encodeOffset(offset), data[:size])
+		offset += int64(size)
+		data = data[size:]
+	}
+	if err == nil && end != nil && offset == sent {
+		err = unit.writeStreamFrame(conn, p, pref, streamByteSeqEnd, encodeOffset(sent), end)
+	}
+	sc.mx.Lock()
+	if err == nil && res.epoch == epoch {
+		res.suspended = false
+	}
+	sc.mx.Unlock()
+	sendSignal(sc.quotaSignal)
+}
+
+//skipReceived reads offset of chunk of resumable stream and skips data which has been received already.
+//Chunk beyond received data is dropped. It is called under lock of the stream channel
+func (sc *streamChannel) skipReceived(reader io.Reader, buf []byte) (io.Reader, error) {
+	if sc.resume == nil {
+		return nil, &FrameError{Type: typeStreamData, Field: "offset of not resumable stream"}
+	}
+	if _, err := io.ReadFull(reader, buf[:8]); err != nil {
+		return nil, &FrameError{Type: typeStreamData, Field: "offset"}
+	}
+	skip := sc.resume.received - decodeOffset(buf[:8])
+	if skip < 0 {
+		return io.LimitReader(reader, 0), nil
+	}
+	if _, err := io.CopyN(ioutil.Discard, reader, skip); err != nil {
+		return io.LimitReader(reader, 0), nil
+	}
+	return reader, nil
+}
+
+//receiveEnd handles end of resumable stream. Duplicated end is ignored, the first one is acknowledged
+func (unit *Unit) receiveEnd(sc *streamChannel, raw []byte) error {
+	if sc.resume == nil || len(raw) < 9 {
+		return &FrameError{Type: typeStreamData, Field: "end of resumable stream", Size: len(raw)}
+	}
+	sc.mx.Lock()
+	if decodeOffset(raw) != sc.resume.received {
+		sc.mx.Unlock()
+		return nil
+	}
+	sc.resume.received++
+	var onEnd func()
+	if raw[8] == streamByteFinish {
+		sc.err = io.EOF
+	} else {
+		onEnd = sc.resume.abort()
+	}
+	sc.mx.Unlock()
+	if raw[8] == streamByteFinish {
+		sendSignal(sc.signal)
+	} else {
+		sc.fail(streamError(string(raw[9:])))
+	}
+	if onEnd != nil {
+		onEnd()
+	}
+	go unit.ackStream(sc, 0, true)
+	return nil
+}
+
+//receiveAck handles ack and resume frames
+func (unit *Unit) receiveAck(conn *connLocker, channel correlation, sc *streamChannel, b byte, raw []byte) error {
+	if sc.resume == nil || len(raw) != 16 {
+		return &FrameError{Type: typeStreamData, Field: "ack of resumable stream", Size: len(raw)}
+	}
+	received, quota := decodeOffset(raw), decodeOffset(raw[8:])
+	if b == streamByteResume {
+		unit.resumeStream(conn, channel, sc, received, quota)
+		return nil
+	}
+	sc.mx.Lock()
+	onEnd := sc.resume.acknowledge(received, quota)
+	sc.mx.Unlock()
+	sendSignal(sc.quotaSignal)
+	if onEnd != nil {
+		onEnd()
+	}
+	return nil
+}
+
+//abortStream stops waiting for end of local writer of resumable stream, since remote side has destroyed it
+func (sc *streamChannel) abortStream() {
+	if sc.resume == nil {
+		return
+	}
+	sc.mx.Lock()
+	onEnd := sc.resume.abort()
+	sc.mx.Unlock()
+	if onEnd != nil {
+		onEnd()
+	}
+}
+
+//writeSeqChunk writes chunk of resumable stream. Written data is retained until remote side acknowledges it.
+//If connection fails, nothing is written, so the chunk is written again after the stream has been resumed
+func (w *Writable) writeSeqChunk(p []byte) (n int, err error) {
+	sc := w.streamChannel
+	res := sc.resume
+	res.sendMx.Lock()
+	defer res.sendMx.Unlock()
+	sc.mx.Lock()
+	offset, conn := res.sent, sc.conn
+	sc.mx.Unlock()
+	if conn == nil {
+		return 0, nil
+	}
+	if w.unit.writeStreamFrame(conn, w.priority, w.pref, streamByteSeqChunk, encodeOffset(offset), p) != nil {
+		return 0, nil
+	}
+	sc.mx.Lock()
+	res.retained = append(res.retained, p...)
+	res.sent += int64(len(p))
+	sc.mx.Unlock()
+	sc.touch()
+	return len(p), nil
+}
+
+//endSeq ends resumable stream. Local channel is finished after remote side has received the end, so the end is written again if connection is lost before
+func (w *Writable) endSeq(b byte, payload []byte) error {
+	sc := w.streamChannel
+	res := sc.resume
+	res.sendMx.Lock()
+	defer res.sendMx.Unlock()
+	sc.mx.Lock()
+	res.end = append([]byte{b}, payload...)
+	res.onEnd = w.finish
+	end, offset := res.end, res.sent
+	conn, suspended := sc.conn, res.suspended
+	var onEnd func()
+	if res.aborted == true || res.pref == nil {
+		onEnd = res.abort()
+	}
+	sc.mx.Unlock()
+	if onEnd != nil {
+		onEnd()
+		return nil
+	}
+	if suspended == true || conn == nil {
+		return nil
+	}
+	return w.unit.writeStreamFrame(conn, w.priority, w.pref, streamByteSeqEnd, encodeOffset(offset), end)
+}
+
+//resumableClose returns true if connection has been lost rather than closed on purpose, so its streams can be resumed
+func (unit *Unit) resumableClose(err error) bool {
+	if atomic.LoadInt32(&unit.closed) == 1 || isClosedChan(unit.peer.done) == true {
+		return false
+	}
+	switch closeCode(err) {
+	case 0, websocket.CloseAbnormalClosure, errHeartbeatTimeout:
+		return true
+	}
+	return false
+}
+
+//detachUnit keeps disconnected unit with suspended streams, so they can be resumed if the unit connects again in time
+func (peer *Peer) detachUnit(unit *Unit) {
+	peer.detachedMx.Lock()
+	peer.detached[unit.id] = unit
+	peer.detachedMx.Unlock()
+	time.AfterFunc(peer.resume.Timeout, func() {
+		peer.detachedMx.Lock()
+		if peer.detached[unit.id] == unit {
+			delete(peer.detached, unit.id)
+		}
+		peer.detachedMx.Unlock()
+	})
+}
+
+//abandonSuspended fails suspended streams of the unit with err
+func (unit *Unit) abandonSuspended(err error) {
+	sm := &unit.streamCtr
+	sm.mx.RLock()
+	channels := make([]*streamChannel, 0, len(sm.m))
+	for _, sc := range sm.m {
+		channels = append(channels, sc)
+	}
+	sm.mx.RUnlock()
+	for _, sc := range channels {
+		sc.abandon(err)
+	}
+}
+
+//clearDetached forgets detached units and fails their suspended streams, so retained data is not kept after the Peer is closed
+func (peer *Peer) clearDetached() {
+	peer.detachedMx.Lock()
+	detached := peer.detached
+	peer.detached = make(map[string]*Unit)
+	peer.detachedMx.Unlock()
+	for _, unit := range detached {
+		unit.abandonSuspended(errPeerShutdown)
+	}
+}
+
+//reviveUnit returns detached unit updated with res, so its suspended streams can be resumed. New unit is created if there is no detached one
+func (peer *Peer) reviveUnit(res peerData) *Unit {
+	peer.detachedMx.Lock()
+	unit, ok := peer.detached[res.ID]
+	delete(peer.detached, res.ID)
+	peer.detachedMx.Unlock()
+	if ok == false {
+		return peer.createUnit(res)
+	}
+	roles := make(map[string]interface{})
+	for _, role := range res.Roles {
+		roles[role] = struct{}{}
+	}
+	unit.rolesMx.Lock()
+	unit.name = res.Name
+	unit.friendly = res.Friendly
+	unit.meta = res.Meta
+	unit.fragments = hasFeature(res.Meta.Features, featureFragments)
+	unit.roles = roles
+	unit.rolesMx.Unlock()
+	peer.logger.Debug("unit revived", "unit", unit.id, "streams", unit.streamCtr.open())
+	return unit
+}
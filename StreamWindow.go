@@ -0,0 +1,126 @@
+package roletalk
+
+import (
+	"errors"
+	"time"
+)
+
+//StreamWindow configures flow control of readable end of a stream: how many bytes remote writer can send ahead of reading.
+//Window larger than bandwidth-delay product of the link is needed for full throughput, but it costs memory of the reader. Zero fields take defaults
+type StreamWindow struct {
+	Initial   int     `json:"initial"`   //Initial is window in bytes the stream starts with. It is at least 16 KiB, which is default
+	Max       int     `json:"max"`       //Max is the limit AutoTune grows window up to. It does not exceed SizeLimits.MaxStreamBuffer of local peer, which is default
+	Threshold float64 `json:"threshold"` //Threshold is fraction of window. When quota not yet used by remote writer drops below it, reader grants quota up to the window. Default is 0.66
+	AutoTune  bool    `json:"autoTune"`  //AutoTune doubles window while reader consumes a large part of it within round trip time, measured with websocket pings
+}
+
+func (w StreamWindow) withDefaults(maxBuffer int) StreamWindow {
+	if w.Max <= 0 || w.Max > maxBuffer {
+		w.Max = maxBuffer
+	}
+	if w.Initial < defQuotaSizeBytes {
+		w.Initial = defQuotaSizeBytes
+	}
+	if w.Initial > w.Max {
+		w.Initial = w.Max
+	}
+	if w.Threshold <= 0 || w.Threshold > 1 {
+		w.Threshold = defStreamQuotaThreshold
+	}
+	return w
+}
+
+//newReadable creates readable end of a stream. Remote writer starts with default quota, so larger initial window is granted by open
+func newReadable(unit *Unit, channel, remote correlation, sc *streamChannel, p Priority, window StreamWindow) *Readable {
+	window = window.withDefaults(unit.peer.sizeLimits.MaxStreamBuffer)
+	sc.establish(remote, p)
+	return &Readable{
+		unit:          unit,
+		streamChannel: sc,
+		c:             channel,
+		pref:          createStreamPrefix(remote, streamByteQuota),
+		quotaRem:      defQuotaSizeBytes,
+		quotaSize:     defQuotaSizeBytes,
+		priority:      p,
+		window:        window,
+	}
+}
+
+//open grants the rest of initial window to remote writer. It is called after the stream has been established
+func (r *Readable) open() {
+	r.quotaMx.Lock()
+	grant := r.window.Initial - r.quotaSize
+	r.quotaSize = r.window.Initial
+	r.quotaRem += grant
+	r.quotaMx.Unlock()
+	if grant > 0 {
+		r.addQuota(grant)
+	}
+}
+
+//consume accounts n bytes read from the stream and returns quota to grant to remote writer
+func (r *Readable) consume(n int) (grant int) {
+	r.quotaMx.Lock()
+	r.quotaRem -= n
+	if float64(r.quotaRem) < float64(r.quotaSize)*r.window.Threshold {
+		grant = r.quotaSize - r.quotaRem
+		r.quotaRem = r.quotaSize
+	}
+	probe := false
+	if r.window.AutoTune == true && r.quotaSize < r.window.Max {
+		r.consumed += n
+		if r.probing == false {
+			//bytes consumed until pong arrives is a sample of bandwidth-delay product. Bytes consumed by this call count too,
+			//since WriteTo consumes all data received within round trip at once
+			r.probing = true
+			r.consumed = n
+			probe = true
+		}
+	}
+	r.quotaMx.Unlock()
+	if probe == true && r.probe() != nil {
+		r.quotaMx.Lock()
+		r.probing = false
+		r.quotaMx.Unlock()
+	}
+	return
+}
+
+//probe measures round trip time of connection carrying the stream
+func (r *Readable) probe() error {
+	conn := r.streamChannel.getConn()
+	if conn == nil {
+		return errors.New(errConnClosed)
+	}
+	return conn.probeRTT(r.tune)
+}
+
+//tune grows window if reader has consumed a large part of it within round trip time, so the window limits throughput.
+//Window-limited stream transfers about half of the window per round trip with default threshold, since quota is granted in batches
+func (r *Readable) tune(rtt time.Duration) {
+	r.quotaMx.Lock()
+	r.probing = false
+	size := r.quotaSize
+	grant := 0
+	if float64(r.consumed) >= float64(size)*defWindowGrowThreshold {
+		size = 2 * size
+		if size > r.window.Max {
+			size = r.window.Max
+		}
+		grant = size - r.quotaSize
+		r.quotaSize = size
+		r.quotaRem += grant
+	}
+	r.quotaMx.Unlock()
+	if grant > 0 {
+		r.unit.peer.logger.Debug("stream window grown", "unit", r.unit.id, "channel", r.c, "window", size, "rtt", rtt)
+		go r.addQuota(grant)
+	}
+}
+
+//Window returns current window of the stream in bytes
+func (r *Readable) Window() int {
+	r.quotaMx.RLock()
+	defer r.quotaMx.RUnlock()
+	return r.quotaSize
+}
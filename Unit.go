@@ -2,6 +2,7 @@ package roletalk
 
 import (
 	"sync"
+	"sync/atomic"
 )
 
 //Unit represents remote peer
@@ -19,10 +20,14 @@ type Unit struct {
 	callbackCtr     reqCallbackController
 	closeHandlers   []func(err error)
 	lastRoleSession int
+	fragments       bool //fragments is true if the unit reassembles fragmented frames
+	fragmentCtr     fragmentController
+	closed          int32 //closed is set by Close, so streams are not resumed
 }
 
-//Close all underlying connections
+//Close all underlying connections. Pending requests are rejected. Goroutines serving the connections exit as soon as remote side confirms close, but no later than in a second
 func (unit *Unit) Close() {
+	atomic.StoreInt32(&unit.closed, 1)
 	unit.peer.addrUnits.deleteUnit(unit)
 	unit.callbackCtr.onClose()
 	unit.closeWithCode(errManualClose, "closed by demand")
@@ -49,10 +54,11 @@ func (unit *Unit) HasRole(name string) bool {
 	return has
 }
 
-//Connected returns true if unit's underlying conn's have not been closed.
-//If all conns's are closed or there was at least a moment when all conn's were closed, Connected returns false
+//Connected returns true if the unit is attached to the Peer, i.e. it has at least one open connection.
+//Once all connections are closed, Connected returns false
 //
 //Explanation: when all connections of a unit are closed, Peer gets rid of the unit. But you could still keep referrence to it. When unit gets reconnected, a new instance of type Unit is created, possibly with different ID. So Connected() method can be used to check whether unit is still attached to Peer. That's the reason why Unit has no communication methods.
+//The exception is a unit which had suspended resumable streams when it lost connections (see EmitOptions.Resumable): if it connects again within PeerOptions.StreamResume.Timeout, the same Unit is revived to resume the streams, so Connected returns true again
 func (unit *Unit) Connected() bool {
 	u := unit.peer.Unit(unit.id)
 	return u == unit
@@ -78,7 +84,8 @@ func (unit *Unit) Meta() MetaInfo {
 	return unit.meta
 }
 
-//OnClose adds handler function f which runs synchronosly with other close handlers of the destination in FIFO order when Destination losts last unit
+//OnClose adds handler function f which runs synchronosly with other close handlers of the unit in FIFO order when the unit losts last connection and is removed from the Peer.
+//Unit with resumable streams is revived if it connects again in time (see PeerOptions.StreamResume). Revived unit keeps its handlers, so they run once per each removal
 func (unit *Unit) OnClose(f func(err error)) {
 	unit.connsMx.Lock()
 	unit.closeHandlers = append(unit.closeHandlers, f)
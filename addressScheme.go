@@ -81,3 +81,10 @@ func (ca *addressScheme) getUnitMap() map[string]*Unit {
 	ca.mx.RUnlock()
 	return m
 }
+
+func (ca *addressScheme) clear() {
+	ca.mx.Lock()
+	ca.addresses = make(map[string]unitConn)
+	ca.conns = make(map[*connLocker]string)
+	ca.mx.Unlock()
+}
@@ -0,0 +1,58 @@
+package roletalk
+
+import (
+	"encoding/json"
+	"testing"
+
+	"gotest.tools/assert"
+)
+
+func TestAdminRole(t *testing.T) {
+	server := NewPeer(PeerOptions{Name: "admin server", Admin: &AdminOptions{KeyIDs: []string{"admin"}}})
+	server.AddKey("admin", "secret")
+	server.AddKey("user", "password")
+	admin := NewPeer(PeerOptions{Name: "admin"})
+	admin.AddKey("admin", "secret")
+	user := NewPeer(PeerOptions{Name: "user"})
+	user.AddKey("user", "password")
+	defer server.Close()
+	defer admin.Close()
+	defer user.Close()
+	server.Role("service")
+
+	addr, err := server.Listen("localhost:0")
+	assert.NilError(t, err)
+	adminUnit, err := admin.Connect("ws://"+addr.String(), ConnectOptions{DoNotReconnect: true})
+	assert.NilError(t, err)
+	defer adminUnit.Close()
+	userUnit, err := user.Connect("ws://"+addr.String(), ConnectOptions{DoNotReconnect: true})
+	assert.NilError(t, err)
+	defer userUnit.Close()
+
+	assert.Assert(t, adminUnit.HasRole(AdminRole))
+	dest := admin.Destination(AdminRole)
+	res, err := dest.Request("ping", EmitOptions{})
+	assert.NilError(t, err)
+	assert.Equal(t, res.Data, "pong")
+
+	res, err = dest.Request("info", EmitOptions{})
+	assert.NilError(t, err)
+	info := AdminInfo{}
+	assert.NilError(t, json.Unmarshal(res.Data.([]byte), &info))
+	assert.Equal(t, info.ID, server.ID())
+	assert.Equal(t, info.Name, "admin server")
+
+	res, err = dest.Request("units", EmitOptions{})
+	assert.NilError(t, err)
+	units := []UnitSnapshot{}
+	assert.NilError(t, json.Unmarshal(res.Data.([]byte), &units))
+	assert.Equal(t, len(units), 2)
+
+	_, err = user.Destination(AdminRole).Request("ping", EmitOptions{})
+	assert.Error(t, err, "Access denied")
+
+	plain := NewPeer(PeerOptions{Name: "no admin"})
+	defer plain.Close()
+	plain.Role(AdminRole)
+	assert.DeepEqual(t, plain.ListRoles(), []string{})
+}
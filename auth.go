@@ -7,7 +7,6 @@ import (
 	"encoding/hex"
 	"encoding/json"
 	"fmt"
-	"log"
 	"runtime"
 	"time"
 
@@ -33,37 +32,40 @@ type peerData struct {
 	Roles    []string `json:"roles"`
 	Friendly bool     `json:"friendly"`
 	Meta     MetaInfo `json:"meta"`
+	Codecs   []string `json:"codecs,omitempty"` //Codecs the connection accepts compressed payloads with
 }
 
 //MetaInfo represents meta info of remote peer
 type MetaInfo struct {
-	Os       string `json:"os"`
-	Runtime  string `json:"runtime"`
-	Uptime   int64  `json:"uptime"`
-	Time     int64  `json:"time"`
-	Protocol string `json:"protocol"`
+	Os       string   `json:"os"`
+	Runtime  string   `json:"runtime"`
+	Uptime   int64    `json:"uptime"`
+	Time     int64    `json:"time"`
+	Protocol string   `json:"protocol"`
+	Features []string `json:"features,omitempty"` //Features are optional protocol extensions supported by the peer, e.g. "fragments", "duplex" or "resume". Peers omitting them get plain frames
 }
 
+//authenticateWS runs handshake within authTimeot. On timeout the caller should close conn: it stops the handshake goroutine
 func (peer *Peer) authenticateWS(conn *connLocker) (peerData, error) {
-	var success = make(chan peerData)
-	var fail = make(chan error)
-	data := peerData{}
+	type result struct {
+		data peerData
+		err  error
+	}
+	//buffered, so the handshake goroutine never blocks after timeout
+	done := make(chan result, 1)
 
 	go func() {
 		data, err := peer.startAuthWSHandshake(conn)
-		if err != nil {
-			fail <- err
-		}
-		success <- data
+		done <- result{data, err}
 	}()
 
+	timer := time.NewTimer(authTimeot)
+	defer timer.Stop()
 	select {
-	case data := <-success:
-		return data, nil
-	case <-time.After(authTimeot):
-		return data, fmt.Errorf("Auth timeout exceed: %v", authTimeot)
-	case err := <-fail:
-		return data, err
+	case res := <-done:
+		return res.data, res.err
+	case <-timer.C:
+		return peerData{}, fmt.Errorf("Auth timeout exceed: %v", authTimeot)
 	}
 }
 
@@ -86,7 +88,7 @@ func (peer *Peer) startAuthWSHandshake(conn *connLocker) (peerData, error) {
 		}
 	} else {
 		confirmedIn = true
-		pd, err := peer.generatePeerData()
+		pd, err := peer.generatePeerData(conn.compression.Codecs)
 		if err != nil {
 			return res, errors.Wrap(err, "Cannot generate peer data to confirm auth for remote peer")
 		}
@@ -121,11 +123,13 @@ func (peer *Peer) startAuthWSHandshake(conn *connLocker) (peerData, error) {
 				return res, errors.Wrap(err, "Cannot send generated proof")
 			}
 		case byteAuthResponse:
-			if err := peer.verifyResponse(challenge, raw); err != nil {
+			keyID, err := peer.verifyResponse(challenge, raw)
+			if err != nil {
 				return res, errors.Wrap(err, "Response verification failed")
 			}
+			conn.keyID = keyID
 			confirmedIn = true
-			pd, err := peer.generatePeerData()
+			pd, err := peer.generatePeerData(conn.compression.Codecs)
 			if err != nil {
 				return res, errors.Wrap(err, "Cannot generate peer data to confirm auth for remote peer")
 			}
@@ -149,7 +153,7 @@ func (peer *Peer) generateChallengeWithIds() (msg, challenge string, err error)
 	b := make([]byte, 16)
 	_, err = rand.Read(b)
 	if err != nil {
-		log.Fatal(err)
+		return "", "", errors.Wrap(err, "Cannot generate random challenge")
 	}
 	challenge = fmt.Sprintf("%x", b)
 	ids := make([]string, len(peer.presharedKeys))
@@ -193,7 +197,8 @@ func (peer *Peer) getProof(challenge, key string) string {
 	return hex.EncodeToString(h.Sum(nil))
 }
 
-func (peer *Peer) verifyResponse(challenge string, raw []byte) error {
+//verifyResponse returns id of the key remote peer has proved
+func (peer *Peer) verifyResponse(challenge string, raw []byte) (string, error) {
 	proofAndID := proofWithID{}
 	json.Unmarshal(raw, &proofAndID)
 	for _, preshared := range peer.presharedKeys {
@@ -202,18 +207,19 @@ func (peer *Peer) verifyResponse(challenge string, raw []byte) error {
 			originalHmac.Write([]byte(challenge))
 			computed := hex.EncodeToString(originalHmac.Sum(nil))
 			if computed != proofAndID.Proof {
-				return fmt.Errorf("Hashes for proof with id %v are not equal", proofAndID.ID)
+				return "", fmt.Errorf("Hashes for proof with id %v are not equal", proofAndID.ID)
 			}
-			return nil
+			return proofAndID.ID, nil
 		}
 	}
-	return fmt.Errorf("Response with id %v not found", proofAndID.ID)
+	return "", fmt.Errorf("Response with id %v not found", proofAndID.ID)
 }
 
-func (peer *Peer) generatePeerData() ([]byte, error) {
+//generatePeerData returns data introducing the peer over a connection which accepts codecs
+func (peer *Peer) generatePeerData(codecs []string) ([]byte, error) {
 	nowMs := int64(time.Now().UnixNano() / 10e6)
-	meta := MetaInfo{Os: runtime.GOOS, Runtime: "GO", Time: nowMs, Uptime: int64(nowMs - peer.startTime.UnixNano()/10e6), Protocol: protocolVersion}
-	pd := peerData{ID: peer.id, Friendly: peer.Friendly, Roles: peer.ListRoles(), Name: peer.Name, Meta: meta}
+	meta := MetaInfo{Os: runtime.GOOS, Runtime: "GO", Time: nowMs, Uptime: int64(nowMs - peer.startTime.UnixNano()/10e6), Protocol: protocolVersion, Features: []string{featureFragments, featureDuplex, featureResume}}
+	pd := peerData{ID: peer.id, Friendly: peer.Friendly, Roles: peer.ListRoles(), Name: peer.Name, Meta: meta, Codecs: codecs}
 	marshaled, err := json.Marshal(pd)
 	if err != nil {
 		return nil, err
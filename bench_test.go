@@ -0,0 +1,283 @@
+package roletalk
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func BenchmarkSend(b *testing.B) {
+	server, client, unit := testPeers(b, PeerOptions{Name: "bench server"}, PeerOptions{Name: "bench client"}, ConnectOptions{DoNotReconnect: true}, nil)
+	payload := make([]byte, 1024)
+	var received int32
+	done := make(chan struct{})
+	server.Role("bench").OnMessage("msg", func(ctx *MessageContext) {
+		if int(atomic.AddInt32(&received, 1)) == b.N {
+			close(done)
+		}
+	})
+	dest := client.Destination("bench")
+	b.SetBytes(int64(len(payload)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := dest.Send("msg", EmitOptions{Unit: unit, Data: payload}); err != nil {
+			b.Fatal(err)
+		}
+	}
+	<-done
+}
+
+func BenchmarkRequest(b *testing.B) {
+	server, client, unit := testPeers(b, PeerOptions{Name: "bench server"}, PeerOptions{Name: "bench client"}, ConnectOptions{DoNotReconnect: true}, nil)
+	payload := make([]byte, 1024)
+	server.Role("bench").OnRequest("req", func(ctx *RequestContext) {
+		ctx.Reply(ctx.Data)
+	})
+	dest := client.Destination("bench")
+	b.SetBytes(int64(len(payload)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := dest.Request("req", EmitOptions{Unit: unit, Data: payload}); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkStream(b *testing.B) {
+	server, client, unit := testPeers(b, PeerOptions{Name: "bench server"}, PeerOptions{Name: "bench client"}, ConnectOptions{DoNotReconnect: true}, nil)
+	chunk := make([]byte, maxStreamChunk)
+	read := make(chan int64, 1)
+	server.Role("bench").OnReader("stream", func(ctx *ReaderRequestContext) {
+		r, err := ctx.Reply(nil)
+		if err != nil {
+			b.Error(err)
+			return
+		}
+		n, _ := io.Copy(ioutil.Discard, r)
+		read <- n
+	})
+	_, w, err := client.Destination("bench").NewWriter("stream", EmitOptions{Unit: unit})
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.SetBytes(int64(len(chunk)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := w.Write(chunk); err != nil {
+			b.Fatal(err)
+		}
+	}
+	w.Close()
+	if n := <-read; n != int64(b.N*len(chunk)) {
+		b.Fatalf("read %v bytes of %v", n, b.N*len(chunk))
+	}
+}
+
+//wireListener counts bytes read from accepted connections, i.e. bytes on the wire after all compression
+type wireListener struct {
+	net.Listener
+	read int64
+}
+
+func (l *wireListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	return &wireConn{Conn: c, read: &l.read}, err
+}
+
+type wireConn struct {
+	net.Conn
+	read *int64
+}
+
+func (c *wireConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	atomic.AddInt64(c.read, int64(n))
+	return n, err
+}
+
+//BenchmarkCompression sends compressible JSON and reports bytes on the wire per message
+func BenchmarkCompression(b *testing.B) {
+	payload := compressibleJSON(200)
+	for _, bc := range []struct {
+		name        string
+		compression Compression
+	}{
+		{"none", Compression{}},
+		{"deflate", Compression{Deflate: true}},
+		{CodecZstd, Compression{Codecs: []string{CodecZstd}}},
+		{CodecSnappy, Compression{Codecs: []string{CodecSnappy}}},
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			server := NewPeer(PeerOptions{Name: "bench server", Compression: bc.compression})
+			client := NewPeer(PeerOptions{Name: "bench client", Compression: bc.compression})
+			defer server.Close()
+			defer client.Close()
+			listener, err := net.Listen("tcp4", "localhost:0")
+			if err != nil {
+				b.Fatal(err)
+			}
+			wire := &wireListener{Listener: listener}
+			httpServer := &http.Server{Handler: server}
+			go httpServer.Serve(wire)
+			defer httpServer.Close()
+			unit, err := client.Connect("ws://"+listener.Addr().String(), ConnectOptions{DoNotReconnect: true})
+			if err != nil {
+				b.Fatal(err)
+			}
+			var received int32
+			done := make(chan struct{})
+			server.Role("bench").OnMessage("msg", func(ctx *MessageContext) {
+				if int(atomic.AddInt32(&received, 1)) == b.N {
+					close(done)
+				}
+			})
+			dest := client.Destination("bench")
+			b.SetBytes(int64(len(payload)))
+			b.ReportAllocs()
+			b.ResetTimer()
+			start := atomic.LoadInt64(&wire.read)
+			for i := 0; i < b.N; i++ {
+				if err := dest.Send("msg", EmitOptions{Unit: unit, Data: payload}); err != nil {
+					b.Fatal(err)
+				}
+			}
+			<-done
+			b.ReportMetric(float64(atomic.LoadInt64(&wire.read)-start)/float64(b.N), "wire-B/op")
+		})
+	}
+}
+
+//latencyProxy forwards TCP connections to target delaying data in both directions, so round trip time of the link is 2*delay. Bandwidth is not limited
+func latencyProxy(tb testing.TB, target string, delay time.Duration) (addr string, close func()) {
+	listener, err := net.Listen("tcp4", "localhost:0")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	var wg sync.WaitGroup
+	var mx sync.Mutex
+	conns := []net.Conn{}
+	go func() {
+		for {
+			client, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			server, err := net.Dial("tcp4", target)
+			if err != nil {
+				client.Close()
+				continue
+			}
+			mx.Lock()
+			conns = append(conns, client, server)
+			mx.Unlock()
+			wg.Add(2)
+			go delayCopy(&wg, server, client, delay)
+			go delayCopy(&wg, client, server, delay)
+		}
+	}()
+	return listener.Addr().String(), func() {
+		listener.Close()
+		mx.Lock()
+		for _, c := range conns {
+			c.Close()
+		}
+		mx.Unlock()
+		wg.Wait()
+	}
+}
+
+//delayCopy copies src to dst delivering each piece of data delay after it has been read
+func delayCopy(wg *sync.WaitGroup, dst, src net.Conn, delay time.Duration) {
+	defer wg.Done()
+	type packet struct {
+		at   time.Time
+		data []byte
+	}
+	queue := make(chan packet, 1024)
+	go func() {
+		defer close(queue)
+		for {
+			buf := make([]byte, 32*1024)
+			n, err := src.Read(buf)
+			if n > 0 {
+				queue <- packet{at: time.Now().Add(delay), data: buf[:n]}
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+	for p := range queue {
+		time.Sleep(time.Until(p.at))
+		if _, err := dst.Write(p.data); err != nil {
+			break
+		}
+	}
+	dst.Close()
+	src.Close()
+	for range queue {
+	}
+}
+
+//BenchmarkStreamWindow transfers 1 MiB per stream over link with 20ms round trip time
+func BenchmarkStreamWindow(b *testing.B) {
+	const size = 1 << 20
+	for _, bc := range []struct {
+		name   string
+		window StreamWindow
+	}{
+		{"default", StreamWindow{}},
+		{"256KiB", StreamWindow{Initial: 256 * 1024}},
+		{"autotune", StreamWindow{AutoTune: true}},
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			server := NewPeer(PeerOptions{Name: "bench server"})
+			client := NewPeer(PeerOptions{Name: "bench client"})
+			defer server.Close()
+			defer client.Close()
+			data := make([]byte, size)
+			server.Role("bench").OnWriter("download", func(ctx *WriterRequestContext) {
+				w, err := ctx.Reply(nil)
+				if err != nil {
+					b.Error(err)
+					return
+				}
+				w.Write(data)
+				w.Close()
+			})
+			addr, err := server.Listen("localhost:0")
+			if err != nil {
+				b.Fatal(err)
+			}
+			proxy, closeProxy := latencyProxy(b, addr.String(), 10*time.Millisecond)
+			defer closeProxy()
+			unit, err := client.Connect("ws://"+proxy, ConnectOptions{DoNotReconnect: true})
+			if err != nil {
+				b.Fatal(err)
+			}
+			b.SetBytes(size)
+			b.ResetTimer()
+			window := 0
+			for i := 0; i < b.N; i++ {
+				_, r, err := client.Destination("bench").NewReader("download", EmitOptions{Unit: unit, Window: bc.window})
+				if err != nil {
+					b.Fatal(err)
+				}
+				if n, err := io.Copy(ioutil.Discard, r); err != nil || n != size {
+					b.Fatal(fmt.Sprintf("read %v bytes: %v", n, err))
+				}
+				window += r.Window()
+			}
+			b.ReportMetric(float64(window)/float64(b.N), "window-B")
+		})
+	}
+}
@@ -0,0 +1,192 @@
+//Command roletalk connects to live roletalk peers from the command line.
+//
+//Usage:
+//
+//	roletalk [global flags] <command> [command flags] <args>
+//
+//Global flags:
+//
+//	-key id:key    preshared key to authenticate with (see Peer.AddKey); can be repeated
+//	-insecure      ignore TLS certificate errors
+//	-name string   name of the local peer
+//	-timeout dur   timeout of requests (default 10s)
+//
+//Commands:
+//
+//	info    <url>                      print remote unit's ID, name, roles and meta
+//	send    <url> <role> <event>       send one-way message
+//	request <url> <role> <event>       send request and print response data to stdout
+//	write   <url> <role> <event>       pipe stdin into a writable stream (Destination.NewWriter)
+//	read    <url> <role> <event>       pipe a readable stream (Destination.NewReader) to stdout
+//	serve   <address|url> <role>       serve a role and log all incoming messages; listens on address or connects to url;
+//	                                   Ctrl+C shuts the peer down gracefully within -timeout
+//	mesh    <url>...                   crawl peers reachable from seed urls and print the graph (-format json|dot, -max n);
+//	                                   peers should serve AdminRole (PeerOptions.Admin) to reveal their neighbours
+//
+//Commands send, request, write and read accept payload flags:
+//
+//	-type string|number|bool|json|binary|null   datatype of payload (default string)
+//	-data string                                 payload value
+//	-file path                                   read payload from file ("-" for stdin, not allowed for write)
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/xshkut/roletalk-go"
+)
+
+type keyList []string
+
+func (kl *keyList) String() string {
+	return strings.Join(*kl, ",")
+}
+
+func (kl *keyList) Set(value string) error {
+	if strings.Contains(value, ":") == false {
+		return errors.New("key should be in id:key format")
+	}
+	*kl = append(*kl, value)
+	return nil
+}
+
+type globalOptions struct {
+	keys     keyList
+	insecure bool
+	name     string
+	timeout  time.Duration
+}
+
+func main() {
+	opts := globalOptions{}
+	flag.Var(&opts.keys, "key", "preshared key in id:key format; can be repeated")
+	flag.BoolVar(&opts.insecure, "insecure", false, "ignore TLS certificate errors")
+	flag.StringVar(&opts.name, "name", "roletalk-cli", "name of the local peer")
+	flag.DurationVar(&opts.timeout, "timeout", 10*time.Second, "timeout of requests")
+	flag.Usage = usage
+	flag.Parse()
+
+	if flag.NArg() < 1 {
+		usage()
+		os.Exit(2)
+	}
+	if err := run(opts, flag.Arg(0), flag.Args()[1:]); err != nil {
+		fmt.Fprintln(os.Stderr, "roletalk:", err)
+		os.Exit(1)
+	}
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "Usage: roletalk [-key id:key] [-insecure] [-name name] [-timeout dur] <info|send|request|write|read|serve|mesh> [flags] <args>")
+	flag.PrintDefaults()
+}
+
+func run(opts globalOptions, command string, args []string) error {
+	peer := roletalk.NewPeer(roletalk.PeerOptions{Name: opts.name})
+	for _, kv := range opts.keys {
+		pair := strings.SplitN(kv, ":", 2)
+		peer.AddKey(pair[0], pair[1])
+	}
+
+	switch command {
+	case "info":
+		return info(peer, opts, args)
+	case "send", "request", "write", "read":
+		return emit(peer, opts, command, args)
+	case "serve":
+		return serve(peer, opts, args)
+	case "mesh":
+		return crawl(opts, args)
+	default:
+		return fmt.Errorf("unknown command %q", command)
+	}
+}
+
+func connect(peer *roletalk.Peer, opts globalOptions, url string) (*roletalk.Unit, error) {
+	return peer.Connect(url, roletalk.ConnectOptions{DoNotReconnect: true, DoNotAcquaint: true, InsecureTLS: opts.insecure})
+}
+
+func info(peer *roletalk.Peer, opts globalOptions, args []string) error {
+	if len(args) != 1 {
+		return errors.New("usage: info <url>")
+	}
+	unit, err := connect(peer, opts, args[0])
+	if err != nil {
+		return err
+	}
+	defer unit.Close()
+	meta := unit.Meta()
+	fmt.Printf("id:       %v\n", unit.ID())
+	fmt.Printf("name:     %v\n", unit.Name())
+	fmt.Printf("friendly: %v\n", unit.Friendly())
+	fmt.Printf("roles:    %v\n", strings.Join(unit.GetRoles(), ", "))
+	fmt.Printf("os:       %v\n", meta.Os)
+	fmt.Printf("runtime:  %v\n", meta.Runtime)
+	fmt.Printf("protocol: %v\n", meta.Protocol)
+	fmt.Printf("uptime:   %v\n", time.Duration(meta.Uptime)*time.Millisecond)
+	return nil
+}
+
+func emit(peer *roletalk.Peer, opts globalOptions, command string, args []string) error {
+	fs := flag.NewFlagSet(command, flag.ContinueOnError)
+	p := payloadFlags(fs)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 3 {
+		return fmt.Errorf("usage: %v [-type t] [-data d | -file f] <url> <role> <event>", command)
+	}
+	if command == "write" && p.file == "-" {
+		return errors.New("stdin is used as stream source; payload cannot be read from it")
+	}
+	data, err := p.value()
+	if err != nil {
+		return err
+	}
+	url, role, event := fs.Arg(0), fs.Arg(1), fs.Arg(2)
+
+	unit, err := connect(peer, opts, url)
+	if err != nil {
+		return err
+	}
+	defer unit.Close()
+	if unit.HasRole(role) == false {
+		return fmt.Errorf("unit %v (%v) does not serve role %v", unit.ID(), unit.Name(), role)
+	}
+	dest := peer.Destination(role)
+	eo := roletalk.EmitOptions{Data: data, Unit: unit, Timeout: opts.timeout}
+
+	switch command {
+	case "send":
+		return dest.Send(event, eo)
+	case "request":
+		res, err := dest.Request(event, eo)
+		if err != nil {
+			return err
+		}
+		return printData(os.Stdout, res)
+	case "write":
+		_, writable, err := dest.NewWriter(event, eo)
+		if err != nil {
+			return err
+		}
+		if _, err = io.Copy(writable, os.Stdin); err != nil {
+			writable.Destroy(err)
+			return err
+		}
+		return writable.Close()
+	default:
+		_, readable, err := dest.NewReader(event, eo)
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(os.Stdout, readable)
+		return err
+	}
+}
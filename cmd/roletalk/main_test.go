@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/xshkut/roletalk-go"
+	"gotest.tools/assert"
+)
+
+func parsePayload(t *testing.T, args ...string) *payload {
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	p := payloadFlags(fs)
+	assert.NilError(t, fs.Parse(args))
+	return p
+}
+
+func TestPayloadValue(t *testing.T) {
+	cases := []struct {
+		args  []string
+		value interface{}
+	}{
+		{[]string{"-data", "hello"}, "hello"},
+		{[]string{"-type", "number", "-data", "4.5"}, 4.5},
+		{[]string{"-type", "bool", "-data", "true"}, true},
+		{[]string{"-type", "json", "-data", `{"a":1}`}, json.RawMessage(`{"a":1}`)},
+		{[]string{"-type", "binary", "-data", "raw"}, []byte("raw")},
+		{[]string{"-type", "null"}, nil},
+	}
+	for _, c := range cases {
+		value, err := parsePayload(t, c.args...).value()
+		assert.NilError(t, err, c.args)
+		assert.DeepEqual(t, value, c.value)
+	}
+
+	errs := map[string][]string{
+		"strconv.ParseFloat":        {"-type", "number", "-data", "four"},
+		"strconv.ParseBool":         {"-type", "bool", "-data", "yes please"},
+		"not valid JSON":            {"-type", "json", "-data", "{"},
+		"unknown payload type":      {"-type", "xml", "-data", "<a/>"},
+		"mutually exclusive":        {"-data", "a", "-file", "b"},
+		"no such file or directory": {"-file", "does-not-exist"},
+	}
+	for msg, args := range errs {
+		_, err := parsePayload(t, args...).value()
+		assert.ErrorContains(t, err, msg, args)
+	}
+}
+
+func TestPayloadFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "roletalk")
+	assert.NilError(t, err)
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "payload.json")
+	assert.NilError(t, ioutil.WriteFile(file, []byte(`[1,2]`), 0600))
+	value, err := parsePayload(t, "-type", "json", "-file", file).value()
+	assert.NilError(t, err)
+	assert.DeepEqual(t, value, json.RawMessage(`[1,2]`))
+}
+
+func TestKeyList(t *testing.T) {
+	var keys keyList
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	fs.SetOutput(ioutil.Discard)
+	fs.Var(&keys, "key", "")
+	assert.NilError(t, fs.Parse([]string{"-key", "id1:key1", "-key", "id2:key:with:colons"}))
+	assert.DeepEqual(t, []string(keys), []string{"id1:key1", "id2:key:with:colons"})
+	assert.Equal(t, keys.String(), "id1:key1,id2:key:with:colons")
+	assert.ErrorContains(t, fs.Parse([]string{"-key", "nokey"}), "id:key format")
+}
+
+func TestRunUsage(t *testing.T) {
+	opts := globalOptions{timeout: time.Second}
+	errs := []struct {
+		command string
+		args    []string
+		msg     string
+	}{
+		{"unknown", nil, "unknown command"},
+		{"info", nil, "usage: info"},
+		{"request", []string{"ws://localhost:1", "role"}, "usage: request"},
+		{"write", []string{"-file", "-", "ws://localhost:1", "role", "event"}, "stdin is used as stream source"},
+		{"send", []string{"-type", "number", "ws://localhost:1", "role", "event"}, "strconv.ParseFloat"},
+		{"serve", []string{"localhost:0"}, "usage: serve"},
+		{"mesh", nil, "usage: mesh"},
+		{"mesh", []string{"-format", "svg", "ws://localhost:1"}, "unknown format"},
+	}
+	for _, e := range errs {
+		assert.ErrorContains(t, run(opts, e.command, e.args), e.msg, e.command, e.args)
+	}
+}
+
+func TestPrintEcho(t *testing.T) {
+	server := roletalk.NewPeer(roletalk.PeerOptions{Name: "cli server"})
+	client := roletalk.NewPeer(roletalk.PeerOptions{Name: "cli client"})
+	defer server.Close()
+	defer client.Close()
+	server.Role("cli").OnRequest("", func(ctx *roletalk.RequestContext) {
+		ctx.Reply(echo(ctx.MessageContext))
+	})
+	addr, err := server.Listen("localhost:0")
+	assert.NilError(t, err)
+	_, err = client.Connect("ws://"+addr.String(), roletalk.ConnectOptions{DoNotReconnect: true})
+	assert.NilError(t, err)
+
+	cases := map[string]*payload{
+		"hello\n":     {typ: "string", data: "hello"},
+		"{\"a\":1}\n": {typ: "json", data: `{"a":1}`},
+		"raw":         {typ: "binary", data: "raw"},
+		"null\n":      {typ: "null"},
+	}
+	for printed, p := range cases {
+		data, err := p.value()
+		assert.NilError(t, err)
+		res, err := client.Destination("cli").Request("echo", roletalk.EmitOptions{Data: data})
+		assert.NilError(t, err)
+		var buf bytes.Buffer
+		assert.NilError(t, printData(&buf, res))
+		assert.Equal(t, buf.String(), printed)
+	}
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/xshkut/roletalk-go/mesh"
+)
+
+func crawl(opts globalOptions, args []string) error {
+	fs := flag.NewFlagSet("mesh", flag.ContinueOnError)
+	format := fs.String("format", "json", "output format: json or dot")
+	max := fs.Int("max", 0, "maximum number of peers to connect to; 0 means no limit")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() < 1 {
+		return errors.New("usage: mesh [-format json|dot] [-max n] <url>...")
+	}
+	if *format != "json" && *format != "dot" {
+		return fmt.Errorf("unknown format %q", *format)
+	}
+
+	mo := mesh.Options{InsecureTLS: opts.insecure, MaxPeers: *max, Timeout: opts.timeout}
+	for _, kv := range opts.keys {
+		pair := strings.SplitN(kv, ":", 2)
+		mo.Keys = append(mo.Keys, mesh.Key{ID: pair[0], Key: pair[1]})
+	}
+	graph, err := mesh.Crawl(context.Background(), fs.Args(), mo)
+	if err != nil {
+		return err
+	}
+	if *format == "dot" {
+		return graph.WriteDOT(os.Stdout)
+	}
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(graph)
+}
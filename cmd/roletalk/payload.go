@@ -0,0 +1,102 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strconv"
+
+	"github.com/xshkut/roletalk-go"
+)
+
+type payload struct {
+	typ  string
+	data string
+	file string
+}
+
+func payloadFlags(fs *flag.FlagSet) *payload {
+	p := &payload{}
+	fs.StringVar(&p.typ, "type", "string", "datatype of payload: string, number, bool, json, binary or null")
+	fs.StringVar(&p.data, "data", "", "payload value")
+	fs.StringVar(&p.file, "file", "", "read payload from file (\"-\" for stdin)")
+	return p
+}
+
+func (p *payload) raw() ([]byte, error) {
+	switch p.file {
+	case "":
+		return []byte(p.data), nil
+	case "-":
+		return ioutil.ReadAll(os.Stdin)
+	default:
+		return ioutil.ReadFile(p.file)
+	}
+}
+
+//value converts payload to the type roletalk serializes to the requested datatype
+func (p *payload) value() (interface{}, error) {
+	if p.data != "" && p.file != "" {
+		return nil, errors.New("flags -data and -file are mutually exclusive")
+	}
+	raw, err := p.raw()
+	if err != nil {
+		return nil, err
+	}
+	switch p.typ {
+	case "string":
+		return string(raw), nil
+	case "number":
+		return strconv.ParseFloat(string(raw), 64)
+	case "bool":
+		return strconv.ParseBool(string(raw))
+	case "json":
+		if json.Valid(raw) == false {
+			return nil, errors.New("payload is not valid JSON")
+		}
+		return json.RawMessage(raw), nil
+	case "binary":
+		return raw, nil
+	case "null":
+		return nil, nil
+	default:
+		return nil, fmt.Errorf("unknown payload type %q", p.typ)
+	}
+}
+
+func printData(w io.Writer, ctx *roletalk.MessageContext) (err error) {
+	origin := ctx.OriginData()
+	switch origin.T {
+	case roletalk.DatatypeBinary:
+		_, err = w.Write(origin.Data)
+	case roletalk.DatatypeNull:
+		_, err = fmt.Fprintln(w, "null")
+	default:
+		_, err = fmt.Fprintln(w, string(origin.Data))
+	}
+	return
+}
+
+//echo returns received data in the form roletalk serializes back to the same datatype
+func echo(ctx *roletalk.MessageContext) interface{} {
+	if ctx.OriginData().T == roletalk.DatatypeJSON {
+		return json.RawMessage(ctx.OriginData().Data)
+	}
+	return ctx.Data
+}
+
+func describeData(ctx *roletalk.MessageContext) string {
+	origin := ctx.OriginData()
+	switch origin.T {
+	case roletalk.DatatypeBinary:
+		return fmt.Sprintf("%v (%v bytes)", origin.T, len(origin.Data))
+	case roletalk.DatatypeNull:
+		return "null"
+	default:
+		return fmt.Sprintf("%v %s", origin.T, origin.Data)
+	}
+}
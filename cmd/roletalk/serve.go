@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/signal"
+	"strings"
+	"time"
+
+	"github.com/xshkut/roletalk-go"
+)
+
+func serve(peer *roletalk.Peer, opts globalOptions, args []string) error {
+	if len(args) != 2 {
+		return errors.New("usage: serve <address|url> <role>")
+	}
+	target, name := args[0], args[1]
+	role := peer.Role(name)
+
+	role.OnMessage("", func(ctx *roletalk.MessageContext) {
+		log.Printf("message  %v.%v from %v (%v): %v", ctx.Role(), ctx.Event(), ctx.Unit().ID(), ctx.Unit().Name(), describeData(ctx))
+	})
+	role.OnRequest("", func(ctx *roletalk.RequestContext) {
+		log.Printf("request  %v.%v from %v (%v): %v", ctx.Role(), ctx.Event(), ctx.Unit().ID(), ctx.Unit().Name(), describeData(ctx.MessageContext))
+		ctx.Reply(echo(ctx.MessageContext))
+	})
+	role.OnReader("", func(ctx *roletalk.ReaderRequestContext) {
+		log.Printf("writer   %v.%v from %v (%v): %v", ctx.Role(), ctx.Event(), ctx.Unit().ID(), ctx.Unit().Name(), describeData(ctx.MessageContext))
+		readable, err := ctx.Reply(nil)
+		if err != nil {
+			log.Printf("cannot accept stream: %v", err)
+			return
+		}
+		n, err := io.Copy(ioutil.Discard, readable)
+		log.Printf("stream   %v.%v from %v finished: %v bytes, error: %v", ctx.Role(), ctx.Event(), ctx.Unit().ID(), n, err)
+	})
+	role.OnWriter("", func(ctx *roletalk.WriterRequestContext) {
+		log.Printf("reader   %v.%v from %v (%v): %v; rejecting", ctx.Role(), ctx.Event(), ctx.Unit().ID(), ctx.Unit().Name(), describeData(ctx.MessageContext))
+		ctx.Reject("roletalk serve does not produce streams")
+	})
+	peer.OnUnit(func(unit *roletalk.Unit) {
+		log.Printf("unit     %v (%v) connected, roles: %v", unit.ID(), unit.Name(), strings.Join(unit.GetRoles(), ", "))
+		unit.OnClose(func(err error) {
+			log.Printf("unit     %v (%v) disconnected: %v", unit.ID(), unit.Name(), err)
+		})
+	})
+
+	if strings.Contains(target, "://") {
+		if _, err := peer.Connect(target, roletalk.ConnectOptions{InsecureTLS: opts.insecure}); err != nil {
+			return err
+		}
+		log.Printf("serving role %v via %v", name, target)
+	} else {
+		addr, err := peer.Listen(target)
+		if err != nil {
+			return err
+		}
+		log.Printf("serving role %v on %v", name, addr)
+	}
+	go shutdownOnInterrupt(peer, opts.timeout)
+	peer.WaitForClose()
+	return nil
+}
+
+//shutdownOnInterrupt lets in-flight requests and streams finish within timeout after the first interrupt
+func shutdownOnInterrupt(peer *roletalk.Peer, timeout time.Duration) {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt)
+	<-sig
+	log.Printf("shutting down, press Ctrl+C again to exit immediately")
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	go func() {
+		<-sig
+		cancel()
+	}()
+	if err := peer.Shutdown(ctx); err != nil {
+		log.Printf("shutdown: %v", err)
+	}
+}
@@ -13,11 +13,14 @@ import (
 	"gotest.tools/assert"
 )
 
-var peerOne = NewPeer(PeerOptions{Name: "peer one"})
-var peerTwo = NewPeer(PeerOptions{Name: "peer two"})
+var peerOne, peerTwo *Peer
 var address string
 
 func TestCommunication(t *testing.T) {
+	peerOne = NewPeer(PeerOptions{Name: "peer one"})
+	peerTwo = NewPeer(PeerOptions{Name: "peer two"})
+	defer peerOne.Close()
+	defer peerTwo.Close()
 	peerOne.Role("echo")
 	peerTwo.Destination("echo")
 	addr, err := peerOne.Listen("localhost:0")
@@ -383,7 +386,7 @@ func testReaderConnAbort(t *testing.T) {
 				break
 			}
 		}
-		writer.conn.conn.Close()
+		writer.streamChannel.getConn().conn.Close()
 	}()
 
 	wg.Wait()
@@ -417,7 +420,7 @@ func testWriterConnAbort(t *testing.T) {
 				break
 			}
 		}
-		writer.conn.conn.Close()
+		writer.streamChannel.getConn().conn.Close()
 	}()
 
 	//WRITER
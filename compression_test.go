@@ -0,0 +1,96 @@
+package roletalk
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	"gotest.tools/assert"
+)
+
+//compressibleJSON returns JSON array of n similar objects
+func compressibleJSON(n int) []byte {
+	items := make([]map[string]interface{}, n)
+	for i := range items {
+		items[i] = map[string]interface{}{"id": i, "name": fmt.Sprintf("item %v", i), "tags": []string{"alpha", "beta"}, "active": i%2 == 0}
+	}
+	b, _ := json.Marshal(items)
+	return b
+}
+
+func connCodec(unit *Unit) string {
+	name := ""
+	unit.connections.Range(func(key, value interface{}) bool {
+		if c := key.(*connLocker).codec; c != nil {
+			name = c.name
+		}
+		return false
+	})
+	return name
+}
+
+func TestNegotiateCodec(t *testing.T) {
+	assert.Assert(t, negotiateCodec(nil, []string{CodecZstd}) == nil)
+	assert.Assert(t, negotiateCodec([]string{CodecZstd}, nil) == nil)
+	assert.Assert(t, negotiateCodec([]string{"lz4", CodecSnappy}, []string{CodecZstd, "lz4", CodecSnappy}).name == CodecSnappy)
+	assert.Assert(t, negotiateCodec([]string{CodecZstd, CodecSnappy}, []string{CodecSnappy, CodecZstd}).name == CodecZstd)
+}
+
+func TestCodecLimits(t *testing.T) {
+	data := compressibleJSON(1000)
+	for _, c := range codecs {
+		decoded, err := c.decode(c.encode(data), int64(len(data)))
+		assert.NilError(t, err, c.name)
+		assert.Assert(t, bytes.Equal(decoded, data), c.name)
+		_, err = c.decode(c.encode(data), int64(len(data)-1))
+		assert.ErrorType(t, err, &compressedSizeError{}, c.name)
+		_, err = c.decode([]byte("not compressed"), int64(len(data)))
+		assert.Assert(t, err != nil, c.name)
+	}
+}
+
+func TestCompression(t *testing.T) {
+	metrics := newTestCollector()
+	serverOpts := PeerOptions{Name: "compression server", Metrics: metrics, Compression: Compression{Deflate: true, Codecs: []string{CodecZstd, CodecSnappy}}}
+	connect := ConnectOptions{DoNotReconnect: true, Compression: &Compression{Codecs: []string{CodecSnappy, CodecZstd}}}
+	server, client, unit := testPeers(t, serverOpts, PeerOptions{Name: "compression client"}, connect, func(server *Peer) {
+		server.Role("compression").OnRequest("echo", func(ctx *RequestContext) { ctx.Reply(ctx.Data) })
+	})
+	//each side uses its preferred codec
+	assert.Equal(t, connCodec(unit), CodecSnappy)
+	waitFor(t, func() bool { return server.Unit(client.id) != nil })
+	assert.Equal(t, connCodec(server.Unit(client.id)), CodecZstd)
+
+	data := compressibleJSON(1000)
+	var progress [][2]int
+	onProgress := func(sent, total int) { progress = append(progress, [2]int{sent, total}) }
+	res, err := client.Destination("compression").Request("echo", EmitOptions{Data: data, OnProgress: onProgress})
+	assert.NilError(t, err)
+	//progress is reported in uncompressed bytes
+	assert.DeepEqual(t, progress, [][2]int{{len(data), len(data)}})
+	assert.Equal(t, res.OriginData().T, DatatypeBinary)
+	assert.Assert(t, bytes.Equal(res.Data.([]byte), data))
+	metrics.mx.Lock()
+	assert.Assert(t, metrics.bytesIn < len(data)/2, metrics.bytesIn)
+	assert.Assert(t, metrics.bytesOut < len(data)/2, metrics.bytesOut)
+	metrics.mx.Unlock()
+	res, err = client.Destination("compression").Request("echo", EmitOptions{Data: "small"})
+	assert.NilError(t, err)
+	assert.Equal(t, res.Data, "small")
+}
+
+func TestCompressionNotNegotiated(t *testing.T) {
+	clientOpts := PeerOptions{Name: "compression client", Compression: Compression{Codecs: []string{CodecSnappy}}}
+	_, client, unit := testPeers(t, PeerOptions{Name: "compression server"}, clientOpts, ConnectOptions{DoNotReconnect: true}, func(server *Peer) {
+		server.Role("compression").OnMessage("msg", func(ctx *MessageContext) {})
+	})
+	assert.Equal(t, connCodec(unit), "")
+
+	unit.connections.Range(func(key, value interface{}) bool {
+		key.(*connLocker).codec = codecByName(CodecSnappy)
+		return true
+	})
+	assert.NilError(t, client.Destination("compression").Send("msg", EmitOptions{Data: compressibleJSON(100)}))
+	waitFor(t, func() bool { return unit.Connected() == false })
+}
@@ -8,9 +8,7 @@ import (
 	"gotest.tools/assert"
 )
 
-var peer1 = NewPeer(PeerOptions{Name: "test peer 1", Friendly: true})
-var peer2 = NewPeer(PeerOptions{Name: "test peer 2", Friendly: true})
-var peer3 = NewPeer(PeerOptions{Name: "test peer 3", Friendly: true})
+var peer1, peer2, peer3 *Peer
 
 var address1 string
 var address3 string
@@ -28,6 +26,13 @@ var peerOnRoled uint32
 var RoleOnStatusChanged int
 
 func TestUnderlyingCommunication(t *testing.T) {
+	peer1 = NewPeer(PeerOptions{Name: "test peer 1", Friendly: true})
+	peer2 = NewPeer(PeerOptions{Name: "test peer 2", Friendly: true})
+	peer3 = NewPeer(PeerOptions{Name: "test peer 3", Friendly: true})
+	defer peer1.Close()
+	defer peer2.Close()
+	defer peer3.Close()
+	peerOnUnited, destOnUnited, destOnClosed, unitOnClosed, peerOnRoled, RoleOnStatusChanged = 0, 0, 0, 0, 0, 0
 	for _, peer := range []*Peer{peer1, peer2, peer3} {
 		peer.AddKey("awd", "zxc")
 	}
@@ -70,7 +75,6 @@ func TestUnderlyingCommunication(t *testing.T) {
 	t.Run("testing aqcuaint logic", testAcquaint)
 	t.Run("testing reconnection after conn abort", testReconnectionAbort)
 	t.Run("testing reconnections after manual close", testReconnectionManual)
-	peer1.Close()
 }
 
 func connectPeers(t *testing.T) {
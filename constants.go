@@ -7,13 +7,21 @@ type messageType byte
 const (
 	protocolVersion string = "2.0.0"
 	//restrictions
-	maxCorrelation correlation = 1<<53 - 1
+	maxCorrelation    correlation = 1<<53 - 1
+	maxCorrelationLen             = 7          //bytes of maxCorrelation
+	maxStreamChunk                = 16 * 1024  //max payload of stream data frame, so streams do not hold connection for long
+	fragmentThreshold             = 256 * 1024 //frames larger than this are fragmented if unit supports it
+	fragmentSize                  = 64 * 1024  //max size of fragment's piece
+	maxReassemblies               = 64         //max fragmented frames being received over a connection at once
+	maxLaneBypass                 = 16         //max frames written ahead of a waiting frame of lower priority
 	//timing
 	authTimeot        time.Duration = 5 * time.Second
 	heartBeatTimeout  time.Duration = 5 * time.Second
 	heartBeatInterval time.Duration = 10 * time.Second
 	reconnInterval    time.Duration = 1 * time.Second
 	requestTimeout    time.Duration = 10 * time.Minute
+	drainInterval     time.Duration = 10 * time.Millisecond
+	closeGrace        time.Duration = 1 * time.Second
 
 	//protocol
 
@@ -32,6 +40,8 @@ const (
 	typeStreamData    byte = 106
 	typeStreamResolve byte = 107
 	typeStreamReject  byte = 108
+	typeFragment      byte = 109
+	typeDuplex        byte = 110
 
 	typeAcquaint byte = 200
 	typeRoles    byte = 201
@@ -41,6 +51,21 @@ const (
 	streamByteFinish byte = 1
 	streamByteError  byte = 2
 	streamByteQuota  byte = 3
+	//stream control byte of resumable streams
+	streamByteSeqChunk byte = 4 //chunk with offset of its data
+	streamByteSeqEnd   byte = 5 //end with its offset, then streamByteFinish or streamByteError and payload of the end
+	streamByteAck      byte = 6 //offset of received data and quota granted in total
+	streamByteResume   byte = 7 //the same as ack, sent over a new connection after the previous one has been lost
+	//data type flags
+	flagCompressed byte = 0x80 //payload is compressed, codec id goes first
+	flagResumable  byte = 0x40 //stream request asks for resumable stream
+	//fragment flags
+	fragFirst byte = 1
+	fragLast  byte = 2
+	//features announced in MetaInfo.Features
+	featureFragments = "fragments"
+	featureDuplex    = "duplex"
+	featureResume    = "resume"
 	//protocol close codes
 	errManualClose                 = 4000
 	errAuthRejected                = 4001
@@ -50,13 +75,28 @@ const (
 	errHeartbeatTimeout            = 4005
 	errIncorrectMessageStructure   = 4006
 	errIncompatibleProtocolVersion = 4007
+	errMessageTooBig               = 4008
 
 	//errorMessages
 	errStrOnceResponded = "Already responded"
 	// errNonPositiveWaterMark = "Cannot set HighWaterMark <= 0"
-	errConnClosed = "Connection closed"
+	errConnClosed  = "Connection closed"
+	errStrShutdown = "Peer is shutting down"
+	errStrBusy     = "Busy: concurrency limit reached"
+	errStrTooLarge = "Payload too large"
 
 	// defaults
 	defStreamQuotaThreshold float64 = 0.66
 	defQuotaSizeBytes               = 1024 * 16
+	defMaxMessageBytes              = 32 << 20
+	defMaxReassemblyBytes           = 64 << 20
+	defMaxNameBytes                 = 1024
+	defMaxJSONDepth                 = 64
+	defMaxStreamBufferBytes         = 4 << 20
+	defCompressionThreshold         = 1024
+	defListenerBacklog              = 128
+	defStreamStallTimeout           = time.Minute
+	defWindowGrowThreshold          = 0.4 //stream window is doubled if reader consumes this part of it within round trip time
+	defStreamResumeTimeout          = 30 * time.Second
+	defStreamResumeBuffer           = 4 << 20
 )
@@ -0,0 +1,85 @@
+package roletalk
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+//ErrStreamIdle is returned by both ends of a stream which has been destroyed because no data was transferred within EmitOptions.IdleTimeout
+var ErrStreamIdle = errors.New("Stream idle timeout")
+
+//ErrStreamStalled is returned by both ends of a stream which has been destroyed because remote reader has not granted quota within PeerOptions.StreamStallTimeout
+var ErrStreamStalled = errors.New("Stream stalled: remote side has not granted quota")
+
+//ErrDeadlineExceeded is returned by Read and Write of streams after deadline has passed. It implements net.Error with Timeout() == true
+var ErrDeadlineExceeded error = deadlineExceededError{}
+
+type deadlineExceededError struct{}
+
+func (deadlineExceededError) Error() string   { return "i/o timeout" }
+func (deadlineExceededError) Timeout() bool   { return true }
+func (deadlineExceededError) Temporary() bool { return true }
+
+//deadline wakes up blocked reads or writes of a stream. Zero value has no deadline
+type deadline struct {
+	mx     sync.Mutex
+	timer  *time.Timer
+	cancel chan struct{} //cancel is closed when deadline has passed
+}
+
+//set sets deadline to t. Zero t means no deadline
+func (d *deadline) set(t time.Time) {
+	d.mx.Lock()
+	defer d.mx.Unlock()
+	if d.cancel == nil {
+		d.cancel = make(chan struct{})
+	}
+	if d.timer != nil && d.timer.Stop() == false {
+		//timer has fired, wait until it closes cancel
+		<-d.cancel
+	}
+	d.timer = nil
+
+	closed := isClosedChan(d.cancel)
+	if t.IsZero() == true {
+		if closed == true {
+			d.cancel = make(chan struct{})
+		}
+		return
+	}
+	if dur := time.Until(t); dur > 0 {
+		if closed == true {
+			d.cancel = make(chan struct{})
+		}
+		cancel := d.cancel
+		d.timer = time.AfterFunc(dur, func() { close(cancel) })
+		return
+	}
+	if closed == false {
+		close(d.cancel)
+	}
+}
+
+//wait returns channel which is closed when deadline has passed
+func (d *deadline) wait() chan struct{} {
+	d.mx.Lock()
+	defer d.mx.Unlock()
+	if d.cancel == nil {
+		d.cancel = make(chan struct{})
+	}
+	return d.cancel
+}
+
+func (d *deadline) exceeded() bool {
+	return isClosedChan(d.wait())
+}
+
+func isClosedChan(c chan struct{}) bool {
+	select {
+	case <-c:
+		return true
+	default:
+		return false
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"sync"
 	"sync/atomic"
+	"time"
 )
 
 type unitsMap map[*Unit]interface{}
@@ -24,6 +25,9 @@ func (dest *Destination) addUnit(unit *Unit) {
 	}
 	dest.stateMutex.Lock()
 	dest.units[unit] = struct{}{}
+	if dest.ready == false {
+		dest.peer.emit(Event{Type: EventDestinationReady, Destination: dest.name, UnitID: unit.id, UnitName: unit.name})
+	}
 	dest.ready = true
 	go dest.runOnUnit(unit)
 	dest.stateMutex.Unlock()
@@ -35,6 +39,7 @@ func (dest *Destination) deleteUnit(unit *Unit) {
 		delete(dest.units, unit)
 		if len(dest.units) < 1 {
 			dest.ready = false
+			dest.peer.emit(Event{Type: EventDestinationUnready, Destination: dest.name, UnitID: unit.id, UnitName: unit.name})
 			go dest.runOnClose()
 		}
 		dest.stateMutex.Unlock()
@@ -59,12 +64,33 @@ func (dest *Destination) runOnUnit(unit *Unit) {
 	}
 }
 
-func (dest *Destination) nextUnit() (*Unit, error) {
+//nextUnit returns next unit in round-robin order. If usable is not nil, units it refuses are skipped.
+//Returns nil unit without error if all connected units are refused
+func (dest *Destination) nextUnit(usable func(*Unit) bool) (*Unit, error) {
 	i := atomic.AddUint32(&dest.unitIndex, 1)
 	units := dest.Units()
-	l := len(units)
+	l := uint32(len(units))
 	if l < 1 {
 		return nil, fmt.Errorf("No units connected to serve role %v", dest.name)
 	}
-	return units[i%uint32(l)], nil
+	if usable == nil {
+		return units[i%l], nil
+	}
+	for j := uint32(0); j < l; j++ {
+		if unit := units[(i+j)%l]; usable(unit) == true {
+			return unit, nil
+		}
+	}
+	return nil, nil
+}
+
+//timeoutLeft returns request's timeout reduced by time spent before sending the request
+func timeoutLeft(timeout time.Duration, start time.Time) time.Duration {
+	if timeout == 0 {
+		timeout = requestTimeout
+	}
+	if left := timeout - time.Since(start); left > 0 {
+		return left
+	}
+	return 1
 }
@@ -0,0 +1,99 @@
+package roletalk
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"gotest.tools/assert"
+)
+
+func TestDestinationLimitsPerUnit(t *testing.T) {
+	client := NewPeer(PeerOptions{Name: "dest limits client"})
+	defer client.Close()
+	release := make(chan struct{})
+	started := make(chan string, 4)
+	var units []*Unit
+	for _, name := range []string{"first", "second"} {
+		name := name
+		server := NewPeer(PeerOptions{Name: name})
+		defer server.Close()
+		server.Role("fragile").OnRequest("work", func(ctx *RequestContext) {
+			started <- name
+			<-release
+			ctx.Reply(nil)
+		})
+		addr, err := server.Listen("localhost:0")
+		assert.NilError(t, err)
+		unit, err := client.Connect("ws://"+addr.String(), ConnectOptions{DoNotReconnect: true})
+		assert.NilError(t, err)
+		units = append(units, unit)
+	}
+	dest := client.Destination("fragile")
+	waitFor(t, func() bool { return len(dest.Units()) == 2 })
+	dest.SetLimits(DestinationLimits{MaxInFlightPerUnit: 1, FailFast: true})
+
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := dest.Request("work", EmitOptions{})
+			assert.NilError(t, err)
+		}()
+	}
+	//each unit gets one request as saturated unit is skipped
+	served := map[string]bool{<-started: true, <-started: true}
+	assert.Equal(t, len(served), 2)
+
+	_, err := dest.Request("work", EmitOptions{})
+	assert.Equal(t, err, ErrDestinationSaturated)
+	_, err = dest.Request("work", EmitOptions{Unit: units[0]})
+	assert.Equal(t, err, ErrDestinationSaturated)
+
+	//waiting request respects context
+	dest.SetLimits(DestinationLimits{MaxInFlightPerUnit: 1})
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Millisecond)
+	defer cancel()
+	_, err = dest.Request("work", EmitOptions{Context: ctx})
+	assert.Equal(t, err, context.DeadlineExceeded)
+	_, err = dest.Request("work", EmitOptions{Timeout: 30 * time.Millisecond})
+	assert.Equal(t, err, ErrDestinationSaturated)
+
+	//waiting request proceeds when capacity is released
+	done := make(chan error, 1)
+	go func() {
+		_, err := dest.Request("work", EmitOptions{})
+		done <- err
+	}()
+	time.Sleep(20 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	assert.NilError(t, <-done)
+}
+
+func TestDestinationLimitsRate(t *testing.T) {
+	server := NewPeer(PeerOptions{Name: "dest rate server"})
+	client := NewPeer(PeerOptions{Name: "dest rate client"})
+	defer server.Close()
+	defer client.Close()
+	server.Role("fragile").OnRequest("work", func(ctx *RequestContext) { ctx.Reply(nil) })
+	addr, err := server.Listen("localhost:0")
+	assert.NilError(t, err)
+	_, err = client.Connect("ws://"+addr.String(), ConnectOptions{DoNotReconnect: true})
+	assert.NilError(t, err)
+	dest := client.Destination("fragile")
+	dest.SetLimits(DestinationLimits{MaxInFlight: 1, Rate: RateLimit{Rate: 20, Burst: 1}})
+
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		_, err = dest.Request("work", EmitOptions{})
+		assert.NilError(t, err)
+	}
+	assert.Assert(t, time.Since(start) >= 90*time.Millisecond, time.Since(start))
+
+	dest.SetLimits(DestinationLimits{Rate: RateLimit{Rate: 1, Burst: 1}, FailFast: true})
+	assert.NilError(t, dest.Send("work", EmitOptions{}))
+	assert.Equal(t, dest.Send("work", EmitOptions{}), ErrDestinationSaturated)
+}
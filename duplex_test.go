@@ -0,0 +1,123 @@
+package roletalk
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"testing"
+
+	"gotest.tools/assert"
+)
+
+func TestDuplexEcho(t *testing.T) {
+	server, client, _ := testPeers(t, PeerOptions{Name: "duplex server"}, PeerOptions{Name: "duplex client"}, ConnectOptions{DoNotReconnect: true}, func(server *Peer) {
+		role := server.Role("duplex")
+		role.OnDuplex("echo", func(ctx *DuplexRequestContext) {
+			d, err := ctx.Reply(nil)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			io.Copy(d, d)
+			d.CloseWrite()
+		})
+	})
+
+	//data exceeds quota in both directions, so echo works only if quotas are independent
+	data := make([]byte, 1<<20)
+	rand.Read(data)
+	_, d, err := client.Destination("duplex").NewDuplex("echo", EmitOptions{})
+	assert.NilError(t, err)
+	go func() {
+		d.Write(data)
+		d.CloseWrite()
+	}()
+	echoed, err := ioutil.ReadAll(d)
+	assert.NilError(t, err)
+	assert.Assert(t, bytes.Equal(echoed, data))
+	assert.NilError(t, d.Close())
+	waitFor(t, func() bool { return client.openStreams() == 0 && server.openStreams() == 0 })
+}
+
+func TestDuplexInteractive(t *testing.T) {
+	_, client, _ := testPeers(t, PeerOptions{Name: "duplex server"}, PeerOptions{Name: "duplex client"}, ConnectOptions{DoNotReconnect: true}, func(server *Peer) {
+		role := server.Role("duplex")
+		role.OnDuplex("shell", func(ctx *DuplexRequestContext) {
+			d, err := ctx.Reply(nil)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			scanner := bufio.NewScanner(d)
+			for scanner.Scan() {
+				fmt.Fprintf(d, "got %v\n", scanner.Text())
+			}
+			d.Close()
+		})
+	})
+
+	_, d, err := client.Destination("duplex").NewDuplex("shell", EmitOptions{})
+	assert.NilError(t, err)
+	lines := bufio.NewReader(d)
+	for i := 0; i < 3; i++ {
+		fmt.Fprintf(d, "cmd %v\n", i)
+		line, err := lines.ReadString('\n')
+		assert.NilError(t, err)
+		assert.Equal(t, line, fmt.Sprintf("got cmd %v\n", i))
+	}
+	assert.NilError(t, d.CloseWrite())
+	_, err = lines.ReadString('\n')
+	assert.Equal(t, err, io.EOF)
+}
+
+func TestDuplexUnsupported(t *testing.T) {
+	_, client, unit := testPeers(t, PeerOptions{Name: "duplex server"}, PeerOptions{Name: "duplex client"}, ConnectOptions{DoNotReconnect: true}, func(server *Peer) {
+		role := server.Role("duplex")
+		role.OnDuplex("echo", func(ctx *DuplexRequestContext) { ctx.Reply(nil) })
+	})
+	unit.meta.Features = []string{featureFragments}
+	_, _, err := client.Destination("duplex").NewDuplex("echo", EmitOptions{Unit: unit})
+	assert.Equal(t, err, ErrDuplexUnsupported)
+}
+
+//TestStreamChannels checks that frames of streams are addressed to channels assigned by the receiving side, which differ after rejected stream requests
+func TestStreamChannels(t *testing.T) {
+	_, client, _ := testPeers(t, PeerOptions{Name: "duplex server"}, PeerOptions{Name: "duplex client"}, ConnectOptions{DoNotReconnect: true}, func(server *Peer) {
+		role := server.Role("duplex")
+		role.OnReader("upload", func(ctx *ReaderRequestContext) {
+			r, err := ctx.Reply(nil)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			ioutil.ReadAll(r)
+		})
+		role.OnWriter("download", func(ctx *WriterRequestContext) {
+			w, err := ctx.Reply(nil)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			w.Write([]byte("data"))
+			w.Close()
+		})
+	})
+	dest := client.Destination("duplex")
+	for i := 0; i < 3; i++ {
+		_, _, err := dest.NewReader("missing", EmitOptions{})
+		assert.ErrorContains(t, err, "not handled")
+	}
+	_, r, err := dest.NewReader("download", EmitOptions{})
+	assert.NilError(t, err)
+	data, err := ioutil.ReadAll(r)
+	assert.NilError(t, err)
+	assert.Equal(t, string(data), "data")
+	_, w, err := dest.NewWriter("upload", EmitOptions{})
+	assert.NilError(t, err)
+	_, err = w.Write(make([]byte, 3*defQuotaSizeBytes))
+	assert.NilError(t, err)
+	assert.NilError(t, w.Close())
+}
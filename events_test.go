@@ -0,0 +1,56 @@
+package roletalk
+
+import (
+	"testing"
+	"time"
+
+	"gotest.tools/assert"
+)
+
+func waitForEvent(t *testing.T, sub *Subscription, typ EventType) Event {
+	timeout := time.After(time.Second)
+	for {
+		select {
+		case e := <-sub.C:
+			if e.Type == typ {
+				return e
+			}
+		case <-timeout:
+			t.Fatalf("Event %v has not been emitted within 1 sec", typ)
+		}
+	}
+}
+
+func TestEvents(t *testing.T) {
+	server := NewPeer(PeerOptions{Name: "events server"})
+	client := NewPeer(PeerOptions{Name: "events client"})
+	defer server.Close()
+	defer client.Close()
+	server.Role("events")
+	client.Destination("events")
+	sub := client.Subscribe(100)
+	defer sub.Close()
+	serverSub := server.Subscribe(100)
+	defer serverSub.Close()
+
+	addr, err := server.Listen("localhost:0")
+	assert.NilError(t, err)
+	unit, err := client.Connect("ws://"+addr.String(), ConnectOptions{DoNotReconnect: true})
+	assert.NilError(t, err)
+
+	assert.Equal(t, waitForEvent(t, sub, EventAuthSucceeded).UnitID, server.ID())
+	assert.Equal(t, waitForEvent(t, sub, EventUnitAdded).UnitID, server.ID())
+	assert.Equal(t, waitForEvent(t, sub, EventDestinationReady).Destination, "events")
+	assert.Equal(t, waitForEvent(t, sub, EventConnOpened).UnitID, server.ID())
+	assert.Equal(t, waitForEvent(t, serverSub, EventConnOpened).UnitID, client.ID())
+
+	server.Role("events").Disable()
+	e := waitForEvent(t, sub, EventUnitRolesChanged)
+	assert.DeepEqual(t, e.RemovedRoles, []string{"events"})
+	assert.Equal(t, waitForEvent(t, sub, EventDestinationUnready).Destination, "events")
+
+	unit.Close()
+	waitForEvent(t, sub, EventConnClosed)
+	assert.Equal(t, waitForEvent(t, sub, EventUnitRemoved).UnitID, server.ID())
+	assert.Equal(t, sub.Dropped(), uint64(0))
+}
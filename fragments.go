@@ -0,0 +1,205 @@
+package roletalk
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"sync"
+)
+
+//Large messages, requests and responses are split into fragment frames, if the unit supports it (featureFragments in MetaInfo.Features).
+//Fragment frame: typeFragment, flags, fragment id (length byte + correlation), total size for the first fragment (length byte + correlation), piece of original frame.
+//The first fragment carries the header of original frame. All fragments of a frame are written to the same connection, each one under its own lock,
+//so other frames are interleaved with them. Receiver collects fragments per connection and handles the whole frame as if it was received at once
+
+//fragmentController allocates ids of fragmented messages being sent to a unit
+type fragmentController struct {
+	mx    sync.Mutex
+	last  correlation
+	inUse map[correlation]struct{}
+}
+
+func (fc *fragmentController) acquire() correlation {
+	fc.mx.Lock()
+	defer fc.mx.Unlock()
+	if fc.inUse == nil {
+		fc.inUse = make(map[correlation]struct{})
+	}
+	id := nextCorrelation(&fc.last, func(c correlation) bool {
+		_, ok := fc.inUse[c]
+		return ok
+	})
+	fc.inUse[id] = struct{}{}
+	return id
+}
+
+func (fc *fragmentController) release(id correlation) {
+	fc.mx.Lock()
+	delete(fc.inUse, id)
+	fc.mx.Unlock()
+}
+
+func hasFeature(features []string, feature string) bool {
+	for _, f := range features {
+		if f == feature {
+			return true
+		}
+	}
+	return false
+}
+
+func appendFragmentHead(dst []byte, flags byte, id correlation, total int) []byte {
+	dst = append(dst, typeFragment, flags)
+	dst = append(dst, byte(correlationLen(id)))
+	dst = appendCorrelation(dst, id)
+	if flags&fragFirst != 0 {
+		dst = append(dst, byte(correlationLen(correlation(total))))
+		dst = appendCorrelation(dst, correlation(total))
+	}
+	return dst
+}
+
+//parseFragment parses fragment frame without type byte. total is 0 for all fragments but the first one
+func parseFragment(raw []byte) (flags byte, id correlation, total int, piece []byte, err error) {
+	r := frameReader{raw: raw, way: typeFragment}
+	flags = r.byte("flags")
+	id = r.correlation(r.corrLen("fragment id length"), "fragment id")
+	if flags&fragFirst != 0 {
+		total = int(r.correlation(r.corrLen("total size length"), "total size"))
+	}
+	if r.err != nil {
+		return 0, 0, 0, nil, r.err
+	}
+	return flags, id, total, raw[r.pos:], nil
+}
+
+//writeFragments splits f into fragments and writes them to conn. progress of f is called after each fragment with number of body bytes sent
+func (unit *Unit) writeFragments(conn *connLocker, f frame, p Priority) error {
+	id := unit.fragmentCtr.acquire()
+	defer unit.fragmentCtr.release(id)
+	body := f.body
+	for first := true; first == true || len(body) > 0; first = false {
+		var flags byte
+		room := fragmentSize
+		if first == true {
+			flags |= fragFirst
+			if room -= len(f.head); room < 0 {
+				room = 0
+			}
+		}
+		if room >= len(body) {
+			room = len(body)
+			flags |= fragLast
+		}
+		frag := newFrame()
+		frag.head = appendFragmentHead(frag.head, flags, id, f.size())
+		if first == true {
+			frag.head = append(frag.head, f.head...)
+		}
+		frag.body = body[:room]
+		err := conn.writeFrame(frag, p)
+		frag.release()
+		if err != nil {
+			return err
+		}
+		body = body[room:]
+		if f.progress != nil {
+			f.progress(len(f.body)-len(body), len(f.body))
+		}
+	}
+	return nil
+}
+
+//fragmentSizeError is returned when declared size of fragmented frame exceeds SizeLimits.MaxMessage
+//or received fragments of all frames being reassembled exceed SizeLimits.MaxReassembly
+type fragmentSizeError struct {
+	total    int64
+	max      int64
+	inFlight bool
+}
+
+func (e *fragmentSizeError) Error() string {
+	if e.inFlight == true {
+		return fmt.Sprintf("%v: fragmented frames being reassembled reach %v bytes, limit is %v bytes", errStrTooLarge, e.total, e.max)
+	}
+	return fmt.Sprintf("%v: fragmented frame of %v bytes exceeds %v bytes", errStrTooLarge, e.total, e.max)
+}
+
+//reassembly is a fragmented frame being received
+type reassembly struct {
+	buf   []byte
+	total int
+}
+
+//reassembler collects fragments received from one connection. It is used only by the goroutine reading the connection
+type reassembler struct {
+	m     map[correlation]*reassembly
+	size  int64 //size is number of received bytes of all frames being reassembled
+	limit int64 //limit is max size
+}
+
+//read reads fragment from r. It returns the whole frame when the last fragment is received, otherwise nil.
+//Errors are *FrameError for malformed fragments and *fragmentSizeError for frames larger than max or too many bytes being reassembled
+func (ra *reassembler) read(r io.Reader, max int64) ([]byte, error) {
+	buf := readPool.Get().(*bytes.Buffer)
+	buf.Reset()
+	defer func() {
+		if buf.Cap() <= maxPooledBuffer {
+			readPool.Put(buf)
+		}
+	}()
+	if _, err := buf.ReadFrom(r); err != nil {
+		return nil, err
+	}
+	return ra.add(buf.Bytes(), max)
+}
+
+func (ra *reassembler) add(raw []byte, max int64) ([]byte, error) {
+	flags, id, total, piece, err := parseFragment(raw)
+	if err != nil {
+		return nil, err
+	}
+	if ra.m == nil {
+		ra.m = make(map[correlation]*reassembly)
+	}
+	re, ok := ra.m[id]
+	if flags&fragFirst != 0 {
+		if ok == true {
+			return nil, &FrameError{Type: typeFragment, Field: "fragment id", Offset: 1, Size: len(raw)}
+		}
+		if len(ra.m) >= maxReassemblies {
+			return nil, &FrameError{Type: typeFragment, Field: "fragmented frames in progress", Offset: 1, Size: len(raw)}
+		}
+		if int64(total) > max {
+			return nil, &fragmentSizeError{total: int64(total), max: max}
+		}
+		//memory grows with received fragments, not with declared size
+		re = &reassembly{total: total}
+		ra.m[id] = re
+	} else if ok == false {
+		return nil, &FrameError{Type: typeFragment, Field: "fragment id", Offset: 1, Size: len(raw)}
+	}
+	if len(re.buf)+len(piece) > re.total {
+		ra.remove(id, re)
+		return nil, &FrameError{Type: typeFragment, Field: "fragment", Offset: len(raw) - len(piece), Size: len(raw)}
+	}
+	if size := ra.size + int64(len(piece)); size > ra.limit {
+		ra.remove(id, re)
+		return nil, &fragmentSizeError{total: size, max: ra.limit, inFlight: true}
+	}
+	re.buf = append(re.buf, piece...)
+	ra.size += int64(len(piece))
+	if flags&fragLast == 0 {
+		return nil, nil
+	}
+	ra.remove(id, re)
+	if len(re.buf) != re.total || re.total == 0 {
+		return nil, &FrameError{Type: typeFragment, Field: "total size", Offset: len(raw) - len(piece), Size: len(raw)}
+	}
+	return re.buf, nil
+}
+
+func (ra *reassembler) remove(id correlation, re *reassembly) {
+	delete(ra.m, id)
+	ra.size -= int64(len(re.buf))
+}
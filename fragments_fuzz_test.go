@@ -0,0 +1,22 @@
+//go:build go1.18
+
+package roletalk
+
+import "testing"
+
+func FuzzReassembler(f *testing.F) {
+	f.Add(fragment(fragFirst|fragLast, 1, 3, []byte("abc")))
+	f.Add(fragment(fragFirst, 7, 1<<20, []byte("abc")))
+	f.Add(fragment(0, 1, 0, nil))
+	f.Fuzz(func(t *testing.T, raw []byte) {
+		ra := reassembler{limit: 1 << 20}
+		ra.add(fragment(fragFirst, 1, 10, []byte("abc")), 1<<20)
+		res, err := ra.add(raw, 1<<20)
+		if err != nil && res != nil {
+			t.Fatalf("both result and error returned: %v", err)
+		}
+		if len(ra.m) > 2 {
+			t.Fatalf("%v frames in progress", len(ra.m))
+		}
+	})
+}
@@ -0,0 +1,121 @@
+package roletalk
+
+import (
+	"bytes"
+	"errors"
+	"sync"
+	"testing"
+
+	"gotest.tools/assert"
+)
+
+func fragment(flags byte, id correlation, total int, piece []byte) []byte {
+	return append(appendFragmentHead(nil, flags, id, total)[1:], piece...)
+}
+
+func TestReassembler(t *testing.T) {
+	ra := reassembler{limit: 1000}
+	res, err := ra.add(fragment(fragFirst, 1, 6, []byte("ab")), 100)
+	assert.NilError(t, err)
+	assert.Assert(t, res == nil)
+	//fragments of different frames are interleaved
+	res, err = ra.add(fragment(fragFirst|fragLast, 2, 3, []byte("xyz")), 100)
+	assert.NilError(t, err)
+	assert.DeepEqual(t, res, []byte("xyz"))
+	res, err = ra.add(fragment(0, 1, 0, []byte("cd")), 100)
+	assert.NilError(t, err)
+	assert.Assert(t, res == nil)
+	res, err = ra.add(fragment(fragLast, 1, 0, []byte("ef")), 100)
+	assert.NilError(t, err)
+	assert.DeepEqual(t, res, []byte("abcdef"))
+	assert.Equal(t, len(ra.m), 0)
+
+	frameErr := &FrameError{}
+	_, err = ra.add(fragment(0, 3, 0, []byte("a")), 100)
+	assert.ErrorType(t, err, frameErr)
+	_, err = ra.add(fragment(fragFirst, 3, 2, []byte("a")), 100)
+	assert.NilError(t, err)
+	_, err = ra.add(fragment(fragFirst, 3, 2, []byte("a")), 100)
+	assert.ErrorType(t, err, frameErr)
+	_, err = ra.add(fragment(fragLast, 3, 0, []byte("bc")), 100)
+	assert.ErrorType(t, err, frameErr)
+	_, err = ra.add(fragment(fragFirst|fragLast, 4, 3, []byte("ab")), 100)
+	assert.ErrorType(t, err, frameErr)
+	_, err = ra.add(fragment(fragFirst, 5, 101, nil), 100)
+	assert.ErrorType(t, err, &fragmentSizeError{})
+	assert.Equal(t, len(ra.m), 0)
+}
+
+func TestReassemblerLimit(t *testing.T) {
+	ra := reassembler{limit: 12}
+	_, err := ra.add(fragment(fragFirst, 1, 10, []byte("abcd")), 100)
+	assert.NilError(t, err)
+	_, err = ra.add(fragment(fragFirst, 2, 8, []byte("efgh")), 100)
+	assert.NilError(t, err)
+	res, err := ra.add(fragment(fragLast, 2, 0, []byte("ijkl")), 100)
+	assert.NilError(t, err)
+	assert.DeepEqual(t, res, []byte("efghijkl"))
+	assert.Equal(t, ra.size, int64(4))
+	//declared sizes are within MaxMessage, but received bytes of both frames exceed the limit
+	_, err = ra.add(fragment(fragFirst, 3, 8, []byte("mnop")), 100)
+	assert.NilError(t, err)
+	_, err = ra.add(fragment(0, 1, 0, []byte("qrstu")), 100)
+	assert.ErrorType(t, err, &fragmentSizeError{})
+	assert.Equal(t, err.(*fragmentSizeError).inFlight, true)
+	assert.Equal(t, len(ra.m), 1)
+	assert.Equal(t, ra.size, int64(4))
+}
+
+func TestFragmentedPayloads(t *testing.T) {
+	var mx sync.Mutex
+	var progress, responseProgress [][2]int
+	received := make(chan []byte, 1)
+	_, client, unit := testPeers(t, PeerOptions{Name: "fragments server"}, PeerOptions{Name: "fragments client"}, ConnectOptions{DoNotReconnect: true}, func(server *Peer) {
+		role := server.Role("fragments")
+		role.OnRequest("echo", func(ctx *RequestContext) {
+			ctx.OnProgress = func(sent, total int) {
+				mx.Lock()
+				responseProgress = append(responseProgress, [2]int{sent, total})
+				mx.Unlock()
+			}
+			ctx.Reply(ctx.Data)
+		})
+		role.OnMessage("store", func(ctx *MessageContext) { received <- ctx.Data.([]byte) })
+	})
+	assert.Assert(t, unit.fragments == true)
+	assert.DeepEqual(t, unit.Meta().Features, []string{featureFragments, featureDuplex, featureResume})
+
+	data := bytes.Repeat([]byte("0123456789abcdef"), 5<<20/16)
+	onProgress := func(sent, total int) {
+		mx.Lock()
+		progress = append(progress, [2]int{sent, total})
+		mx.Unlock()
+	}
+	//small requests are not blocked by a large one
+	done := make(chan error, 1)
+	go func() {
+		res, err := client.Destination("fragments").Request("echo", EmitOptions{Data: data, OnProgress: onProgress})
+		if err == nil && bytes.Equal(res.Data.([]byte), data) == false {
+			err = errors.New("echo differs")
+		}
+		done <- err
+	}()
+	res, err := client.Destination("fragments").Request("echo", EmitOptions{Data: "small"})
+	assert.NilError(t, err)
+	assert.Equal(t, res.Data, "small")
+	assert.NilError(t, <-done)
+	assert.Assert(t, len(progress) > len(data)/fragmentSize, len(progress))
+	assert.DeepEqual(t, progress[len(progress)-1], [2]int{len(data), len(data)})
+	waitFor(t, func() bool {
+		mx.Lock()
+		defer mx.Unlock()
+		return len(responseProgress) > 1 && responseProgress[len(responseProgress)-1] == [2]int{len(data), len(data)}
+	})
+
+	//units not supporting fragments get single frames
+	unit.fragments = false
+	progress = nil
+	assert.NilError(t, client.Destination("fragments").Send("store", EmitOptions{Data: data, OnProgress: onProgress}))
+	assert.Assert(t, bytes.Equal(<-received, data))
+	assert.DeepEqual(t, progress, [][2]int{{len(data), len(data)}})
+}
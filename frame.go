@@ -0,0 +1,105 @@
+package roletalk
+
+import (
+	"bytes"
+	"io"
+	"sync"
+)
+
+//frame is outgoing message. head is written to websocket writer first and body goes right after it, so payload is never concatenated with header
+type frame struct {
+	head    []byte
+	body    []byte
+	buf     *[]byte //buf is pooled buffer of head. It is returned to pool by release
+	payload bool    //payload is true if the last byte of head is data type, so body can be compressed
+	//progress is called with number of body bytes written. Fragmented frames report after each fragment
+	progress func(sent, total int)
+}
+
+//maxPooledBuffer restricts capacity of buffers returned to pools, so a single huge message does not pin memory
+const maxPooledBuffer = 64 * 1024
+
+var headPool = sync.Pool{New: func() interface{} {
+	b := make([]byte, 0, 128)
+	return &b
+}}
+
+var readPool = sync.Pool{New: func() interface{} {
+	return new(bytes.Buffer)
+}}
+
+func newFrame() frame {
+	buf := headPool.Get().(*[]byte)
+	return frame{head: (*buf)[:0], buf: buf}
+}
+
+//rawFrame wraps already serialized message
+func rawFrame(msg []byte) frame {
+	return frame{body: msg}
+}
+
+func (f frame) size() int {
+	return len(f.head) + len(f.body)
+}
+
+//release returns header buffer to pool. The frame must not be used afterwards
+func (f frame) release() {
+	if f.buf == nil || cap(f.head) > maxPooledBuffer {
+		return
+	}
+	*f.buf = f.head[:0]
+	headPool.Put(f.buf)
+}
+
+func onewayFrame(role, event string, t Datatype, body []byte) frame {
+	f := newFrame()
+	f.head = append(appendOnewayHead(f.head, role, event), byte(t))
+	f.body = body
+	f.payload = true
+	return f
+}
+
+func requestFrame(role, event string, corr correlation, t Datatype, body []byte) frame {
+	f := newFrame()
+	f.head = append(appendRequestHead(f.head, role, event, corr), byte(t))
+	f.body = body
+	f.payload = true
+	return f
+}
+
+func streamRequestFrame(way byte, role, event string, corr, channel correlation, t Datatype, body []byte) frame {
+	f := newFrame()
+	f.head = append(appendStreamRequestHead(f.head, way, role, event, corr, channel), byte(t))
+	f.body = body
+	f.payload = true
+	return f
+}
+
+func responseFrame(way byte, corr correlation, t Datatype, body []byte) frame {
+	f := newFrame()
+	f.head = append(appendResponseHead(f.head, way, corr), byte(t))
+	f.body = body
+	f.payload = true
+	return f
+}
+
+func streamResponseFrame(way byte, corr, channel correlation, t Datatype, body []byte) frame {
+	f := newFrame()
+	f.head = append(appendStreamResponseHead(f.head, way, corr, channel), byte(t))
+	f.body = body
+	f.payload = true
+	return f
+}
+
+//readAllPooled reads r to the end through pooled buffer and returns a copy of exact size, so it is allocated once
+func readAllPooled(r io.Reader) ([]byte, error) {
+	buf := readPool.Get().(*bytes.Buffer)
+	buf.Reset()
+	_, err := buf.ReadFrom(r)
+	raw := make([]byte, buf.Len())
+	copy(raw, buf.Bytes())
+	if buf.Cap() <= maxPooledBuffer {
+		readPool.Put(buf)
+	}
+	return raw, err
+}
@@ -4,8 +4,10 @@ go 1.13
 
 require (
 	github.com/blang/semver v3.5.1+incompatible
-	github.com/google/go-cmp v0.4.0 // indirect
 	github.com/gorilla/websocket v1.4.1
-	github.com/pkg/errors v0.8.1
+	github.com/klauspost/compress v1.11.13
+	github.com/pkg/errors v0.9.1
 	gotest.tools v2.2.0+incompatible
 )
+
+require github.com/google/go-cmp v0.5.5 // indirect
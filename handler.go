@@ -2,45 +2,73 @@ package roletalk
 
 import (
 	"encoding/json"
-	"errors"
 	"fmt"
 )
 
 func (peer *Peer) consumeIncomingMessages() {
-	for inc := range peer.incMsgChan {
-		peer.serveIncMsg(inc)
+	for {
+		select {
+		case inc := <-peer.incMsgChan:
+			peer.serveIncMsg(inc)
+		case <-peer.done:
+			return
+		}
 	}
 }
 
 func (peer *Peer) serveIncMsg(ctx *MessageContext) {
 	defer func() {
 		if r := recover(); r != nil {
+			peer.logger.Warn("protocol violation: malformed message", "unit", ctx.unit.id, "type", ctx.w, "error", fmt.Sprint(r))
 			go ctx.unit.closeWithCode(errIncorrectMessageStructure, fmt.Sprint(r))
 		}
 	}()
 	var role *Role
 	var hasRole bool
-	var err error
 	switch ctx.w {
 	case typeMessage:
-		roleName, event, t, rawData := parseOneway(ctx.raw)
+		roleName, event, t, rawData, err := parseOneway(ctx.raw)
+		if err != nil {
+			go peer.closeOnViolation(ctx.unit, ctx.conn, errIncorrectMessageStructure, err.Error())
+			return
+		}
+		if t, rawData, err = peer.decompress(ctx.unit, ctx.conn, t, rawData); err != nil {
+			return
+		}
 		ctx.role = roleName
 		ctx.origin.T = t
 		ctx.origin.Data = rawData
 		ctx.event = event
 		ctx.Data, err = retrieveDataByType(t, rawData)
 		if err != nil {
-			go closeConnWithCode(ctx.conn, errWrongMessageType, fmt.Sprintf("wrong data type: %v", t))
+			go peer.closeOnViolation(ctx.unit, ctx.conn, errWrongMessageType, fmt.Sprintf("wrong data type: %v", t))
+			return
+		}
+		if err = peer.sizeLimits.check(roleName, event, t, rawData); err != nil {
+			peer.oversize(ctx, err)
+			return
+		}
+		if role, hasRole = peer.getServedRole(roleName); hasRole == false {
 			return
 		}
-		if role, hasRole = peer.getRole(roleName); hasRole == false {
+		peer.metrics.MessageReceived(roleName, event)
+		if _, ok := peer.checkRate(role, ctx); ok == false {
 			return
 		}
-		go role.emitMsg(ctx)
+		peer.runHandler(role, func() { role.emitMsg(ctx) }, func(reason string) {
+			peer.logger.Debug("message dropped", "unit", ctx.unit.id, "role", roleName, "event", event, "reason", reason)
+		})
 	case typeRequest:
 		ctx := &RequestContext{MessageContext: ctx}
 		// ctx := &RequestContext{Conn: ctx.conn, Unit: ctx.unit, Event: ctx.event, Role: ctx.role, Data: ctx.Data, origin: ctx.origin, w: ctx.w, raw: ctx.raw}
-		roleName, event, corr, t, rawData := parseRequest(ctx.raw)
+		roleName, event, corr, t, rawData, err := parseRequest(ctx.raw)
+		if err != nil {
+			go peer.closeOnViolation(ctx.unit, ctx.conn, errIncorrectMessageStructure, err.Error())
+			return
+		}
+		if t, rawData, err = peer.decompress(ctx.unit, ctx.conn, t, rawData); err != nil {
+			return
+		}
 		ctx.role = roleName
 		ctx.origin.T = t
 		ctx.origin.Data = rawData
@@ -48,19 +76,36 @@ func (peer *Peer) serveIncMsg(ctx *MessageContext) {
 		ctx.corr = corr
 		ctx.Data, err = retrieveDataByType(t, rawData)
 		if err != nil {
-			go closeConnWithCode(ctx.conn, errWrongMessageType, fmt.Sprintf("wrong data type: %v", t))
+			go peer.closeOnViolation(ctx.unit, ctx.conn, errWrongMessageType, fmt.Sprintf("wrong data type: %v", t))
 			return
 		}
-		if role, hasRole = peer.getRole(roleName); hasRole == false {
+		if err = peer.sizeLimits.check(roleName, event, t, rawData); err != nil {
+			ctx.Reject(err)
+			return
+		}
+		if role, hasRole = peer.getServedRole(roleName); hasRole == false {
 			ctx.Reject(fmt.Sprintf("No such role [%v] on peer %v", roleName, peer.id))
 			return
 		}
-		go role.emitRequest(ctx)
+		peer.metrics.RequestReceived(roleName, event)
+		if retryAfter, ok := peer.checkRate(role, ctx.MessageContext); ok == false {
+			ctx.rejectRateLimited(retryAfter)
+			return
+		}
+		peer.runHandler(role, func() { role.emitRequest(ctx) }, func(reason string) { ctx.Reject(reason) })
 	case typeReader:
 		rc := &RequestContext{MessageContext: ctx}
 		ctx := &WriterRequestContext{RequestContext: rc}
 		// ctx := &RequestContext{Conn: ctx.conn, Unit: ctx.unit, Event: ctx.event, Role: ctx.role, Data: ctx.Data, origin: ctx.origin, w: ctx.w, raw: ctx.raw}
-		roleName, event, corr, channel, t, rawData := parseStreamRequest(ctx.raw)
+		roleName, event, corr, channel, t, rawData, err := parseStreamRequest(ctx.w, ctx.raw)
+		if err != nil {
+			go peer.closeOnViolation(ctx.unit, ctx.conn, errIncorrectMessageStructure, err.Error())
+			return
+		}
+		t, ctx.resumable = parseResumeType(t)
+		if t, rawData, err = peer.decompress(ctx.unit, ctx.conn, t, rawData); err != nil {
+			return
+		}
 		ctx.role = roleName
 		ctx.event = event
 		ctx.origin.T = t
@@ -69,19 +114,36 @@ func (peer *Peer) serveIncMsg(ctx *MessageContext) {
 		ctx.channel = channel
 		ctx.Data, err = retrieveDataByType(t, rawData)
 		if err != nil {
-			go closeConnWithCode(ctx.conn, errWrongMessageType, fmt.Sprintf("wrong data type: %v", t))
+			go peer.closeOnViolation(ctx.unit, ctx.conn, errWrongMessageType, fmt.Sprintf("wrong data type: %v", t))
 			return
 		}
-		if role, hasRole = peer.getRole(roleName); hasRole == false {
+		if err = peer.sizeLimits.check(roleName, event, t, rawData); err != nil {
+			ctx.Reject(err)
+			return
+		}
+		if role, hasRole = peer.getServedRole(roleName); hasRole == false {
 			ctx.Reject(fmt.Sprintf("No such role [%v] on peer %v", roleName, peer.id))
 			return
 		}
-		go role.emitWriter(ctx)
+		peer.metrics.RequestReceived(roleName, event)
+		if retryAfter, ok := peer.checkRate(role, ctx.MessageContext); ok == false {
+			ctx.rejectRateLimited(retryAfter)
+			return
+		}
+		peer.runHandler(role, func() { role.emitWriter(ctx) }, func(reason string) { ctx.Reject(reason) })
 	case typeWriter:
 		rc := &RequestContext{MessageContext: ctx}
 		ctx := &ReaderRequestContext{RequestContext: rc}
 		// ctx := &RequestContext{conn: ctx.conn, Unit: ctx.unit, Event: ctx.event, Role: ctx.role, Data: ctx.Data, origin: ctx.origin, w: ctx.w, raw: ctx.raw}
-		roleName, event, corr, channel, t, rawData := parseStreamRequest(ctx.raw)
+		roleName, event, corr, channel, t, rawData, err := parseStreamRequest(ctx.w, ctx.raw)
+		if err != nil {
+			go peer.closeOnViolation(ctx.unit, ctx.conn, errIncorrectMessageStructure, err.Error())
+			return
+		}
+		t, ctx.resumable = parseResumeType(t)
+		if t, rawData, err = peer.decompress(ctx.unit, ctx.conn, t, rawData); err != nil {
+			return
+		}
 		ctx.role = roleName
 		ctx.origin.T = t
 		ctx.origin.Data = rawData
@@ -90,58 +152,132 @@ func (peer *Peer) serveIncMsg(ctx *MessageContext) {
 		ctx.channel = channel
 		ctx.Data, err = retrieveDataByType(t, rawData)
 		if err != nil {
-			go closeConnWithCode(ctx.conn, errWrongMessageType, fmt.Sprintf("wrong data type: %v", t))
+			go peer.closeOnViolation(ctx.unit, ctx.conn, errWrongMessageType, fmt.Sprintf("wrong data type: %v", t))
+			return
+		}
+		if err = peer.sizeLimits.check(roleName, event, t, rawData); err != nil {
+			ctx.Reject(err)
 			return
 		}
-		if role, hasRole = peer.getRole(roleName); hasRole == false {
+		if role, hasRole = peer.getServedRole(roleName); hasRole == false {
 			ctx.Reject(fmt.Sprintf("No such role [%v] on peer %v", roleName, peer.id))
 			return
 		}
-		go role.emitReader(ctx)
+		peer.metrics.RequestReceived(roleName, event)
+		if retryAfter, ok := peer.checkRate(role, ctx.MessageContext); ok == false {
+			ctx.rejectRateLimited(retryAfter)
+			return
+		}
+		peer.runHandler(role, func() { role.emitReader(ctx) }, func(reason string) { ctx.Reject(reason) })
+	case typeDuplex:
+		rc := &RequestContext{MessageContext: ctx}
+		ctx := &DuplexRequestContext{RequestContext: rc}
+		roleName, event, corr, channel, t, rawData, err := parseStreamRequest(ctx.w, ctx.raw)
+		if err != nil {
+			go peer.closeOnViolation(ctx.unit, ctx.conn, errIncorrectMessageStructure, err.Error())
+			return
+		}
+		t, ctx.resumable = parseResumeType(t)
+		if t, rawData, err = peer.decompress(ctx.unit, ctx.conn, t, rawData); err != nil {
+			return
+		}
+		ctx.role = roleName
+		ctx.origin.T = t
+		ctx.origin.Data = rawData
+		ctx.event = event
+		ctx.corr = corr
+		ctx.channel = channel
+		ctx.Data, err = retrieveDataByType(t, rawData)
+		if err != nil {
+			go peer.closeOnViolation(ctx.unit, ctx.conn, errWrongMessageType, fmt.Sprintf("wrong data type: %v", t))
+			return
+		}
+		if err = peer.sizeLimits.check(roleName, event, t, rawData); err != nil {
+			ctx.Reject(err)
+			return
+		}
+		if role, hasRole = peer.getServedRole(roleName); hasRole == false {
+			ctx.Reject(fmt.Sprintf("No such role [%v] on peer %v", roleName, peer.id))
+			return
+		}
+		peer.metrics.RequestReceived(roleName, event)
+		if retryAfter, ok := peer.checkRate(role, ctx.MessageContext); ok == false {
+			ctx.rejectRateLimited(retryAfter)
+			return
+		}
+		peer.runHandler(role, func() { role.emitDuplex(ctx) }, func(reason string) { ctx.Reject(reason) })
 	case typeStreamResolve:
 		// ctx := &StreamReponseContext{MessageContext: ctx}
-		corr, channel, t, rawData := parseStreamResponse(ctx.raw)
+		corr, channel, t, rawData, err := parseStreamResponse(ctx.w, ctx.raw)
+		if err != nil {
+			go peer.closeOnViolation(ctx.unit, ctx.conn, errIncorrectMessageStructure, err.Error())
+			return
+		}
+		if t, rawData, err = peer.decompress(ctx.unit, ctx.conn, t, rawData); err != nil {
+			return
+		}
 		ctx.channel = channel
 		ctx.origin.T = t
 		ctx.origin.Data = rawData
 		ctx.Data, err = retrieveDataByType(t, rawData)
 		if err != nil {
-			go closeConnWithCode(ctx.conn, errWrongMessageType, fmt.Sprintf("wrong data type: %v", t))
+			go peer.closeOnViolation(ctx.unit, ctx.conn, errWrongMessageType, fmt.Sprintf("wrong data type: %v", t))
 			return
 		}
-		go ctx.unit.callbackCtr.respond(corr, &callback{ctx: ctx})
+		ctx.unit.callbackCtr.respond(corr, &callback{ctx: ctx})
 	case typeStreamReject:
 		// ctx := StreamReponseContext{MessageContext: ctx}
-		corr, channel, t, rawData := parseStreamResponse(ctx.raw)
+		corr, channel, t, rawData, err := parseStreamResponse(ctx.w, ctx.raw)
+		if err != nil {
+			go peer.closeOnViolation(ctx.unit, ctx.conn, errIncorrectMessageStructure, err.Error())
+			return
+		}
+		if t, rawData, err = peer.decompress(ctx.unit, ctx.conn, t, rawData); err != nil {
+			return
+		}
 		ctx.channel = channel
 		ctx.origin.T = t
 		ctx.origin.Data = rawData
 		ctx.Data, err = retrieveDataByType(t, rawData)
 		if err != nil {
-			go closeConnWithCode(ctx.conn, errWrongMessageType, fmt.Sprintf("wrong data type: %v", t))
+			go peer.closeOnViolation(ctx.unit, ctx.conn, errWrongMessageType, fmt.Sprintf("wrong data type: %v", t))
 			return
 		}
-		go ctx.unit.callbackCtr.respond(corr, &callback{ctx: ctx, err: errors.New(string(ctx.raw))})
+		ctx.unit.callbackCtr.respond(corr, &callback{ctx: ctx, err: parseRejection(t, rawData)})
 	case typeResolve:
-		corr, t, rawData := parseResponse(ctx.raw)
+		corr, t, rawData, err := parseResponse(ctx.w, ctx.raw)
+		if err != nil {
+			go peer.closeOnViolation(ctx.unit, ctx.conn, errIncorrectMessageStructure, err.Error())
+			return
+		}
+		if t, rawData, err = peer.decompress(ctx.unit, ctx.conn, t, rawData); err != nil {
+			return
+		}
 		ctx.origin.T = t
 		ctx.origin.Data = rawData
 		ctx.Data, err = retrieveDataByType(t, rawData)
 		if err != nil {
-			go closeConnWithCode(ctx.conn, errWrongMessageType, fmt.Sprintf("wrong data type: %v", t))
+			go peer.closeOnViolation(ctx.unit, ctx.conn, errWrongMessageType, fmt.Sprintf("wrong data type: %v", t))
 			return
 		}
 		ctx.unit.callbackCtr.respond(corr, &callback{ctx: ctx})
 	case typeReject:
-		corr, t, rawData := parseResponse(ctx.raw)
+		corr, t, rawData, err := parseResponse(ctx.w, ctx.raw)
+		if err != nil {
+			go peer.closeOnViolation(ctx.unit, ctx.conn, errIncorrectMessageStructure, err.Error())
+			return
+		}
+		if t, rawData, err = peer.decompress(ctx.unit, ctx.conn, t, rawData); err != nil {
+			return
+		}
 		ctx.origin.T = t
 		ctx.origin.Data = rawData
 		ctx.Data, err = retrieveDataByType(t, rawData)
 		if err != nil {
-			go closeConnWithCode(ctx.conn, errWrongMessageType, fmt.Sprintf("wrong data type: %v", t))
+			go peer.closeOnViolation(ctx.unit, ctx.conn, errWrongMessageType, fmt.Sprintf("wrong data type: %v", t))
 			return
 		}
-		go ctx.unit.callbackCtr.respond(corr, &callback{err: errors.New(string(rawData)), ctx: ctx})
+		ctx.unit.callbackCtr.respond(corr, &callback{err: parseRejection(t, rawData), ctx: ctx})
 	case typeRoles:
 		roles, err := parseRoles(ctx.raw)
 		if roles.I <= ctx.Unit().getLastRoleSession() {
@@ -150,7 +286,7 @@ func (peer *Peer) serveIncMsg(ctx *MessageContext) {
 
 		ctx.Unit().setLastRoleSession(roles.I)
 		if err != nil {
-			go closeConnWithCode(ctx.conn, errIncorrectMessageStructure, fmt.Sprintf("wrong roles message message: %v", string(ctx.raw)))
+			go peer.closeOnViolation(ctx.unit, ctx.conn, errIncorrectMessageStructure, fmt.Sprintf("wrong roles message message: %v", string(ctx.raw)))
 			return
 		}
 		newRoles := make(map[string]interface{})
@@ -159,27 +295,40 @@ func (peer *Peer) serveIncMsg(ctx *MessageContext) {
 		}
 
 		ctx.unit.rolesMx.Lock()
+		added, removed := diffRoles(ctx.unit.roles, newRoles)
 		ctx.unit.roles = newRoles
 		ctx.unit.rolesMx.Unlock()
+		peer.logger.Debug("unit roles changed", "unit", ctx.unit.id, "roles", roles.Roles)
+		peer.emit(Event{Type: EventUnitRolesChanged, UnitID: ctx.unit.id, UnitName: ctx.unit.name, AddedRoles: added, RemovedRoles: removed})
 
 		go peer.onNewUnitRoles(ctx.unit)
 	case typeAcquaint:
 		am := acquaintMsg{}
 		if err := json.Unmarshal(ctx.raw, &am); err != nil {
-			go closeConnWithCode(ctx.conn, errIncorrectMessageStructure, fmt.Sprintf("wrong acquaint message structure: %v", string(ctx.raw)))
+			go peer.closeOnViolation(ctx.unit, ctx.conn, errIncorrectMessageStructure, fmt.Sprintf("wrong acquaint message structure: %v", string(ctx.raw)))
+			return
 		}
+		peer.logger.Debug("acquaint received", "unit", ctx.unit.id, "peer", am.ID, "address", am.Address, "roles", am.Roles)
+		peer.emit(Event{Type: EventAcquaintReceived, UnitID: am.ID, Address: am.Address, AddedRoles: am.Roles})
 		if peer.Friendly == false || peer.Unit(am.ID) != nil {
 			return
 		}
 		for _, dest := range peer.ListDestinations() {
 			for _, role := range am.Roles {
 				if role == dest {
+					peer.logger.Info("following acquaint", "unit", ctx.unit.id, "peer", am.ID, "address", am.Address)
+					peer.emit(Event{Type: EventAcquaintFollowed, UnitID: am.ID, Address: am.Address, Destination: dest})
 					go peer.Connect(am.Address, ConnectOptions{})
 					return
 				}
 			}
 		}
 	default:
-		go closeConnWithCode(ctx.conn, errWrongMessageType, fmt.Sprintf("wrong message type: %v", ctx.raw[0]))
+		go peer.closeOnViolation(ctx.unit, ctx.conn, errWrongMessageType, fmt.Sprintf("wrong message type: %v", ctx.w))
 	}
 }
+
+func (peer *Peer) closeOnViolation(unit *Unit, conn *connLocker, code int, reason string) {
+	peer.logger.Warn("protocol violation", "unit", unit.id, "code", code, "reason", reason)
+	closeConnWithCode(conn, code, reason)
+}
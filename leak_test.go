@@ -0,0 +1,130 @@
+package roletalk
+
+import (
+	"io/ioutil"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"gotest.tools/assert"
+)
+
+//goroutines returns stacks of running goroutines by their ids
+func goroutines() map[string]string {
+	buf := make([]byte, 1<<20)
+	for {
+		n := runtime.Stack(buf, true)
+		if n < len(buf) {
+			buf = buf[:n]
+			break
+		}
+		buf = make([]byte, 2*len(buf))
+	}
+	stacks := make(map[string]string)
+	for _, stack := range strings.Split(string(buf), "\n\n") {
+		//stack starts with "goroutine <id> [<state>]:"
+		fields := strings.Fields(stack)
+		if len(fields) < 2 {
+			continue
+		}
+		stacks[fields[1]] = stack
+	}
+	return stacks
+}
+
+//checkGoroutines returns function which fails the test if goroutines started after checkGoroutines call are still running.
+//Goroutines are compared by ids, so goroutines of other tests exiting meanwhile do not hide the leak.
+//They are given a few seconds to exit, since closing connections waits for remote side up to closeGrace
+func checkGoroutines(t *testing.T) func() {
+	before := goroutines()
+	return func() {
+		deadline := time.Now().Add(closeGrace + 3*time.Second)
+		for {
+			var leaked []string
+			for id, stack := range goroutines() {
+				if _, ok := before[id]; ok == false {
+					leaked = append(leaked, stack)
+				}
+			}
+			if len(leaked) == 0 {
+				return
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("%v goroutines leaked:\n%s", len(leaked), strings.Join(leaked, "\n\n"))
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+}
+
+func TestPeerCloseLeak(t *testing.T) {
+	check := checkGoroutines(t)
+	server := NewPeer(PeerOptions{Name: "leak server"})
+	client := NewPeer(PeerOptions{Name: "leak client"})
+	server.Role("leak").OnRequest("ping", func(ctx *RequestContext) {
+		ctx.Reply("pong")
+	})
+	server.Role("leak").OnWriter("data", func(ctx *WriterRequestContext) {
+		writable, err := ctx.Reply(nil)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		writable.Write([]byte("data"))
+		writable.Close()
+	})
+	addr, err := server.Listen("localhost:0")
+	assert.NilError(t, err)
+	_, err = client.Connect("ws://"+addr.String(), ConnectOptions{})
+	assert.NilError(t, err)
+
+	res, err := client.Destination("leak").Request("ping", EmitOptions{})
+	assert.NilError(t, err)
+	assert.Equal(t, res.Data, "pong")
+	_, readable, err := client.Destination("leak").NewReader("data", EmitOptions{})
+	assert.NilError(t, err)
+	data, err := ioutil.ReadAll(readable)
+	assert.NilError(t, err)
+	assert.Equal(t, string(data), "data")
+
+	//client starts reconnecting to closed server; Close should stop it
+	server.Close()
+	time.Sleep(reconnInterval + 100*time.Millisecond)
+	client.Close()
+	check()
+}
+
+func TestUnitCloseLeak(t *testing.T) {
+	server := NewPeer(PeerOptions{Name: "leak server"})
+	client := NewPeer(PeerOptions{Name: "leak client"})
+	defer server.Close()
+	defer client.Close()
+	addr, err := server.Listen("localhost:0")
+	assert.NilError(t, err)
+
+	check := checkGoroutines(t)
+	sub := server.Subscribe(10)
+	unit, err := client.Connect("ws://"+addr.String(), ConnectOptions{DoNotReconnect: true})
+	assert.NilError(t, err)
+	waitForEvent(t, sub, EventUnitAdded)
+	unit.Close()
+	waitForEvent(t, sub, EventUnitRemoved)
+	sub.Close()
+	check()
+}
+
+func TestAuthFailureLeak(t *testing.T) {
+	server := NewPeer(PeerOptions{Name: "leak server"})
+	client := NewPeer(PeerOptions{Name: "leak client"})
+	defer server.Close()
+	defer client.Close()
+	server.AddKey("id", "key")
+	addr, err := server.Listen("localhost:0")
+	assert.NilError(t, err)
+
+	check := checkGoroutines(t)
+	_, err = client.Connect("ws://"+addr.String(), ConnectOptions{DoNotReconnect: true})
+	assert.Assert(t, err != nil)
+	check()
+}
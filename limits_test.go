@@ -0,0 +1,194 @@
+package roletalk
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"gotest.tools/assert"
+)
+
+type queueCollector struct {
+	nopCollector
+	mx    sync.Mutex
+	depth map[string]int
+}
+
+func (c *queueCollector) QueueDepth(role string, n int) {
+	c.mx.Lock()
+	c.depth[role] = n
+	c.mx.Unlock()
+}
+
+func TestRoleLimitsReject(t *testing.T) {
+	metrics := &queueCollector{depth: make(map[string]int)}
+	server := NewPeer(PeerOptions{Name: "limits server", Metrics: metrics})
+	client := NewPeer(PeerOptions{Name: "limits client"})
+	defer server.Close()
+	defer client.Close()
+	started := make(chan struct{}, 3)
+	release := make(chan struct{})
+	role := server.Role("limited")
+	role.SetLimits(Limits{Concurrency: 1, Queue: 1, Overflow: OverflowReject})
+	role.OnRequest("work", func(ctx *RequestContext) {
+		started <- struct{}{}
+		<-release
+		ctx.Reply(nil)
+	})
+	addr, err := server.Listen("localhost:0")
+	assert.NilError(t, err)
+	unit, err := client.Connect("ws://"+addr.String(), ConnectOptions{DoNotReconnect: true})
+	assert.NilError(t, err)
+
+	results := make(chan error, 2)
+	request := func() {
+		_, err := client.Destination("limited").Request("work", EmitOptions{Unit: unit})
+		results <- err
+	}
+	go request()
+	<-started
+	go request()
+	waitFor(t, func() bool {
+		_, queued := server.scheduler.load(role)
+		return queued == 1
+	})
+	metrics.mx.Lock()
+	assert.Equal(t, metrics.depth["limited"], 1)
+	metrics.mx.Unlock()
+
+	_, err = client.Destination("limited").Request("work", EmitOptions{Unit: unit})
+	assert.Error(t, err, errStrBusy)
+
+	close(release)
+	assert.NilError(t, <-results)
+	assert.NilError(t, <-results)
+	assert.Equal(t, len(started), 1)
+}
+
+func TestLimitsPriority(t *testing.T) {
+	peer := NewPeer(PeerOptions{Limits: Limits{Concurrency: 1, Queue: 10}})
+	defer peer.Close()
+	low := peer.Role("low")
+	high := peer.Role("high")
+	high.SetLimits(Limits{Priority: 1})
+
+	release := make(chan struct{})
+	order := make(chan string, 3)
+	submit := func(role *Role, name string, block bool) {
+		peer.scheduler.submit(&task{role: role, run: func() {
+			if block == true {
+				<-release
+			}
+			order <- name
+		}, reject: func(reason string) { order <- reason }})
+	}
+	submit(low, "blocker", true)
+	submit(low, "low", false)
+	submit(high, "high", false)
+	close(release)
+	assert.Equal(t, <-order, "blocker")
+	assert.Equal(t, <-order, "high")
+	assert.Equal(t, <-order, "low")
+}
+
+func TestLimitsDropOldest(t *testing.T) {
+	peer := NewPeer(PeerOptions{})
+	defer peer.Close()
+	role := peer.Role("drop")
+	role.SetLimits(Limits{Concurrency: 1, Queue: 1, Overflow: OverflowDropOldest})
+
+	release := make(chan struct{})
+	results := make(chan string, 3)
+	submit := func(name string, block bool) {
+		peer.scheduler.submit(&task{role: role, run: func() {
+			if block == true {
+				<-release
+			}
+			results <- name
+		}, reject: func(reason string) { results <- name + ": " + reason }})
+	}
+	submit("first", true)
+	submit("second", false)
+	submit("third", false)
+	assert.Equal(t, <-results, "second: "+errStrBusy)
+	close(release)
+	assert.Equal(t, <-results, "first")
+	assert.Equal(t, <-results, "third")
+}
+
+func TestLimitsDropOldestPriority(t *testing.T) {
+	peer := NewPeer(PeerOptions{Limits: Limits{Concurrency: 1, Queue: 2, Overflow: OverflowDropOldest}})
+	defer peer.Close()
+	low := peer.Role("low")
+	high := peer.Role("high")
+	high.SetLimits(Limits{Priority: 1})
+	lowest := peer.Role("lowest")
+	lowest.SetLimits(Limits{Priority: -1})
+
+	release := make(chan struct{})
+	results := make(chan string, 5)
+	submit := func(role *Role, name string, block bool) {
+		peer.scheduler.submit(&task{role: role, run: func() {
+			if block == true {
+				<-release
+			}
+			results <- name
+		}, reject: func(reason string) { results <- name + ": " + reason }})
+	}
+	submit(low, "blocker", true)
+	submit(high, "high", false)
+	submit(low, "low", false)
+	//queued task of high priority role is older, but task of low priority role is dropped
+	submit(low, "flood", false)
+	assert.Equal(t, <-results, "low: "+errStrBusy)
+	//queued tasks have higher priority than the new one
+	submit(lowest, "lowest", false)
+	assert.Equal(t, <-results, "lowest: "+errStrBusy)
+	close(release)
+	assert.Equal(t, <-results, "blocker")
+	assert.Equal(t, <-results, "high")
+	assert.Equal(t, <-results, "flood")
+}
+
+func TestLimitsBlock(t *testing.T) {
+	peer := NewPeer(PeerOptions{})
+	role := peer.Role("block")
+	role.SetLimits(Limits{Concurrency: 1, Overflow: OverflowBlock})
+
+	release := make(chan struct{})
+	submitted := make(chan struct{})
+	ran := make(chan struct{})
+	peer.scheduler.submit(&task{role: role, run: func() { <-release }, reject: func(string) {}})
+	go func() {
+		peer.scheduler.submit(&task{role: role, run: func() { close(ran) }, reject: func(string) {}})
+		close(submitted)
+	}()
+	select {
+	case <-submitted:
+		t.Fatal("submit has not blocked while the role is busy")
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(release)
+	<-submitted
+	<-ran
+
+	//blocked submit is released with rejection when the Peer is closed
+	release = make(chan struct{})
+	defer close(release)
+	peer.scheduler.submit(&task{role: role, run: func() { <-release }, reject: func(string) {}})
+	rejected := make(chan string, 1)
+	go peer.scheduler.submit(&task{role: role, run: func() {}, reject: func(reason string) { rejected <- reason }})
+	time.Sleep(20 * time.Millisecond)
+	peer.Close()
+	assert.Equal(t, <-rejected, errStrShutdown)
+}
+
+func waitFor(t *testing.T, cond func() bool) {
+	deadline := time.Now().Add(time.Second)
+	for cond() == false {
+		if time.Now().After(deadline) {
+			t.Fatal("Condition has not been met within 1 sec")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
@@ -0,0 +1,55 @@
+//go:build go1.21
+
+package roletalk
+
+import (
+	"bytes"
+	"log/slog"
+	"strings"
+	"sync"
+	"testing"
+
+	"gotest.tools/assert"
+)
+
+type syncBuffer struct {
+	mx  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mx.Lock()
+	defer b.mx.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mx.Lock()
+	defer b.mx.Unlock()
+	return b.buf.String()
+}
+
+//TestSlogLogger checks that *slog.Logger can be used as Logger. The file is built with go 1.21 and later, Logger itself does not depend on slog
+func TestSlogLogger(t *testing.T) {
+	out := &syncBuffer{}
+	logger := slog.New(slog.NewTextHandler(out, &slog.HandlerOptions{Level: slog.LevelDebug}))
+	server := NewPeer(PeerOptions{Name: "log server"})
+	client := NewPeer(PeerOptions{Name: "log client", Logger: logger})
+	defer server.Close()
+	defer client.Close()
+
+	addr, err := server.Listen("localhost:0")
+	assert.NilError(t, err)
+	unit, err := client.Connect("ws://"+addr.String(), ConnectOptions{DoNotReconnect: true})
+	assert.NilError(t, err)
+	defer unit.Close()
+
+	logs := out.String()
+	assert.Assert(t, strings.Contains(logs, "msg=\"connected to remote peer\""), logs)
+	assert.Assert(t, strings.Contains(logs, "unit="+server.ID()), logs)
+
+	server.AddKey("id", "key")
+	_, err = client.Connect("ws://"+addr.String(), ConnectOptions{DoNotReconnect: true})
+	assert.Assert(t, err != nil)
+	assert.Assert(t, strings.Contains(out.String(), "msg=\"authentication failed\""), out.String())
+}
@@ -0,0 +1,292 @@
+//Package mesh discovers topology of roletalk peers.
+//
+//Crawl starts from seed addresses, connects to each peer, learns its roles and asks its AdminRole
+//for connected units and acquaintances (addresses the peer has dialed). Addresses are followed recursively.
+//Peers which do not serve AdminRole (or deny access to it) are still added to the graph with their roles, but their neighbours remain unknown.
+package mesh
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/xshkut/roletalk-go"
+)
+
+//Key is preshared auth key (see roletalk.Peer.AddKey)
+type Key struct {
+	ID  string
+	Key string
+}
+
+//Options configure Crawl. All fields are optional
+type Options struct {
+	Keys        []Key         //Keys to authenticate with. Should include a key allowed by remote AdminOptions.KeyIDs
+	InsecureTLS bool          //InsecureTLS ignores TLS certificate errors
+	MaxPeers    int           //MaxPeers limits number of peers to connect to. 0 means no limit
+	Timeout     time.Duration //Timeout of each request to AdminRole. Default is 5 seconds
+}
+
+//Node is discovered peer
+type Node struct {
+	ID        string            `json:"id"`
+	Name      string            `json:"name,omitempty"`
+	Roles     []string          `json:"roles"`
+	Addresses []string          `json:"addresses"`
+	Meta      roletalk.MetaInfo `json:"meta"`
+	Crawled   bool              `json:"crawled"`         //Crawled is true if neighbours of the node have been retrieved from its AdminRole
+	Error     string            `json:"error,omitempty"` //Error explains why the node has not been crawled
+}
+
+//Edge is connection between two peers. If Address is not empty, peer From has dialed peer To by the Address
+type Edge struct {
+	From    string `json:"from"`
+	To      string `json:"to"`
+	Address string `json:"address,omitempty"`
+}
+
+//Graph is discovered topology
+type Graph struct {
+	Nodes       []*Node           `json:"nodes"`
+	Edges       []Edge            `json:"edges"`
+	Unreachable map[string]string `json:"unreachable,omitempty"` //Unreachable maps addresses Crawl failed to connect to onto errors
+}
+
+type crawler struct {
+	peer      *roletalk.Peer
+	opts      Options
+	nodes     map[string]*Node
+	edges     map[Edge]struct{}
+	visited   map[string]struct{}
+	queue     []string
+	connected int
+	graph     *Graph
+}
+
+//Crawl discovers peers reachable from seeds and returns the graph. It returns error only if ctx is done, without waiting for the peer being visited;
+//peers which failed to connect are listed in Graph.Unreachable
+func Crawl(ctx context.Context, seeds []string, opts Options) (*Graph, error) {
+	if opts.Timeout == 0 {
+		opts.Timeout = 5 * time.Second
+	}
+	c := &crawler{
+		peer:    roletalk.NewPeer(roletalk.PeerOptions{Name: "roletalk-mesh"}),
+		opts:    opts,
+		nodes:   make(map[string]*Node),
+		edges:   make(map[Edge]struct{}),
+		visited: make(map[string]struct{}),
+		graph:   &Graph{Unreachable: make(map[string]string)},
+	}
+	defer c.peer.Close()
+	for _, key := range opts.Keys {
+		c.peer.AddKey(key.ID, key.Key)
+	}
+	c.enqueue(seeds...)
+	for len(c.queue) > 0 {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		if opts.MaxPeers > 0 && c.connected >= opts.MaxPeers {
+			break
+		}
+		addr := c.queue[0]
+		c.queue = c.queue[1:]
+		visited := make(chan struct{})
+		go func() {
+			c.visit(addr)
+			close(visited)
+		}()
+		select {
+		case <-visited:
+		case <-ctx.Done():
+			//hung peer could block connecting or requests for long, so the visit is abandoned. Closing the peer closes its connection
+			return nil, ctx.Err()
+		}
+	}
+	return c.result(), nil
+}
+
+func (c *crawler) enqueue(addrs ...string) {
+	for _, addr := range addrs {
+		if _, ok := c.visited[addr]; ok == true {
+			continue
+		}
+		c.visited[addr] = struct{}{}
+		c.queue = append(c.queue, addr)
+	}
+}
+
+func (c *crawler) node(id string) *Node {
+	n, ok := c.nodes[id]
+	if ok == false {
+		n = &Node{ID: id, Roles: []string{}, Addresses: []string{}}
+		c.nodes[id] = n
+	}
+	return n
+}
+
+func (c *crawler) addEdge(from, to, addr string) {
+	if from == c.peer.ID() || to == c.peer.ID() || from == to {
+		return
+	}
+	c.edges[Edge{From: from, To: to, Address: addr}] = struct{}{}
+}
+
+func (c *crawler) visit(addr string) {
+	unit, err := c.peer.Connect(addr, roletalk.ConnectOptions{DoNotReconnect: true, DoNotAcquaint: true, InsecureTLS: c.opts.InsecureTLS})
+	if err != nil {
+		c.graph.Unreachable[addr] = err.Error()
+		return
+	}
+	defer unit.Close()
+	c.connected++
+
+	n := c.node(unit.ID())
+	n.Name = unit.Name()
+	n.Meta = unit.Meta()
+	n.Roles = unit.GetRoles()
+	n.Addresses = appendUnique(n.Addresses, addr)
+	if n.Crawled == true {
+		return
+	}
+	if unit.HasRole(roletalk.AdminRole) == false {
+		n.Error = "peer does not serve " + roletalk.AdminRole
+		return
+	}
+
+	units := []roletalk.UnitSnapshot{}
+	if err := c.request(unit, "units", &units); err != nil {
+		n.Error = err.Error()
+		return
+	}
+	acquaintances := []roletalk.Acquaintance{}
+	if err := c.request(unit, "acquaintances", &acquaintances); err != nil {
+		n.Error = err.Error()
+		return
+	}
+	n.Crawled = true
+	n.Error = ""
+
+	for _, us := range units {
+		if us.ID == c.peer.ID() {
+			continue
+		}
+		neighbour := c.node(us.ID)
+		neighbour.Name = us.Name
+		neighbour.Meta = us.Meta
+		neighbour.Roles = us.Roles
+		c.addEdge(n.ID, us.ID, "")
+	}
+	for _, acq := range acquaintances {
+		neighbour := c.node(acq.ID)
+		neighbour.Addresses = appendUnique(neighbour.Addresses, acq.Address)
+		if neighbour.Name == "" {
+			neighbour.Name = acq.Name
+			neighbour.Roles = acq.Roles
+		}
+		c.addEdge(n.ID, acq.ID, acq.Address)
+		c.enqueue(acq.Address)
+	}
+}
+
+func (c *crawler) request(unit *roletalk.Unit, event string, v interface{}) error {
+	res, err := c.peer.Destination(roletalk.AdminRole).Request(event, roletalk.EmitOptions{Unit: unit, Timeout: c.opts.Timeout})
+	if err != nil {
+		return fmt.Errorf("%v request failed: %v", event, err)
+	}
+	raw, ok := res.Data.([]byte)
+	if ok == false {
+		return fmt.Errorf("%v request replied with %v instead of JSON", event, res.OriginData().T)
+	}
+	return json.Unmarshal(raw, v)
+}
+
+//result merges undirected duplicates: an edge without address is dropped if there is one with address between the same peers
+func (c *crawler) result() *Graph {
+	g := c.graph
+	for _, n := range c.nodes {
+		sort.Strings(n.Roles)
+		sort.Strings(n.Addresses)
+		g.Nodes = append(g.Nodes, n)
+	}
+	sort.Slice(g.Nodes, func(i, j int) bool { return g.Nodes[i].ID < g.Nodes[j].ID })
+
+	dialed := make(map[[2]string]struct{})
+	for e := range c.edges {
+		if e.Address != "" {
+			dialed[pair(e.From, e.To)] = struct{}{}
+			g.Edges = append(g.Edges, e)
+		}
+	}
+	for e := range c.edges {
+		if e.Address != "" {
+			continue
+		}
+		p := pair(e.From, e.To)
+		if _, ok := dialed[p]; ok == true {
+			continue
+		}
+		dialed[p] = struct{}{}
+		g.Edges = append(g.Edges, Edge{From: p[0], To: p[1]})
+	}
+	sort.Slice(g.Edges, func(i, j int) bool {
+		a, b := g.Edges[i], g.Edges[j]
+		if a.From != b.From {
+			return a.From < b.From
+		}
+		if a.To != b.To {
+			return a.To < b.To
+		}
+		return a.Address < b.Address
+	})
+	return g
+}
+
+func pair(a, b string) [2]string {
+	if a > b {
+		return [2]string{b, a}
+	}
+	return [2]string{a, b}
+}
+
+func appendUnique(sl []string, s string) []string {
+	for _, v := range sl {
+		if v == s {
+			return sl
+		}
+	}
+	return append(sl, s)
+}
+
+//WriteDOT writes the graph in Graphviz DOT format. Edges with address are directed from dialer to listener
+func (g *Graph) WriteDOT(w io.Writer) error {
+	b := &strings.Builder{}
+	b.WriteString("digraph roletalk {\n")
+	b.WriteString("\tnode [shape=box];\n")
+	for _, n := range g.Nodes {
+		label := n.Name
+		if label == "" {
+			label = n.ID
+		}
+		label += "\n" + strings.Join(n.Roles, ", ")
+		style := ""
+		if n.Crawled == false {
+			style = ", style=dashed"
+		}
+		fmt.Fprintf(b, "\t%q [label=%q%v];\n", n.ID, label, style)
+	}
+	for _, e := range g.Edges {
+		if e.Address != "" {
+			fmt.Fprintf(b, "\t%q -> %q [label=%q];\n", e.From, e.To, e.Address)
+		} else {
+			fmt.Fprintf(b, "\t%q -> %q [dir=none];\n", e.From, e.To)
+		}
+	}
+	b.WriteString("}\n")
+	_, err := io.WriteString(w, b.String())
+	return err
+}
@@ -0,0 +1,89 @@
+package mesh
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/xshkut/roletalk-go"
+	"gotest.tools/assert"
+)
+
+func listen(t *testing.T, name string) (*roletalk.Peer, string) {
+	peer := roletalk.NewPeer(roletalk.PeerOptions{Name: name, Admin: &roletalk.AdminOptions{KeyIDs: []string{"admin"}}})
+	peer.AddKey("admin", "secret")
+	peer.Role(name + "-role")
+	addr, err := peer.Listen("localhost:0")
+	assert.NilError(t, err)
+	return peer, "ws://" + addr.String()
+}
+
+func TestCrawl(t *testing.T) {
+	a, addrA := listen(t, "a")
+	b, addrB := listen(t, "b")
+	c, addrC := listen(t, "c")
+	d, addrD := listen(t, "d")
+	for _, p := range []*roletalk.Peer{a, b, c, d} {
+		defer p.Close()
+	}
+	_, err := a.Connect(addrB, roletalk.ConnectOptions{DoNotAcquaint: true})
+	assert.NilError(t, err)
+	_, err = a.Connect(addrC, roletalk.ConnectOptions{DoNotAcquaint: true})
+	assert.NilError(t, err)
+	_, err = b.Connect(addrD, roletalk.ConnectOptions{DoNotAcquaint: true})
+	assert.NilError(t, err)
+	time.Sleep(time.Millisecond * 10)
+
+	g, err := Crawl(context.Background(), []string{addrA, "ws://localhost:1"}, Options{Keys: []Key{{"admin", "secret"}}})
+	assert.NilError(t, err)
+
+	assert.Equal(t, len(g.Nodes), 4)
+	for _, n := range g.Nodes {
+		assert.Assert(t, n.Crawled, n.Error)
+		assert.DeepEqual(t, n.Roles, []string{roletalk.AdminRole, n.Name + "-role"})
+	}
+	assert.DeepEqual(t, g.Edges, sortedEdges(
+		Edge{From: a.ID(), To: b.ID(), Address: addrB},
+		Edge{From: a.ID(), To: c.ID(), Address: addrC},
+		Edge{From: b.ID(), To: d.ID(), Address: addrD},
+	))
+	assert.Equal(t, len(g.Unreachable), 1)
+
+	buf := &bytes.Buffer{}
+	assert.NilError(t, g.WriteDOT(buf))
+	assert.Assert(t, strings.Contains(buf.String(), "\""+a.ID()+"\" -> \""+b.ID()+"\""), buf.String())
+}
+
+func sortedEdges(edges ...Edge) []Edge {
+	c := &crawler{edges: make(map[Edge]struct{}), graph: &Graph{}}
+	for _, e := range edges {
+		c.edges[e] = struct{}{}
+	}
+	return c.result().Edges
+}
+
+func TestCrawlHungSeed(t *testing.T) {
+	//seed accepts TCP connections, but never completes websocket handshake
+	ln, err := net.Listen("tcp", "localhost:0")
+	assert.NilError(t, err)
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err = Crawl(ctx, []string{"ws://" + ln.Addr().String()}, Options{})
+	assert.Equal(t, err, context.DeadlineExceeded)
+	assert.Assert(t, time.Since(start) < time.Second, time.Since(start))
+}
@@ -0,0 +1,142 @@
+package roletalk
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"gotest.tools/assert"
+)
+
+type testCollector struct {
+	nopCollector
+	mx       sync.Mutex
+	sent     map[string]int
+	received map[string]int
+	outcomes map[RequestOutcome]int
+	bytesIn  int
+	bytesOut int
+	timeouts map[StreamTimeoutKind]int
+}
+
+func newTestCollector() *testCollector {
+	return &testCollector{sent: make(map[string]int), received: make(map[string]int), outcomes: make(map[RequestOutcome]int), timeouts: make(map[StreamTimeoutKind]int)}
+}
+
+func (c *testCollector) MessageSent(role, event string) {
+	c.mx.Lock()
+	c.sent[role+"."+event]++
+	c.mx.Unlock()
+}
+
+func (c *testCollector) MessageReceived(role, event string) {
+	c.mx.Lock()
+	c.received[role+"."+event]++
+	c.mx.Unlock()
+}
+
+func (c *testCollector) RequestSent(role, event string) {
+	c.MessageSent(role, event)
+}
+
+func (c *testCollector) RequestReceived(role, event string) {
+	c.MessageReceived(role, event)
+}
+
+func (c *testCollector) RequestFinished(role, event string, o RequestOutcome, d time.Duration) {
+	c.mx.Lock()
+	c.outcomes[o]++
+	c.mx.Unlock()
+}
+
+func (c *testCollector) StreamTimeout(unitID string, kind StreamTimeoutKind) {
+	c.mx.Lock()
+	c.timeouts[kind]++
+	c.mx.Unlock()
+}
+
+func (c *testCollector) BytesSent(unitID string, n int) {
+	c.mx.Lock()
+	c.bytesOut += n
+	c.mx.Unlock()
+}
+
+func (c *testCollector) BytesReceived(unitID string, n int) {
+	c.mx.Lock()
+	c.bytesIn += n
+	c.mx.Unlock()
+}
+
+func TestMetrics(t *testing.T) {
+	serverMetrics := newTestCollector()
+	clientMetrics := newTestCollector()
+	server := NewPeer(PeerOptions{Name: "metrics server", Metrics: serverMetrics})
+	client := NewPeer(PeerOptions{Name: "metrics client", Metrics: clientMetrics})
+	defer server.Close()
+	defer client.Close()
+
+	received := make(chan interface{}, 1)
+	server.Role("metrics").OnMessage("msg", func(ctx *MessageContext) {
+		received <- ctx.Data
+	})
+	server.Role("metrics").OnRequest("req", func(ctx *RequestContext) {
+		ctx.Reply(ctx.Data)
+	})
+	server.Role("metrics").OnRequest("rej", func(ctx *RequestContext) {
+		ctx.Reject("rejected")
+	})
+	addr, err := server.Listen("localhost:0")
+	assert.NilError(t, err)
+	unit, err := client.Connect("ws://"+addr.String(), ConnectOptions{DoNotReconnect: true})
+	assert.NilError(t, err)
+	defer unit.Close()
+
+	dest := client.Destination("metrics")
+	assert.NilError(t, dest.Send("msg", EmitOptions{Data: "hello"}))
+	<-received
+	_, err = dest.Request("req", EmitOptions{Data: 1})
+	assert.NilError(t, err)
+	_, err = dest.Request("rej", EmitOptions{})
+	assert.Assert(t, err != nil)
+
+	clientMetrics.mx.Lock()
+	assert.Equal(t, clientMetrics.sent["metrics.msg"], 1)
+	assert.Equal(t, clientMetrics.sent["metrics.req"], 1)
+	assert.Equal(t, clientMetrics.outcomes[OutcomeResolved], 1)
+	assert.Equal(t, clientMetrics.outcomes[OutcomeRejected], 1)
+	assert.Assert(t, clientMetrics.bytesOut > 0)
+	assert.Assert(t, clientMetrics.bytesIn > 0)
+	clientMetrics.mx.Unlock()
+
+	serverMetrics.mx.Lock()
+	assert.Equal(t, serverMetrics.received["metrics.msg"], 1)
+	assert.Equal(t, serverMetrics.received["metrics.req"], 1)
+	assert.Equal(t, serverMetrics.received["metrics.rej"], 1)
+	serverMetrics.mx.Unlock()
+}
+
+//baseCollector implements Collector without optional interfaces
+type baseCollector struct {
+	Collector
+}
+
+func TestCollectorExtensions(t *testing.T) {
+	//Collector without optional interfaces gets no-op ones
+	base := extendCollector(baseCollector{})
+	base.QueueDepth("role", 1)
+	base.RateLimited("role", "event")
+	base.StreamTimeout("unit", StreamIdle)
+
+	queue := &queueCollector{depth: make(map[string]int)}
+	extended := extendCollector(struct {
+		Collector
+		QueueCollector
+	}{baseCollector{}, queue})
+	extended.QueueDepth("role", 2)
+	extended.RateLimited("role", "event")
+	assert.Equal(t, queue.depth["role"], 2)
+
+	metrics := newTestCollector()
+	assert.Equal(t, extendCollector(metrics), collector(metrics))
+	assert.Equal(t, extendCollector(nil), collector(nopCollector{}))
+}
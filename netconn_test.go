@@ -0,0 +1,128 @@
+package roletalk
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"gotest.tools/assert"
+)
+
+func TestHTTPOverStreams(t *testing.T) {
+	var listener *Listener
+	server, client, _ := testPeers(t, PeerOptions{Name: "duplex server"}, PeerOptions{Name: "duplex client"}, ConnectOptions{DoNotReconnect: true}, func(server *Peer) {
+		role := server.Role("duplex")
+		listener = role.Listen("http")
+	})
+	assert.Equal(t, listener.Addr().String(), server.ID()+"/duplex/http")
+	go http.Serve(listener, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "%v %v from %v", r.Method, r.URL.Path, r.RemoteAddr)
+	}))
+
+	dest := client.Destination("duplex")
+	transport := &http.Transport{DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+		return dest.Dial("http", EmitOptions{})
+	}}
+	defer transport.CloseIdleConnections()
+	httpClient := &http.Client{Transport: transport}
+	for i := 0; i < 3; i++ {
+		res, err := httpClient.Get(fmt.Sprintf("http://admin/status/%v", i))
+		assert.NilError(t, err)
+		body, err := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		assert.NilError(t, err)
+		assert.Equal(t, string(body), fmt.Sprintf("GET /status/%v from %v/duplex/http", i, client.ID()))
+	}
+
+	assert.NilError(t, listener.Close())
+	_, err := listener.Accept()
+	assert.Equal(t, err, ErrListenerClosed)
+	_, err = dest.Dial("http", EmitOptions{})
+	assert.ErrorContains(t, err, ErrListenerClosed.Error())
+}
+
+func TestDuplexDeadlines(t *testing.T) {
+	_, client, _ := testPeers(t, PeerOptions{Name: "duplex server"}, PeerOptions{Name: "duplex client"}, ConnectOptions{DoNotReconnect: true}, func(server *Peer) {
+		role := server.Role("duplex")
+		role.OnDuplex("silent", func(ctx *DuplexRequestContext) { ctx.Reply(nil) })
+	})
+	conn, err := client.Destination("duplex").Dial("silent", EmitOptions{})
+	assert.NilError(t, err)
+	defer conn.Close()
+
+	//pending Read is woken up by deadline
+	assert.NilError(t, conn.SetReadDeadline(time.Now().Add(50*time.Millisecond)))
+	start := time.Now()
+	_, err = conn.Read(make([]byte, 1))
+	assert.Equal(t, err, ErrDeadlineExceeded)
+	assert.Assert(t, err.(net.Error).Timeout())
+	assert.Assert(t, time.Since(start) >= 50*time.Millisecond)
+	//deadline can be extended
+	assert.NilError(t, conn.SetReadDeadline(time.Time{}))
+	assert.NilError(t, conn.SetReadDeadline(time.Now().Add(20*time.Millisecond)))
+	_, err = conn.Read(make([]byte, 1))
+	assert.Equal(t, err, ErrDeadlineExceeded)
+
+	//remote side does not read, so write stalls when quota is exhausted
+	assert.NilError(t, conn.SetWriteDeadline(time.Now().Add(50*time.Millisecond)))
+	n, err := conn.Write(make([]byte, 2*defQuotaSizeBytes))
+	assert.Equal(t, err, ErrDeadlineExceeded)
+	assert.Equal(t, n, defQuotaSizeBytes)
+
+	//Close wakes up pending Read
+	assert.NilError(t, conn.SetDeadline(time.Time{}))
+	done := make(chan error, 1)
+	go func() {
+		_, err := conn.Read(make([]byte, 1))
+		done <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+	assert.NilError(t, conn.Close())
+	assert.Assert(t, <-done != nil)
+}
+
+func TestForward(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "admin page")
+	}))
+	defer target.Close()
+	check := checkGoroutines(t)
+	server, client, _ := testPeers(t, PeerOptions{Name: "duplex server"}, PeerOptions{Name: "duplex client"}, ConnectOptions{DoNotReconnect: true}, func(server *Peer) {
+		role := server.Role("duplex")
+		role.ForwardTo("admin", target.Listener.Addr().String())
+		role.ForwardTo("nowhere", "localhost:1")
+	})
+
+	forwarder, err := client.Destination("duplex").Forward("localhost:0", "admin", EmitOptions{})
+	assert.NilError(t, err)
+	transport := &http.Transport{}
+	res, err := (&http.Client{Transport: transport}).Get("http://" + forwarder.Addr().String())
+	assert.NilError(t, err)
+	body, err := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	assert.NilError(t, err)
+	assert.Equal(t, string(body), "admin page")
+	//kept-alive connection is closed with the forwarder
+	assert.NilError(t, forwarder.Close())
+	transport.CloseIdleConnections()
+
+	//connection is closed if remote side fails to dial the target
+	forwarder, err = client.Destination("duplex").Forward("localhost:0", "nowhere", EmitOptions{})
+	assert.NilError(t, err)
+	conn, err := net.Dial("tcp", forwarder.Addr().String())
+	assert.NilError(t, err)
+	_, err = conn.Read(make([]byte, 1))
+	assert.Assert(t, err != nil)
+	conn.Close()
+	assert.NilError(t, forwarder.Close())
+
+	waitFor(t, func() bool { return client.openStreams() == 0 && server.openStreams() == 0 })
+	server.Close()
+	client.Close()
+	check()
+}
@@ -1,11 +1,16 @@
 package roletalk
 
 import (
+	"context"
+	"errors"
+	"sync/atomic"
 	"time"
 
 	"github.com/gorilla/websocket"
 )
 
+var errPeerShutdown = errors.New(errStrShutdown)
+
 func (peer *Peer) getRole(name string) (*Role, bool) {
 	peer.roleRWMutex.RLock()
 	role, ok := peer.roles[name]
@@ -13,13 +18,23 @@ func (peer *Peer) getRole(name string) (*Role, bool) {
 	return role, ok
 }
 
+//getServedRole returns role which is allowed to receive messages from units. AdminRole is reserved unless enabled with PeerOptions.Admin
+func (peer *Peer) getServedRole(name string) (*Role, bool) {
+	if name == AdminRole && peer.admin == false {
+		return nil, false
+	}
+	return peer.getRole(name)
+}
+
 func (peer *Peer) broadcastRoles() {
 	roles := peer.ListRoles()
 	units := peer.Units()
 	// fmt.Printf("Sending roles from %v, %v\n", peer.ID(), roles)
+	peer.logger.Debug("broadcasting roles", "roles", roles, "units", len(units))
 	for _, unit := range units {
-		err := unit.sendRoles(peer.incRolesBroadcastSession(), roles)
-		_ = err
+		if err := unit.sendRoles(peer.incRolesBroadcastSession(), roles); err != nil {
+			peer.logger.Warn("cannot send roles to unit", "unit", unit.id, "error", err)
+		}
 	}
 }
 
@@ -32,35 +47,51 @@ func (peer *Peer) incRolesBroadcastSession() int {
 
 func (peer *Peer) createUnit(res peerData) *Unit {
 	unit := Unit{id: res.ID, friendly: res.Friendly, meta: res.Meta, name: res.Name, peer: peer}
+	unit.fragments = hasFeature(res.Meta.Features, featureFragments)
 	unit.roles = make(map[string]interface{})
 	for _, role := range res.Roles {
 		unit.roles[role] = struct{}{}
 	}
-	unit.callbackCtr = createCallbackController()
-	unit.streamCtr = *createStreamController()
+	unit.callbackCtr = createCallbackController(func(n int) {
+		peer.metrics.InFlightRequests(res.ID, n)
+	})
+	unit.streamCtr = *createStreamController(func(n int) {
+		peer.metrics.OpenStreams(res.ID, n)
+	})
 	return &unit
 }
 
 func (peer *Peer) addConn(conn *connLocker) (unit *Unit, err error) {
+	conn.conn.SetReadLimit(peer.sizeLimits.MaxMessage)
 	res, err := peer.authenticateWS(conn)
 	if err != nil {
+		peer.metrics.AuthFailure()
+		peer.logger.Warn("authentication failed", "remote", conn.conn.RemoteAddr().String(), "error", err)
+		peer.emit(Event{Type: EventAuthFailed, Address: conn.conn.RemoteAddr().String(), Err: err})
 		closeConnWithCode(conn, errAuthRejected, "auth rejected")
 		return
 	}
 	if err := checkProtocolCompatibility(protocolVersion, res.Meta.Protocol); err != nil {
+		peer.logger.Warn("incompatible protocol version", "unit", res.ID, "protocol", res.Meta.Protocol, "error", err)
+		peer.emit(Event{Type: EventAuthFailed, UnitID: res.ID, UnitName: res.Name, Address: conn.conn.RemoteAddr().String(), Err: err})
 		closeConnWithCode(conn, errIncompatibleProtocolVersion, err.Error())
 		return nil, err
 	}
+	conn.codec = negotiateCodec(conn.compression.Codecs, res.Codecs)
+	peer.logger.Debug("authenticated", "unit", res.ID, "name", res.Name, "roles", res.Roles)
+	peer.emit(Event{Type: EventAuthSucceeded, UnitID: res.ID, UnitName: res.Name, Address: conn.conn.RemoteAddr().String()})
 	_, unitExists := peer.getUnit(res.ID)
 	if unitExists == false {
-		peer.addUnit(peer.createUnit(res))
+		peer.addUnit(peer.reviveUnit(res))
 	}
 	unit, _ = peer.getUnit(res.ID)
 	if unitExists == false {
+		peer.emit(Event{Type: EventUnitAdded, UnitID: unit.id, UnitName: unit.name, AddedRoles: unit.GetRoles()})
 		peer.runOnUnit(unit)
 	}
 	peer.onNewUnitRoles(unit)
 	unit.bindConn(conn)
+	peer.emit(Event{Type: EventConnOpened, UnitID: unit.id, UnitName: unit.name, Address: conn.conn.RemoteAddr().String()})
 	return
 }
 
@@ -89,7 +120,7 @@ func (peer *Peer) deleteUnit(u *Unit, err error) {
 	peer.unitRWMutex.Lock()
 	delete(peer.units, u.id)
 	peer.destRWMutex.Lock()
-	for r := range u.roles {
+	for _, r := range u.GetRoles() {
 		dest, ok := peer.destinations[r]
 		if ok == false {
 			break
@@ -98,7 +129,15 @@ func (peer *Peer) deleteUnit(u *Unit, err error) {
 	}
 	peer.destRWMutex.Unlock()
 	peer.unitRWMutex.Unlock()
-	go u.runOnClose(err)
+	peer.roleRWMutex.RLock()
+	for _, role := range peer.roles {
+		role.rates.forgetUnit(u.id)
+	}
+	peer.roleRWMutex.RUnlock()
+	peer.logger.Info("unit disconnected", "unit", u.id, "name", u.name, "error", err)
+	peer.emit(Event{Type: EventUnitRemoved, UnitID: u.id, UnitName: u.name, CloseCode: closeCode(err), Err: err})
+	u.callbackCtr.onClose()
+	go u.runOnClose(u.closeHandlers, err)
 }
 
 func (peer *Peer) addUnit(u *Unit) {
@@ -116,15 +155,31 @@ func (peer *Peer) getUnit(id string) (*Unit, bool) {
 
 func (peer *Peer) startReconnCycle(addr string, waitFirst bool) {
 	if waitFirst {
-		time.Sleep(reconnInterval)
+		select {
+		case <-time.After(reconnInterval):
+		case <-peer.done:
+			return
+		}
+	}
+	if peer.isDraining() == true {
+		return
 	}
 
 	uc, ok := peer.addrUnits.loadByAddress(addr)
-	if uc.conn != nil || ok == false {
+	if ok == false {
+		peer.emit(Event{Type: EventReconnectGaveUp, Address: addr})
+		return
+	}
+	if uc.conn != nil {
 		return
 	}
 
-	peer.Connect(addr)
+	peer.metrics.ReconnectAttempt(addr)
+	peer.logger.Info("reconnecting", "address", addr)
+	peer.emit(Event{Type: EventReconnectAttempt, Address: addr})
+	if unit, err := peer.Connect(addr); err == nil {
+		peer.emit(Event{Type: EventReconnectSucceeded, UnitID: unit.id, UnitName: unit.name, Address: addr})
+	}
 }
 
 func (peer *Peer) runOnUnit(unit *Unit) {
@@ -148,5 +203,87 @@ func (peer *Peer) runOnRole(role *Role) {
 //InvolveConn accepts websocket.Conn for authentication and further communication
 func (peer *Peer) InvolveConn(c *websocket.Conn) (*Unit, error) {
 	conn := createConnLocker(c)
+	conn.compression = peer.compression
 	return peer.addConn(conn)
 }
+
+//startDraining returns false if the Peer has already been draining
+func (peer *Peer) startDraining() bool {
+	peer.drainMx.Lock()
+	defer peer.drainMx.Unlock()
+	if peer.draining == true {
+		return false
+	}
+	peer.draining = true
+	return true
+}
+
+func (peer *Peer) isDraining() bool {
+	peer.drainMx.RLock()
+	defer peer.drainMx.RUnlock()
+	return peer.draining
+}
+
+//runHandler runs f within limits of the Peer and the role. Shutdown waits for f, including time it is queued.
+//If f is not going to run (the Peer is draining or limit is exceeded), reject is called instead
+func (peer *Peer) runHandler(role *Role, f func(), reject func(reason string)) {
+	peer.drainMx.RLock()
+	if peer.draining == true {
+		peer.drainMx.RUnlock()
+		reject(errStrShutdown)
+		return
+	}
+	atomic.AddInt64(&peer.handlers, 1)
+	peer.drainMx.RUnlock()
+	peer.scheduler.submit(&task{
+		role: role,
+		run: func() {
+			defer atomic.AddInt64(&peer.handlers, -1)
+			f()
+		},
+		reject: func(reason string) {
+			defer atomic.AddInt64(&peer.handlers, -1)
+			reject(reason)
+		},
+	})
+}
+
+//drain waits for in-flight handlers and opened streams. Nothing is waited for if ctx is done already
+func (peer *Peer) drain(ctx context.Context) error {
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	ticker := time.NewTicker(drainInterval)
+	defer ticker.Stop()
+	for atomic.LoadInt64(&peer.handlers) > 0 || peer.openStreams() > 0 {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+func (peer *Peer) openStreams() int {
+	n := 0
+	for _, unit := range peer.Units() {
+		n += unit.streamCtr.open()
+	}
+	return n
+}
+
+//terminate closes all connections and stops background goroutines. It is called once by Shutdown
+func (peer *Peer) terminate() {
+	close(peer.done)
+	peer.scheduler.close()
+	peer.addrUnits.clear()
+	for _, unit := range peer.Units() {
+		unit.callbackCtr.rejectAll(errPeerShutdown, true)
+		unit.closeWithCode(errManualClose, errStrShutdown)
+		unit.abandonSuspended(errPeerShutdown)
+	}
+	peer.clearDetached()
+	peer.logger.Info("peer closed")
+	peer.alive.Done()
+}
@@ -0,0 +1,24 @@
+package roletalk
+
+import (
+	"testing"
+
+	"gotest.tools/assert"
+)
+
+//testPeers creates server and client peers, lets setup register roles of the server and connects client to server with connect options.
+//setup could be nil. Both peers are closed when the test finishes
+func testPeers(t testing.TB, serverOpts, clientOpts PeerOptions, connect ConnectOptions, setup func(server *Peer)) (server, client *Peer, unit *Unit) {
+	server = NewPeer(serverOpts)
+	client = NewPeer(clientOpts)
+	t.Cleanup(server.Close)
+	t.Cleanup(client.Close)
+	if setup != nil {
+		setup(server)
+	}
+	addr, err := server.Listen("localhost:0")
+	assert.NilError(t, err)
+	unit, err = client.Connect("ws://"+addr.String(), connect)
+	assert.NilError(t, err)
+	return
+}
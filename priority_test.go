@@ -0,0 +1,112 @@
+package roletalk
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+
+	"gotest.tools/assert"
+)
+
+func TestWriteLanes(t *testing.T) {
+	wl := &writeLanes{}
+	wl.acquire(PriorityNormal)
+	assert.Assert(t, wl.isBusy())
+
+	order := make(chan Priority, 5)
+	for i, p := range []Priority{PriorityBulk, PriorityNormal, PriorityControl, PriorityHigh, PriorityHigh + 10} {
+		p := p
+		go func() {
+			wl.acquire(p)
+			order <- p
+			wl.release()
+		}()
+		n := i + 1
+		waitFor(t, func() bool {
+			wl.mx.Lock()
+			defer wl.mx.Unlock()
+			waiting := 0
+			for _, lane := range wl.waiting {
+				waiting += len(lane)
+			}
+			return waiting == n
+		})
+	}
+	wl.release()
+	//unknown priority shares the lane of the nearest known one
+	for _, expected := range []Priority{PriorityControl, PriorityHigh + 10, PriorityHigh, PriorityNormal, PriorityBulk} {
+		assert.Equal(t, <-order, expected)
+	}
+	assert.Assert(t, wl.isBusy() == false)
+}
+
+func TestWriteLanesBypass(t *testing.T) {
+	wl := &writeLanes{}
+	wl.acquire(PriorityNormal)
+	priorities := []Priority{PriorityBulk}
+	for i := 0; i < maxLaneBypass*2; i++ {
+		priorities = append(priorities, PriorityHigh)
+	}
+	order := make(chan Priority, len(priorities))
+	for i, p := range priorities {
+		p := p
+		go func() {
+			wl.acquire(p)
+			order <- p
+			wl.release()
+		}()
+		n := i + 1
+		waitFor(t, func() bool {
+			wl.mx.Lock()
+			defer wl.mx.Unlock()
+			return len(wl.waiting[PriorityBulk.lane()])+len(wl.waiting[PriorityHigh.lane()]) == n
+		})
+	}
+	wl.release()
+	//bulk writer is not starved by steady high priority writers
+	for i := 0; i < maxLaneBypass; i++ {
+		assert.Equal(t, <-order, PriorityHigh)
+	}
+	assert.Equal(t, <-order, PriorityBulk)
+}
+
+func TestStreamChunksInterleave(t *testing.T) {
+	server := NewPeer(PeerOptions{Name: "chunks server"})
+	client := NewPeer(PeerOptions{Name: "chunks client"})
+	defer server.Close()
+	defer client.Close()
+	payload := bytes.Repeat([]byte("0123456789abcdef"), 20*maxStreamChunk/16)
+	written := make(chan error, 1)
+	role := server.Role("chunks")
+	role.OnWriter("bulk", func(ctx *WriterRequestContext) {
+		ctx.Priority = PriorityBulk
+		w, err := ctx.Reply(nil)
+		if err != nil {
+			written <- err
+			return
+		}
+		_, err = w.Write(payload)
+		if err == nil {
+			err = w.Close()
+		}
+		written <- err
+	})
+	role.OnRequest("ping", func(ctx *RequestContext) { ctx.Reply("pong") })
+	addr, err := server.Listen("localhost:0")
+	assert.NilError(t, err)
+	_, err = client.Connect("ws://"+addr.String(), ConnectOptions{DoNotReconnect: true})
+	assert.NilError(t, err)
+
+	dest := client.Destination("chunks")
+	_, r, err := dest.NewReader("bulk", EmitOptions{Priority: PriorityBulk})
+	assert.NilError(t, err)
+	//the writer is stalled by quota in the middle of the payload, requests are not blocked by it
+	res, err := dest.Request("ping", EmitOptions{Priority: PriorityHigh})
+	assert.NilError(t, err)
+	assert.Equal(t, res.Data, "pong")
+
+	received, err := ioutil.ReadAll(r)
+	assert.NilError(t, err)
+	assert.NilError(t, <-written)
+	assert.Assert(t, bytes.Equal(received, payload))
+}
@@ -0,0 +1,198 @@
+//Package promcollector implements roletalk.Collector on top of Prometheus client.
+//
+//Usage:
+//
+//	collector := promcollector.New("myservice")
+//	prometheus.MustRegister(collector)
+//	peer := roletalk.NewPeer(roletalk.PeerOptions{Name: "myservice", Metrics: collector})
+package promcollector
+
+import (
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/xshkut/roletalk-go"
+)
+
+//Collector exposes roletalk metrics to Prometheus. It implements roletalk.Collector with its optional interfaces and prometheus.Collector.
+//Metrics of units are not labelled with unit ids: the ids are random per process start, so each restart of a remote peer would add series which are never deleted
+type Collector struct {
+	messagesSent     *prometheus.CounterVec
+	messagesReceived *prometheus.CounterVec
+	requestsSent     *prometheus.CounterVec
+	requestsReceived *prometheus.CounterVec
+	requestDuration  *prometheus.HistogramVec
+	inFlight         *unitGauge
+	openStreams      *unitGauge
+	bytesSent        prometheus.Counter
+	bytesReceived    prometheus.Counter
+	reconnects       *prometheus.CounterVec
+	heartbeatFails   prometheus.Counter
+	authFails        prometheus.Counter
+	queueDepth       *prometheus.GaugeVec
+	rateLimited      *prometheus.CounterVec
+	streamTimeouts   *prometheus.CounterVec
+}
+
+var _ roletalk.Collector = (*Collector)(nil)
+var _ roletalk.QueueCollector = (*Collector)(nil)
+var _ roletalk.RateLimitCollector = (*Collector)(nil)
+var _ roletalk.StreamTimeoutCollector = (*Collector)(nil)
+var _ prometheus.Collector = (*Collector)(nil)
+
+//New creates Collector. All metric names are prefixed with namespace (if not empty) and "roletalk" subsystem
+func New(namespace string) *Collector {
+	const subsystem = "roletalk"
+	counter := func(name, help string, labels ...string) *prometheus.CounterVec {
+		return prometheus.NewCounterVec(prometheus.CounterOpts{Namespace: namespace, Subsystem: subsystem, Name: name, Help: help}, labels)
+	}
+	gauge := func(name, help string, labels ...string) *prometheus.GaugeVec {
+		return prometheus.NewGaugeVec(prometheus.GaugeOpts{Namespace: namespace, Subsystem: subsystem, Name: name, Help: help}, labels)
+	}
+	total := func(name, help string) prometheus.Counter {
+		return prometheus.NewCounter(prometheus.CounterOpts{Namespace: namespace, Subsystem: subsystem, Name: name, Help: help})
+	}
+	sum := func(name, help string) *unitGauge {
+		return &unitGauge{gauge: prometheus.NewGauge(prometheus.GaugeOpts{Namespace: namespace, Subsystem: subsystem, Name: name, Help: help}), units: make(map[string]int)}
+	}
+	return &Collector{
+		messagesSent:     counter("messages_sent_total", "One-way messages written to connections", "role", "event"),
+		messagesReceived: counter("messages_received_total", "One-way messages received for local roles", "role", "event"),
+		requestsSent:     counter("requests_sent_total", "Requests written to connections", "role", "event"),
+		requestsReceived: counter("requests_received_total", "Requests received for local roles", "role", "event"),
+		requestDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "request_duration_seconds",
+			Help:      "Latency of outgoing requests by outcome (resolved, rejected, timeout, error)",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"role", "event", "outcome"}),
+		inFlight:       sum("inflight_requests", "Requests waiting for response from units"),
+		openStreams:    sum("open_streams", "Stream channels opened with units"),
+		bytesSent:      total("sent_bytes_total", "Bytes written to connections"),
+		bytesReceived:  total("received_bytes_total", "Bytes read from connections"),
+		reconnects:     counter("reconnect_attempts_total", "Reconnection attempts by address", "address"),
+		heartbeatFails: total("heartbeat_failures_total", "Connections which did not respond to ping in time"),
+		rateLimited:    counter("rate_limited_total", "Incoming messages dropped and requests rejected by rate limits", "role", "event"),
+		streamTimeouts: counter("stream_timeouts_total", "Streams destroyed by idle or stall timeout", "kind"),
+		queueDepth:     gauge("queue_depth", "Incoming messages and requests waiting for a free handler slot", "role"),
+		authFails:      total("auth_failures_total", "Connections which have not passed authentication"),
+	}
+}
+
+func (c *Collector) collectors() []prometheus.Collector {
+	return []prometheus.Collector{
+		c.messagesSent, c.messagesReceived, c.requestsSent, c.requestsReceived, c.requestDuration,
+		c.inFlight.gauge, c.openStreams.gauge, c.bytesSent, c.bytesReceived, c.reconnects, c.heartbeatFails, c.authFails, c.queueDepth, c.rateLimited, c.streamTimeouts,
+	}
+}
+
+//Describe implements prometheus.Collector
+func (c *Collector) Describe(ch chan<- *prometheus.Desc) {
+	for _, col := range c.collectors() {
+		col.Describe(ch)
+	}
+}
+
+//Collect implements prometheus.Collector
+func (c *Collector) Collect(ch chan<- prometheus.Metric) {
+	for _, col := range c.collectors() {
+		col.Collect(ch)
+	}
+}
+
+//MessageSent implements roletalk.Collector
+func (c *Collector) MessageSent(role, event string) {
+	c.messagesSent.WithLabelValues(role, event).Inc()
+}
+
+//MessageReceived implements roletalk.Collector
+func (c *Collector) MessageReceived(role, event string) {
+	c.messagesReceived.WithLabelValues(role, event).Inc()
+}
+
+//RequestSent implements roletalk.Collector
+func (c *Collector) RequestSent(role, event string) {
+	c.requestsSent.WithLabelValues(role, event).Inc()
+}
+
+//RequestReceived implements roletalk.Collector
+func (c *Collector) RequestReceived(role, event string) {
+	c.requestsReceived.WithLabelValues(role, event).Inc()
+}
+
+//RequestFinished implements roletalk.Collector
+func (c *Collector) RequestFinished(role, event string, outcome roletalk.RequestOutcome, latency time.Duration) {
+	c.requestDuration.WithLabelValues(role, event, string(outcome)).Observe(latency.Seconds())
+}
+
+//InFlightRequests implements roletalk.Collector
+func (c *Collector) InFlightRequests(unitID string, n int) {
+	c.inFlight.set(unitID, n)
+}
+
+//OpenStreams implements roletalk.Collector
+func (c *Collector) OpenStreams(unitID string, n int) {
+	c.openStreams.set(unitID, n)
+}
+
+//BytesSent implements roletalk.Collector
+func (c *Collector) BytesSent(unitID string, n int) {
+	c.bytesSent.Add(float64(n))
+}
+
+//BytesReceived implements roletalk.Collector
+func (c *Collector) BytesReceived(unitID string, n int) {
+	c.bytesReceived.Add(float64(n))
+}
+
+//ReconnectAttempt implements roletalk.Collector
+func (c *Collector) ReconnectAttempt(address string) {
+	c.reconnects.WithLabelValues(address).Inc()
+}
+
+//HeartbeatFailure implements roletalk.Collector
+func (c *Collector) HeartbeatFailure(unitID string) {
+	c.heartbeatFails.Inc()
+}
+
+//AuthFailure implements roletalk.Collector
+func (c *Collector) AuthFailure() {
+	c.authFails.Inc()
+}
+
+//RateLimited implements roletalk.RateLimitCollector
+func (c *Collector) RateLimited(role, event string) {
+	c.rateLimited.WithLabelValues(role, event).Inc()
+}
+
+//QueueDepth implements roletalk.QueueCollector
+func (c *Collector) QueueDepth(role string, n int) {
+	c.queueDepth.WithLabelValues(role).Set(float64(n))
+}
+
+//StreamTimeout implements roletalk.StreamTimeoutCollector
+func (c *Collector) StreamTimeout(unitID string, kind roletalk.StreamTimeoutKind) {
+	c.streamTimeouts.WithLabelValues(string(kind)).Inc()
+}
+
+//unitGauge is a gauge of sum of values reported per unit. Units with zero value are forgotten, so closed units do not hold memory
+type unitGauge struct {
+	mx    sync.Mutex
+	gauge prometheus.Gauge
+	units map[string]int
+	total int
+}
+
+func (g *unitGauge) set(unitID string, n int) {
+	g.mx.Lock()
+	defer g.mx.Unlock()
+	g.total += n - g.units[unitID]
+	if n == 0 {
+		delete(g.units, unitID)
+	} else {
+		g.units[unitID] = n
+	}
+	g.gauge.Set(float64(g.total))
+}
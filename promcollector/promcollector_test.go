@@ -0,0 +1,25 @@
+package promcollector
+
+import (
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestUnitGauge(t *testing.T) {
+	c := New("")
+	c.InFlightRequests("a", 2)
+	c.InFlightRequests("b", 3)
+	c.InFlightRequests("a", 1)
+	if v := testutil.ToFloat64(c.inFlight.gauge); v != 4 {
+		t.Fatalf("expected 4 requests in flight, got %v", v)
+	}
+	c.InFlightRequests("a", 0)
+	c.InFlightRequests("b", 0)
+	if v := testutil.ToFloat64(c.inFlight.gauge); v != 0 {
+		t.Fatalf("expected no requests in flight, got %v", v)
+	}
+	if len(c.inFlight.units) != 0 {
+		t.Fatalf("closed units are kept: %v", c.inFlight.units)
+	}
+}
@@ -2,8 +2,9 @@ package roletalk
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
-	"math"
+	"io"
 	"strconv"
 	"strings"
 )
@@ -17,128 +18,232 @@ func serializeString(t byte, str string) []byte {
 }
 
 func serializeOneway(role, event string, msg []byte) []byte {
-	binRole := []byte(role)
-	binEvent := []byte(event)
-	temp := []byte{typeMessage}
-	temp = append(temp, int2Bytes(len(binRole))...)
-	temp = append(temp, int2Bytes(len(binEvent))...)
-	temp = append(temp, binRole...)
-	temp = append(temp, binEvent...)
-	temp = append(temp, msg...)
-	return temp
+	return append(appendOnewayHead(make([]byte, 0, 5+len(role)+len(event)+len(msg)), role, event), msg...)
 }
 
 func serializeRequest(role, event string, corr correlation, msg []byte) []byte {
-	binRole := []byte(role)
-	binEvent := []byte(event)
-	binCor := serializeCorrelation(corr)
-	temp := []byte{typeRequest}
-	temp = append(temp, int2Bytes(len(binRole))...)
-	temp = append(temp, int2Bytes(len(binEvent))...)
-	temp = append(temp, byte(len(binCor)))
-	temp = append(temp, binRole...)
-	temp = append(temp, binEvent...)
-	temp = append(temp, binCor...)
-	temp = append(temp, msg...)
-	return temp
+	return append(appendRequestHead(make([]byte, 0, 14+len(role)+len(event)+len(msg)), role, event, corr), msg...)
 }
 
 func serializeStreamRequest(t byte, role, event string, corr correlation, channel correlation, msg []byte) []byte {
-	binRole := []byte(role)
-	binEvent := []byte(event)
-	binCor := serializeCorrelation(corr)
-	binChan := serializeCorrelation(channel)
-	temp := []byte{t}
-	temp = append(temp, int2Bytes(len(binRole))...)
-	temp = append(temp, int2Bytes(len(binEvent))...)
-	temp = append(temp, byte(len(binCor)))
-	temp = append(temp, byte(len(binChan)))
-	temp = append(temp, binRole...)
-	temp = append(temp, binEvent...)
-	temp = append(temp, binCor...)
-	temp = append(temp, binChan...)
-	temp = append(temp, msg...)
-	return temp
+	return append(appendStreamRequestHead(make([]byte, 0, 22+len(role)+len(event)+len(msg)), t, role, event, corr, channel), msg...)
 }
 
 func serializeResponse(t byte, corr correlation, msg []byte) []byte {
-	binCor := serializeCorrelation(corr)
-	temp := []byte{t}
-	temp = append(temp, byte(len(binCor)))
-	temp = append(temp, binCor...)
-	temp = append(temp, msg...)
-	return temp
+	return append(appendResponseHead(make([]byte, 0, 10+len(msg)), t, corr), msg...)
 }
 
 func serializeStreamResponse(t byte, corr, channel correlation, msg []byte) []byte {
-	binCor := serializeCorrelation(corr)
-	binChan := serializeCorrelation(channel)
-	temp := []byte{t}
-	temp = append(temp, byte(len(binCor)))
-	temp = append(temp, byte(len(binChan)))
-	temp = append(temp, binCor...)
-	temp = append(temp, binChan...)
-	temp = append(temp, msg...)
-	return temp
-}
-
-func parseOneway(raw []byte) (role, event string, dataType Datatype, rowData []byte) {
-	roleLen := sliceToCorrelation(raw[0:2])
-	eventLen := sliceToCorrelation(raw[2:4])
-	role = string(raw[4 : 4+roleLen])
-	event = string(raw[4+roleLen : 4+roleLen+eventLen])
-	dataType = Datatype(raw[4+roleLen+eventLen])
-	rowData = raw[4+roleLen+eventLen+1:]
-	return
+	return append(appendStreamResponseHead(make([]byte, 0, 19+len(msg)), t, corr, channel), msg...)
 }
 
-func parseRequest(raw []byte) (role, event string, corr correlation, dataType Datatype, rowData []byte) {
-	roleLen := sliceToCorrelation(raw[0:2])
-	eventLen := sliceToCorrelation(raw[2:4])
-	corLen := correlation(raw[4])
-	role = string(raw[5 : 5+roleLen])
-	event = string(raw[5+roleLen : 5+roleLen+eventLen])
-	corr = sliceToCorrelation(raw[5+roleLen+eventLen : 5+roleLen+eventLen+corLen])
-	dataType = Datatype(raw[5+roleLen+eventLen+corLen])
-	rowData = raw[5+roleLen+eventLen+corLen+1:]
-	return
+//appendOnewayHead appends header of one-way message to dst. Data type and payload go after it
+func appendOnewayHead(dst []byte, role, event string) []byte {
+	dst = append(dst, typeMessage)
+	dst = appendUint16(dst, len(role))
+	dst = appendUint16(dst, len(event))
+	dst = append(dst, role...)
+	return append(dst, event...)
 }
 
-func parseStreamRequest(raw []byte) (role, event string, corr, channel correlation, dataType Datatype, rowData []byte) {
-	roleLen := sliceToCorrelation(raw[0:2])
-	eventLen := sliceToCorrelation(raw[2:4])
-	corLen := correlation(raw[4])
-	chanLen := correlation(raw[5])
-	roleFrom := 6
-	eventFrom := roleFrom + int(roleLen)
-	corrFrom := eventFrom + int(eventLen)
-	chanFrom := corrFrom + int(corLen)
-	typePos := chanFrom + int(chanLen)
-	role = string(raw[roleFrom:eventFrom])
-	event = string(raw[eventFrom:corrFrom])
-	corr = sliceToCorrelation(raw[corrFrom:chanFrom])
-	channel = sliceToCorrelation(raw[chanFrom:typePos])
-	dataType = Datatype(raw[typePos])
-	rowData = raw[typePos+1:]
-	return
+func appendRequestHead(dst []byte, role, event string, corr correlation) []byte {
+	dst = append(dst, typeRequest)
+	dst = appendUint16(dst, len(role))
+	dst = appendUint16(dst, len(event))
+	dst = append(dst, byte(correlationLen(corr)))
+	dst = append(dst, role...)
+	dst = append(dst, event...)
+	return appendCorrelation(dst, corr)
 }
 
-func parseResponse(raw []byte) (corr correlation, dataType Datatype, rowData []byte) {
-	corLen := raw[0]
-	corr = sliceToCorrelation(raw[1 : 1+corLen])
-	dataType = Datatype(raw[1+corLen])
-	rowData = raw[2+corLen:]
-	return
+func appendStreamRequestHead(dst []byte, t byte, role, event string, corr, channel correlation) []byte {
+	dst = append(dst, t)
+	dst = appendUint16(dst, len(role))
+	dst = appendUint16(dst, len(event))
+	dst = append(dst, byte(correlationLen(corr)), byte(correlationLen(channel)))
+	dst = append(dst, role...)
+	dst = append(dst, event...)
+	dst = appendCorrelation(dst, corr)
+	return appendCorrelation(dst, channel)
 }
 
-func parseStreamResponse(raw []byte) (corr correlation, channel correlation, dataType Datatype, rowData []byte) {
-	corLen := raw[0]
-	chanLen := raw[1]
-	corr = sliceToCorrelation(raw[2 : 2+corLen])
-	channel = sliceToCorrelation(raw[2+corLen : 2+corLen+chanLen])
-	dataType = Datatype(raw[2+chanLen+chanLen])
-	rowData = raw[3+chanLen+chanLen:]
-	return
+func appendResponseHead(dst []byte, t byte, corr correlation) []byte {
+	dst = append(dst, t, byte(correlationLen(corr)))
+	return appendCorrelation(dst, corr)
+}
+
+func appendStreamResponseHead(dst []byte, t byte, corr, channel correlation) []byte {
+	dst = append(dst, t, byte(correlationLen(corr)), byte(correlationLen(channel)))
+	dst = appendCorrelation(dst, corr)
+	return appendCorrelation(dst, channel)
+}
+
+//FrameError describes malformed frame received from remote peer. Connection is closed with code 4006 (incorrect message structure)
+type FrameError struct {
+	Type   byte   //Type is the first byte of the frame
+	Field  string //Field is the part of the frame which does not fit
+	Offset int    //Offset of the field in the frame, not counting the type byte
+	Size   int    //Size of the frame, not counting the type byte
+}
+
+func (e *FrameError) Error() string {
+	return fmt.Sprintf("malformed frame of type %v: %v at offset %v does not fit frame of %v bytes", e.Type, e.Field, e.Offset, e.Size)
+}
+
+//frameReader reads fields of a frame checking bounds. After the first error all reads return zero values and err keeps the error
+type frameReader struct {
+	raw []byte
+	pos int
+	way byte
+	err error
+}
+
+func (r *frameReader) fail(field string) {
+	if r.err == nil {
+		r.err = &FrameError{Type: r.way, Field: field, Offset: r.pos, Size: len(r.raw)}
+	}
+}
+
+func (r *frameReader) take(n int, field string) []byte {
+	if r.err != nil {
+		return nil
+	}
+	if n < 0 || len(r.raw)-r.pos < n {
+		r.fail(field)
+		return nil
+	}
+	b := r.raw[r.pos : r.pos+n]
+	r.pos += n
+	return b
+}
+
+func (r *frameReader) byte(field string) byte {
+	if b := r.take(1, field); b != nil {
+		return b[0]
+	}
+	return 0
+}
+
+func (r *frameReader) uint16(field string) int {
+	if b := r.take(2, field); b != nil {
+		return int(b[0])<<8 | int(b[1])
+	}
+	return 0
+}
+
+//corrLen reads length of a correlation, which is 1 to 7 bytes
+func (r *frameReader) corrLen(field string) int {
+	n := int(r.byte(field))
+	if r.err == nil && (n < 1 || n > maxCorrelationLen) {
+		r.pos--
+		r.fail(field)
+	}
+	return n
+}
+
+func (r *frameReader) correlation(n int, field string) correlation {
+	b := r.take(n, field)
+	c := sliceToCorrelation(b)
+	if c > maxCorrelation {
+		r.pos -= n
+		r.fail(field)
+		return 0
+	}
+	return c
+}
+
+//payload reads data type and the rest of the frame
+func (r *frameReader) payload() (Datatype, []byte) {
+	t := Datatype(r.byte("data type"))
+	if r.err != nil {
+		return 0, nil
+	}
+	data := r.raw[r.pos:]
+	r.pos = len(r.raw)
+	return t, data
+}
+
+func parseOneway(raw []byte) (role, event string, dataType Datatype, rowData []byte, err error) {
+	r := frameReader{raw: raw, way: typeMessage}
+	roleLen := r.uint16("role length")
+	eventLen := r.uint16("event length")
+	role = string(r.take(roleLen, "role"))
+	event = string(r.take(eventLen, "event"))
+	dataType, rowData = r.payload()
+	return role, event, dataType, rowData, r.err
+}
+
+func parseRequest(raw []byte) (role, event string, corr correlation, dataType Datatype, rowData []byte, err error) {
+	r := frameReader{raw: raw, way: typeRequest}
+	roleLen := r.uint16("role length")
+	eventLen := r.uint16("event length")
+	corLen := r.corrLen("correlation length")
+	role = string(r.take(roleLen, "role"))
+	event = string(r.take(eventLen, "event"))
+	corr = r.correlation(corLen, "correlation")
+	dataType, rowData = r.payload()
+	return role, event, corr, dataType, rowData, r.err
+}
+
+func parseStreamRequest(way byte, raw []byte) (role, event string, corr, channel correlation, dataType Datatype, rowData []byte, err error) {
+	r := frameReader{raw: raw, way: way}
+	roleLen := r.uint16("role length")
+	eventLen := r.uint16("event length")
+	corLen := r.corrLen("correlation length")
+	chanLen := r.corrLen("channel length")
+	role = string(r.take(roleLen, "role"))
+	event = string(r.take(eventLen, "event"))
+	corr = r.correlation(corLen, "correlation")
+	channel = r.correlation(chanLen, "channel")
+	dataType, rowData = r.payload()
+	return role, event, corr, channel, dataType, rowData, r.err
+}
+
+func parseResponse(way byte, raw []byte) (corr correlation, dataType Datatype, rowData []byte, err error) {
+	r := frameReader{raw: raw, way: way}
+	corLen := r.corrLen("correlation length")
+	corr = r.correlation(corLen, "correlation")
+	dataType, rowData = r.payload()
+	return corr, dataType, rowData, r.err
+}
+
+func parseStreamResponse(way byte, raw []byte) (corr correlation, channel correlation, dataType Datatype, rowData []byte, err error) {
+	r := frameReader{raw: raw, way: way}
+	corLen := r.corrLen("correlation length")
+	chanLen := r.corrLen("channel length")
+	corr = r.correlation(corLen, "correlation")
+	channel = r.correlation(chanLen, "channel")
+	dataType, rowData = r.payload()
+	return corr, channel, dataType, rowData, r.err
+}
+
+//readStreamHead reads channel and control byte of stream data frame following its type byte. buf should have capacity of maxCorrelationLen
+func readStreamHead(reader io.Reader, buf []byte) (channel correlation, flag byte, err error) {
+	if _, err = io.ReadFull(reader, buf[:1]); err != nil {
+		return 0, 0, streamHeadError(err, "channel length", 0)
+	}
+	chanLen := int(buf[0])
+	if chanLen < 1 || chanLen > maxCorrelationLen {
+		return 0, 0, &FrameError{Type: typeStreamData, Field: "channel length", Offset: 0, Size: 1}
+	}
+	if _, err = io.ReadFull(reader, buf[:chanLen]); err != nil {
+		return 0, 0, streamHeadError(err, "channel", 1)
+	}
+	if channel = sliceToCorrelation(buf[:chanLen]); channel > maxCorrelation {
+		return 0, 0, &FrameError{Type: typeStreamData, Field: "channel", Offset: 1, Size: 1 + chanLen}
+	}
+	if _, err = io.ReadFull(reader, buf[:1]); err != nil {
+		return 0, 0, streamHeadError(err, "stream control byte", 1+chanLen)
+	}
+	return channel, buf[0], nil
+}
+
+//streamHeadError turns end of frame into FrameError. Other errors are errors of the connection
+func streamHeadError(err error, field string, offset int) error {
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return &FrameError{Type: typeStreamData, Field: field, Offset: offset, Size: offset}
+	}
+	return err
 }
 
 func parseRoles(raw []byte) (roles rolesMsg, err error) {
@@ -147,75 +252,67 @@ func parseRoles(raw []byte) (roles rolesMsg, err error) {
 }
 
 func markDataType(data interface{}) (result []byte, err error) {
+	t, body, err := encodeData(data)
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte{byte(t)}, body...), nil
+}
+
+var (
+	bodyFalse = []byte{0}
+	bodyTrue  = []byte{1}
+)
+
+//encodeData converts data to payload of its Datatype. []byte data is returned as is, without copying
+func encodeData(data interface{}) (t Datatype, body []byte, err error) {
 	switch d := data.(type) {
 	case []byte:
-		result = append([]byte{0}, d...)
-		return
+		return DatatypeBinary, d, nil
 	case nil:
-		result = []byte{1}
-		return
+		return DatatypeNull, nil, nil
 	case bool:
 		if d == false {
-			result = []byte{2, 0}
-		} else {
-			result = []byte{2, 1}
+			return DatatypeBool, bodyFalse, nil
 		}
-		return
+		return DatatypeBool, bodyTrue, nil
 	case string:
-		result = append([]byte{3}, []byte(d)...)
-		return
+		return DatatypeString, []byte(d), nil
 	case float32:
-		result = append([]byte{4}, strings.TrimRight(fmt.Sprintf("%.10f", d), "0")...)
-		return
+		return DatatypeNumber, []byte(strings.TrimRight(fmt.Sprintf("%.10f", d), "0")), nil
 	case float64:
-		result = append([]byte{4}, strings.TrimRight(fmt.Sprintf("%.10f", d), "0")...)
-		return
+		return DatatypeNumber, []byte(strings.TrimRight(fmt.Sprintf("%.10f", d), "0")), nil
 	case int8:
-		result = append([]byte{4}, fmt.Sprintf("%d", d)...)
-		return
+		return DatatypeNumber, strconv.AppendInt(nil, int64(d), 10), nil
 	case int16:
-		result = append([]byte{4}, fmt.Sprintf("%d", d)...)
-		return
+		return DatatypeNumber, strconv.AppendInt(nil, int64(d), 10), nil
 	case int32:
-		result = append([]byte{4}, fmt.Sprintf("%d", d)...)
-		return
+		return DatatypeNumber, strconv.AppendInt(nil, int64(d), 10), nil
 	case int64:
-		result = append([]byte{4}, fmt.Sprintf("%d", d)...)
-		return
+		return DatatypeNumber, strconv.AppendInt(nil, d, 10), nil
 	case int:
-		result = append([]byte{4}, fmt.Sprintf("%d", d)...)
-		return
+		return DatatypeNumber, strconv.AppendInt(nil, int64(d), 10), nil
 	case uint8:
-		result = append([]byte{4}, fmt.Sprintf("%d", d)...)
-		return
+		return DatatypeNumber, strconv.AppendUint(nil, uint64(d), 10), nil
 	case uint16:
-		result = append([]byte{4}, fmt.Sprintf("%d", d)...)
-		return
+		return DatatypeNumber, strconv.AppendUint(nil, uint64(d), 10), nil
 	case uint32:
-		result = append([]byte{4}, fmt.Sprintf("%d", d)...)
-		return
+		return DatatypeNumber, strconv.AppendUint(nil, uint64(d), 10), nil
 	case uint64:
-		result = append([]byte{4}, fmt.Sprintf("%d", d)...)
-		return
+		return DatatypeNumber, strconv.AppendUint(nil, d, 10), nil
 	case uint:
-		result = append([]byte{4}, fmt.Sprintf("%d", d)...)
-		return
+		return DatatypeNumber, strconv.AppendUint(nil, uint64(d), 10), nil
 	case uintptr:
-		result = append([]byte{4}, fmt.Sprintf("%d", d)...)
-		return
+		return DatatypeNumber, strconv.AppendUint(nil, uint64(d), 10), nil
 	case complex64:
-		result = append([]byte{3}, fmt.Sprintf("%.10f", d)...)
-		return
+		return DatatypeString, []byte(fmt.Sprintf("%.10f", d)), nil
 	case complex128:
-		result = append([]byte{3}, fmt.Sprintf("%.10f", d)...)
-		return
+		return DatatypeString, []byte(fmt.Sprintf("%.10f", d)), nil
+	case error:
+		return DatatypeString, []byte(d.Error()), nil
 	default:
-		if jsoned, e := json.Marshal(d); e != nil {
-			err = e
-		} else {
-			result = append([]byte{5}, jsoned...)
-		}
-		return
+		body, err = json.Marshal(d)
+		return DatatypeJSON, body, err
 	}
 }
 
@@ -226,6 +323,9 @@ func retrieveDataByType(t Datatype, raw []byte) (data interface{}, err error) {
 	case DatatypeNull:
 		data = nil
 	case DatatypeBool:
+		if len(raw) == 0 {
+			return nil, errors.New("Empty bool data")
+		}
 		if raw[0] == 0 {
 			data = false
 			break
@@ -250,50 +350,48 @@ func int2Bytes(len int) []byte {
 	return result
 }
 
-func serializeCorrelation(value correlation) []byte {
-	result := []byte{byte(value % 256)}
-	for i := 1; correlation(math.Pow(256, float64(i))) <= correlation(value); i++ {
-		result = append(result, byte(float64(value)/math.Pow(256, float64(i))))
+func appendUint16(dst []byte, n int) []byte {
+	return append(dst, byte(n>>8), byte(n))
+}
+
+//correlationLen returns number of bytes of minimal big-endian representation of c
+func correlationLen(c correlation) int {
+	n := 1
+	for c >>= 8; c > 0; c >>= 8 {
+		n++
 	}
-	if len := len(result); len > 1 {
-		result1 := make([]byte, len)
-		for i, val := range result {
-			result1[len-1-i] = val
-		}
-		result = result1
+	return n
+}
+
+//appendCorrelation appends minimal big-endian representation of c. It is wire format of correlations, channels and quotas, same as in roletalk-js
+func appendCorrelation(dst []byte, c correlation) []byte {
+	for i := correlationLen(c) - 1; i >= 0; i-- {
+		dst = append(dst, byte(c>>(8*uint(i))))
 	}
-	return result
+	return dst
+}
+
+func serializeCorrelation(value correlation) []byte {
+	return appendCorrelation(make([]byte, 0, correlationLen(value)), value)
 }
 
+//serializeInt encodes non-negative value the same way as correlation
 func serializeInt(value int) []byte {
-	result := []byte{byte(value % 256)}
-	for i := 1; int(math.Pow(256, float64(i))) <= value; i++ {
-		result = append(result, byte(float64(value)/math.Pow(256, float64(i))))
-	}
-	if len := len(result); len > 1 {
-		result1 := make([]byte, len)
-		for i, val := range result {
-			result1[len-1-i] = val
-		}
-		result = result1
-	}
-	return result
+	return serializeCorrelation(correlation(value))
 }
 
 func sliceToCorrelation(sl []byte) correlation {
 	var res correlation
-	len := len(sl)
-	for i, b := range sl {
-		res += correlation(b) * correlation(math.Pow(256, float64(len-1-i)))
+	for _, b := range sl {
+		res = res<<8 | correlation(b)
 	}
 	return res
 }
 
 func sliceToInt(sl []byte) int {
 	var res int
-	len := len(sl)
-	for i, b := range sl {
-		res += int(b) * int(math.Pow(256, float64(len-1-i)))
+	for _, b := range sl {
+		res = res<<8 | int(b)
 	}
 	return res
 }
@@ -0,0 +1,147 @@
+//go:build go1.18
+
+package roletalk
+
+import (
+	"bytes"
+	"testing"
+)
+
+func FuzzCorrelation(f *testing.F) {
+	for _, v := range []uint64{0, 255, 256, 65535, legacyExact - 1, 1 << 40, uint64(maxCorrelation)} {
+		f.Add(v)
+	}
+	f.Fuzz(func(t *testing.T, v uint64) {
+		c := correlation(v % uint64(maxCorrelation+1))
+		b := serializeCorrelation(c)
+		for i := range b {
+			if b[i] != byte(c>>(8*uint(len(b)-1-i))) {
+				t.Fatalf("encoding of %v is not big-endian: %v", c, b)
+			}
+		}
+		if len(b) > 1 && b[0] == 0 {
+			t.Fatalf("not minimal encoding of %v: %v", c, b)
+		}
+		if legacy := legacySerializeCorrelation(c); c < legacyExact && bytes.Equal(b, legacy) == false {
+			t.Fatalf("encoding of %v differs from wire format: %v, expected %v", c, b, legacy)
+		}
+		if got := sliceToCorrelation(b); got != c {
+			t.Fatalf("round trip of %v returned %v", c, got)
+		}
+		if got := sliceToInt(serializeInt(int(c))); got != int(c) {
+			t.Fatalf("int round trip of %v returned %v", c, got)
+		}
+	})
+}
+
+func FuzzSliceToCorrelation(f *testing.F) {
+	f.Add([]byte{0})
+	f.Add([]byte{1, 0})
+	f.Add([]byte{0, 0, 7})
+	f.Add([]byte{0x1f, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff})
+	f.Fuzz(func(t *testing.T, b []byte) {
+		if len(b) == 0 || len(b) > 7 {
+			return
+		}
+		c := sliceToCorrelation(b)
+		var expected correlation
+		for i, v := range b {
+			expected += correlation(v) << (8 * uint(len(b)-1-i))
+		}
+		if c != expected || sliceToInt(b) != int(expected) {
+			t.Fatalf("%v decoded as %v, expected %v", b, c, expected)
+		}
+		trimmed := bytes.TrimLeft(b, "\x00")
+		if len(trimmed) == 0 {
+			trimmed = []byte{0}
+		}
+		if encoded := serializeCorrelation(c); bytes.Equal(encoded, trimmed) == false {
+			t.Fatalf("%v re-encoded as %v", b, encoded)
+		}
+	})
+}
+
+func FuzzParseOneway(f *testing.F) {
+	f.Add(serializeOneway("role", "event", []byte{3, 100})[1:])
+	f.Fuzz(func(t *testing.T, raw []byte) {
+		role, event, dt, data, err := parseOneway(raw)
+		if err != nil {
+			return
+		}
+		again := serializeOneway(role, event, append([]byte{byte(dt)}, data...))[1:]
+		if bytes.Equal(again, raw) == false {
+			t.Fatalf("%v re-serialized as %v", raw, again)
+		}
+	})
+}
+
+func FuzzParseRequest(f *testing.F) {
+	f.Add(serializeRequest("role", "event", 300, []byte{3, 100})[1:])
+	f.Fuzz(func(t *testing.T, raw []byte) {
+		role, event, corr, dt, data, err := parseRequest(raw)
+		if err != nil {
+			return
+		}
+		role1, event1, corr1, dt1, data1, err := parseRequest(serializeRequest(role, event, corr, append([]byte{byte(dt)}, data...))[1:])
+		if err != nil || role1 != role || event1 != event || corr1 != corr || dt1 != dt || bytes.Equal(data1, data) == false {
+			t.Fatalf("round trip of %v failed: %v", raw, err)
+		}
+	})
+}
+
+func FuzzParseStreamRequest(f *testing.F) {
+	f.Add(serializeStreamRequest(typeReader, "role", "event", 300, 7, []byte{0, 1, 2})[1:])
+	f.Fuzz(func(t *testing.T, raw []byte) {
+		role, event, corr, channel, dt, data, err := parseStreamRequest(typeReader, raw)
+		if err != nil {
+			return
+		}
+		role1, event1, corr1, channel1, dt1, data1, err := parseStreamRequest(typeReader, serializeStreamRequest(typeReader, role, event, corr, channel, append([]byte{byte(dt)}, data...))[1:])
+		if err != nil || role1 != role || event1 != event || corr1 != corr || channel1 != channel || dt1 != dt || bytes.Equal(data1, data) == false {
+			t.Fatalf("round trip of %v failed: %v", raw, err)
+		}
+	})
+}
+
+func FuzzParseResponse(f *testing.F) {
+	f.Add(serializeResponse(typeResolve, 300, []byte{1})[1:])
+	f.Fuzz(func(t *testing.T, raw []byte) {
+		corr, dt, data, err := parseResponse(typeResolve, raw)
+		if err != nil {
+			return
+		}
+		corr1, dt1, data1, err := parseResponse(typeResolve, serializeResponse(typeResolve, corr, append([]byte{byte(dt)}, data...))[1:])
+		if err != nil || corr1 != corr || dt1 != dt || bytes.Equal(data1, data) == false {
+			t.Fatalf("round trip of %v failed: %v", raw, err)
+		}
+	})
+}
+
+func FuzzParseStreamResponse(f *testing.F) {
+	f.Add(serializeStreamResponse(typeStreamResolve, 300, 70000, []byte{1})[1:])
+	f.Fuzz(func(t *testing.T, raw []byte) {
+		corr, channel, dt, data, err := parseStreamResponse(typeStreamResolve, raw)
+		if err != nil {
+			return
+		}
+		corr1, channel1, dt1, data1, err := parseStreamResponse(typeStreamResolve, serializeStreamResponse(typeStreamResolve, corr, channel, append([]byte{byte(dt)}, data...))[1:])
+		if err != nil || corr1 != corr || channel1 != channel || dt1 != dt || bytes.Equal(data1, data) == false {
+			t.Fatalf("round trip of %v failed: %v", raw, err)
+		}
+	})
+}
+
+func FuzzReadStreamHead(f *testing.F) {
+	f.Add(createStreamPrefix(300, streamByteChunk)[1:])
+	f.Fuzz(func(t *testing.T, raw []byte) {
+		buf := make([]byte, maxCorrelationLen)
+		channel, flag, err := readStreamHead(bytes.NewReader(raw), buf)
+		if err != nil {
+			return
+		}
+		chanLen := int(raw[0])
+		if channel != sliceToCorrelation(raw[1:1+chanLen]) || flag != raw[1+chanLen] {
+			t.Fatalf("%v read as channel %v flag %v", raw, channel, flag)
+		}
+	})
+}
@@ -1,7 +1,9 @@
 package roletalk
 
 import (
+	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"math"
 	"reflect"
@@ -17,7 +19,7 @@ func TestBinaryConversion(t *testing.T) {
 	t.Run("Serialize INT to 2 bytes", testInt2Bytes)
 	t.Run("Parse slice to int", testsliceToCorrelation)
 	t.Run("Serialize one-way message", testSerializeOneWay)
-	t.Run("parse one-way message", testSerializeOneWay)
+	t.Run("parse one-way message", testParseOneWay)
 	t.Run("Serialize request message", testSerializeRequest)
 	t.Run("Serialize stream request message", testSerializeStreamRequest)
 	t.Run("parse request message", testParseRequest)
@@ -111,7 +113,8 @@ func testParseOneWay(t *testing.T) {
 	if err != nil {
 		t.Error(err)
 	}
-	role, event, tp, payload := parseOneway([]byte{0, 4, 0, 5, 114, 111, 108, 101, 101, 118, 101, 110, 116, 3, 100, 97, 116, 97})
+	role, event, tp, payload, err := parseOneway([]byte{0, 4, 0, 5, 114, 111, 108, 101, 101, 118, 101, 110, 116, 3, 100, 97, 116, 97})
+	assert.NilError(t, err)
 	assert.Assert(t, reflect.DeepEqual(payload, data[1:]))
 	assert.Equal(t, role, "role")
 	assert.Equal(t, event, "event")
@@ -123,7 +126,8 @@ func testParseRequest(t *testing.T) {
 	if err != nil {
 		t.Error(err)
 	}
-	role, event, cor, tp, payload := parseRequest([]byte{0, 4, 0, 5, 1, 114, 111, 108, 101, 101, 118, 101, 110, 116, 77, 3, 100, 97, 116, 97})
+	role, event, cor, tp, payload, err := parseRequest([]byte{0, 4, 0, 5, 1, 114, 111, 108, 101, 101, 118, 101, 110, 116, 77, 3, 100, 97, 116, 97})
+	assert.NilError(t, err)
 	assert.Assert(t, reflect.DeepEqual(payload, data[1:]))
 	assert.Equal(t, role, "role")
 	assert.Equal(t, event, "event")
@@ -136,7 +140,8 @@ func testParseStreamRequest(t *testing.T) {
 	if err != nil {
 		t.Error(err)
 	}
-	role, event, cor, channel, tp, payload := parseStreamRequest([]byte{0, 4, 0, 5, 1, 1, 114, 111, 108, 101, 101, 118, 101, 110, 116, 77, 88, 3, 100, 97, 116, 97})
+	role, event, cor, channel, tp, payload, err := parseStreamRequest(typeReader, []byte{0, 4, 0, 5, 1, 1, 114, 111, 108, 101, 101, 118, 101, 110, 116, 77, 88, 3, 100, 97, 116, 97})
+	assert.NilError(t, err)
 	assert.Assert(t, reflect.DeepEqual(payload, data[1:]))
 	assert.Equal(t, role, "role")
 	assert.Equal(t, event, "event")
@@ -150,7 +155,8 @@ func testParseResponse(t *testing.T) {
 	if err != nil {
 		t.Error(err)
 	}
-	cor, tp, payload := parseResponse([]byte{1, 77, 3, 100, 97, 116, 97})
+	cor, tp, payload, err := parseResponse(typeResolve, []byte{1, 77, 3, 100, 97, 116, 97})
+	assert.NilError(t, err)
 	assert.Assert(t, reflect.DeepEqual(payload, data[1:]))
 	assert.Equal(t, cor, correlation(77))
 	assert.Equal(t, tp, DatatypeString)
@@ -161,7 +167,8 @@ func testParseStreamResponse(t *testing.T) {
 	if err != nil {
 		t.Error(err)
 	}
-	cor, channel, tp, payload := parseStreamResponse([]byte{1, 1, 77, 88, 3, 100, 97, 116, 97})
+	cor, channel, tp, payload, err := parseStreamResponse(typeStreamResolve, []byte{1, 1, 77, 88, 3, 100, 97, 116, 97})
+	assert.NilError(t, err)
 	assert.Assert(t, reflect.DeepEqual(payload, data[1:]))
 	assert.Equal(t, cor, correlation(77))
 	assert.Equal(t, channel, correlation(88))
@@ -170,6 +177,7 @@ func testParseStreamResponse(t *testing.T) {
 
 func testGenerateChallengeWithIds(t *testing.T) {
 	peer := NewPeer(PeerOptions{})
+	defer peer.Close()
 	peer.AddKey("some_id", "some_key")
 	result, challenge, _ := peer.generateChallengeWithIds()
 	expected := `{"challenge":"` + challenge + `","ids":["some_id"]}`
@@ -245,3 +253,112 @@ func testSemverCompatibility(t *testing.T) {
 	assert.ErrorContains(t, checkProtocolCompatibility("", "2.9.4"), errCantParseLocal)
 	assert.ErrorContains(t, checkProtocolCompatibility("13", "2.9.4"), errCantParseLocal)
 }
+
+func TestFrameMatchesSerialized(t *testing.T) {
+	data, err := markDataType("data")
+	assert.NilError(t, err)
+	dt, body, err := encodeData("data")
+	assert.NilError(t, err)
+	join := func(f frame) []byte {
+		defer f.release()
+		return append(append([]byte{}, f.head...), f.body...)
+	}
+	corr := correlation(1<<40 + 7)
+	assert.DeepEqual(t, join(onewayFrame("role", "event", dt, body)), serializeOneway("role", "event", data))
+	assert.DeepEqual(t, join(requestFrame("role", "event", corr, dt, body)), serializeRequest("role", "event", corr, data))
+	assert.DeepEqual(t, join(streamRequestFrame(typeWriter, "role", "event", corr, 300, dt, body)), serializeStreamRequest(typeWriter, "role", "event", corr, 300, data))
+	assert.DeepEqual(t, join(responseFrame(typeResolve, corr, dt, body)), serializeResponse(typeResolve, corr, data))
+	assert.DeepEqual(t, join(streamResponseFrame(typeStreamReject, corr, 0, dt, body)), serializeStreamResponse(typeStreamReject, corr, 0, data))
+}
+
+//legacySerializeCorrelation is the former float-based encoder. It produces the wire format for values below legacyExact,
+//above that float to byte conversions of fractional values overflow
+func legacySerializeCorrelation(value correlation) []byte {
+	result := []byte{byte(value % 256)}
+	for i := 1; correlation(math.Pow(256, float64(i))) <= correlation(value); i++ {
+		result = append(result, byte(float64(value)/math.Pow(256, float64(i))))
+	}
+	for i, j := 0, len(result)-1; i < j; i, j = i+1, j-1 {
+		result[i], result[j] = result[j], result[i]
+	}
+	return result
+}
+
+const legacyExact = 1 << 31
+
+func TestCorrelationBounds(t *testing.T) {
+	for _, c := range []correlation{0, 1, 255, 256, 1<<16 - 1, 1 << 16, 1<<32 - 1, 1 << 32, 1<<48 + 1, maxCorrelation - 1, maxCorrelation} {
+		b := serializeCorrelation(c)
+		if c < legacyExact {
+			assert.DeepEqual(t, b, legacySerializeCorrelation(c))
+		}
+		assert.Equal(t, len(b), correlationLen(c))
+		assert.Equal(t, sliceToCorrelation(b), c)
+	}
+	assert.DeepEqual(t, serializeCorrelation(maxCorrelation), []byte{0x1f, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff})
+	assert.DeepEqual(t, serializeInt(defQuotaSizeBytes), []byte{0x40, 0})
+}
+
+func TestParseMalformed(t *testing.T) {
+	frames := []struct {
+		descr string
+		parse func() error
+		field string
+	}{
+		{"role longer than frame", func() error {
+			_, _, _, _, err := parseOneway([]byte{0, 40, 0, 5, 114, 111, 108, 101})
+			return err
+		}, "role"},
+		{"no data type", func() error {
+			_, _, _, _, err := parseOneway([]byte{0, 1, 0, 1, 114, 101})
+			return err
+		}, "data type"},
+		{"empty request", func() error {
+			_, _, _, _, _, err := parseRequest(nil)
+			return err
+		}, "role length"},
+		{"zero correlation length", func() error {
+			_, _, _, _, _, err := parseRequest([]byte{0, 1, 0, 1, 0, 114, 101, 3})
+			return err
+		}, "correlation length"},
+		{"correlation above max", func() error {
+			_, _, _, err := parseResponse(typeResolve, []byte{7, 0x20, 0, 0, 0, 0, 0, 0, 3})
+			return err
+		}, "correlation"},
+		{"channel length above max", func() error {
+			_, _, _, _, _, _, err := parseStreamRequest(typeWriter, []byte{0, 1, 0, 1, 1, 8, 114, 101, 1, 2, 3})
+			return err
+		}, "channel length"},
+		{"truncated channel", func() error {
+			_, _, _, _, err := parseStreamResponse(typeStreamResolve, []byte{1, 3, 77, 1})
+			return err
+		}, "channel"},
+	}
+	for _, f := range frames {
+		err := f.parse()
+		frameErr := &FrameError{}
+		assert.Assert(t, errors.As(err, &frameErr), f.descr)
+		assert.Equal(t, frameErr.Field, f.field, f.descr)
+	}
+
+	//correlation and channel of different lengths
+	cor, channel, tp, payload, err := parseStreamResponse(typeStreamResolve, []byte{1, 3, 77, 1, 0, 88, 3, 100})
+	assert.NilError(t, err)
+	assert.Equal(t, cor, correlation(77))
+	assert.Equal(t, channel, correlation(65536+88))
+	assert.Equal(t, tp, DatatypeString)
+	assert.DeepEqual(t, payload, []byte{100})
+}
+
+func TestReadStreamHead(t *testing.T) {
+	buf := make([]byte, maxCorrelationLen)
+	channel, flag, err := readStreamHead(bytes.NewReader([]byte{2, 1, 0, streamByteQuota, 64, 0}), buf)
+	assert.NilError(t, err)
+	assert.Equal(t, channel, correlation(256))
+	assert.Equal(t, flag, streamByteQuota)
+	for _, raw := range [][]byte{{}, {0}, {8, 1, 2, 3, 4, 5, 6, 7, 8, 0}, {2, 1}, {1, 5}} {
+		_, _, err = readStreamHead(bytes.NewReader(raw), buf)
+		frameErr := &FrameError{}
+		assert.Assert(t, errors.As(err, &frameErr), raw)
+	}
+}
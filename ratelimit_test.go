@@ -0,0 +1,93 @@
+package roletalk
+
+import (
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"gotest.tools/assert"
+)
+
+type rateCollector struct {
+	nopCollector
+	limited int32
+}
+
+func (c *rateCollector) RateLimited(role, event string) {
+	atomic.AddInt32(&c.limited, 1)
+}
+
+func TestBucket(t *testing.T) {
+	now := time.Now()
+	b := newBucket(RateLimit{Rate: 10, Burst: 2}, now)
+	assert.Equal(t, b.refill(now), time.Duration(0))
+	b.tokens -= 2
+	assert.Equal(t, b.refill(now), 100*time.Millisecond)
+	assert.Equal(t, b.refill(now.Add(50*time.Millisecond)), 50*time.Millisecond)
+	assert.Equal(t, b.refill(now.Add(time.Hour)), time.Duration(0))
+	assert.Equal(t, b.tokens, float64(2))
+}
+
+func TestRateLimitRequests(t *testing.T) {
+	server := NewPeer(PeerOptions{Name: "rate server"})
+	vip := NewPeer(PeerOptions{Name: "vip"})
+	plain := NewPeer(PeerOptions{Name: "plain"})
+	defer server.Close()
+	defer vip.Close()
+	defer plain.Close()
+	role := server.Role("limited")
+	role.OnRequest("hit", func(ctx *RequestContext) { ctx.Reply(nil) })
+	role.OnRequest("other", func(ctx *RequestContext) { ctx.Reply(nil) })
+	role.SetRateLimits(RateLimits{
+		Events: map[string]RateLimit{"hit": {Rate: 1, Burst: 3}},
+		Unit:   RateLimit{Rate: 1, Burst: 1},
+		Units:  map[string]RateLimit{"vip": {Rate: 1000, Burst: 100}},
+	})
+	addr, err := server.Listen("localhost:0")
+	assert.NilError(t, err)
+	vipUnit, err := vip.Connect("ws://"+addr.String(), ConnectOptions{DoNotReconnect: true})
+	assert.NilError(t, err)
+	plainUnit, err := plain.Connect("ws://"+addr.String(), ConnectOptions{DoNotReconnect: true})
+	assert.NilError(t, err)
+
+	for i := 0; i < 5; i++ {
+		_, err = vip.Destination("limited").Request("other", EmitOptions{Unit: vipUnit})
+		assert.NilError(t, err)
+	}
+	for i := 0; i < 3; i++ {
+		_, err = vip.Destination("limited").Request("hit", EmitOptions{Unit: vipUnit})
+		assert.NilError(t, err)
+	}
+	_, err = vip.Destination("limited").Request("hit", EmitOptions{Unit: vipUnit})
+	limited := &RateLimitedError{}
+	assert.Assert(t, errors.As(err, &limited), err)
+	assert.Assert(t, limited.RetryAfter > 0 && limited.RetryAfter <= time.Second, limited.RetryAfter)
+
+	_, err = plain.Destination("limited").Request("other", EmitOptions{Unit: plainUnit})
+	assert.NilError(t, err)
+	_, _, err = plain.Destination("limited").NewReader("other", EmitOptions{Unit: plainUnit})
+	assert.Assert(t, errors.As(err, &limited), err)
+}
+
+func TestRateLimitMessages(t *testing.T) {
+	metrics := &rateCollector{}
+	server := NewPeer(PeerOptions{Name: "rate server", Metrics: metrics})
+	client := NewPeer(PeerOptions{Name: "rate client"})
+	defer server.Close()
+	defer client.Close()
+	var handled int32
+	role := server.Role("limited")
+	role.OnMessage("hit", func(ctx *MessageContext) { atomic.AddInt32(&handled, 1) })
+	role.SetRateLimits(RateLimits{Role: RateLimit{Rate: 0.1, Burst: 1}})
+	addr, err := server.Listen("localhost:0")
+	assert.NilError(t, err)
+	unit, err := client.Connect("ws://"+addr.String(), ConnectOptions{DoNotReconnect: true})
+	assert.NilError(t, err)
+
+	for i := 0; i < 3; i++ {
+		assert.NilError(t, client.Destination("limited").Send("hit", EmitOptions{Unit: unit}))
+	}
+	waitFor(t, func() bool { return atomic.LoadInt32(&metrics.limited) == 2 })
+	waitFor(t, func() bool { return atomic.LoadInt32(&handled) == 1 })
+}
@@ -0,0 +1,32 @@
+package roletalk
+
+import (
+	"errors"
+	"testing"
+
+	"gotest.tools/assert"
+)
+
+func TestRejectWithError(t *testing.T) {
+	//error is sent as its message of string type, which peers of all versions decode. Older peers sent empty JSON object instead
+	b, err := markDataType(errors.New("Access denied"))
+	assert.NilError(t, err)
+	assert.DeepEqual(t, b, append([]byte{byte(DatatypeString)}, "Access denied"...))
+	data, err := retrieveDataByType(DatatypeString, b[1:])
+	assert.NilError(t, err)
+	assert.Equal(t, data, "Access denied")
+
+	server := NewPeer(PeerOptions{Name: "reject server"})
+	client := NewPeer(PeerOptions{Name: "reject client"})
+	defer server.Close()
+	defer client.Close()
+	server.Role("reject").OnRequest("error", func(ctx *RequestContext) {
+		ctx.Reject(errors.New("Access denied"))
+	})
+	addr, err := server.Listen("localhost:0")
+	assert.NilError(t, err)
+	_, err = client.Connect("ws://"+addr.String(), ConnectOptions{DoNotReconnect: true})
+	assert.NilError(t, err)
+	_, err = client.Destination("reject").Request("error", EmitOptions{})
+	assert.ErrorContains(t, err, "Access denied")
+}
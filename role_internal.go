@@ -11,9 +11,30 @@ func (peer *Peer) createRole(name string) *Role {
 		mwRequest: createMiddlewareRequestMap(),
 		mwReader:  createMiddlewareReaderMap(),
 		mwWriter:  createMiddlewareWriterMap(),
+		mwDuplex:  createMiddlewareDuplexMap(),
 	}
 }
 
+//setActive changes state of the role and runs its status handlers. Returns true if the state has been changed
+func (role *Role) setActive(active bool) bool {
+	role.stateMutex.Lock()
+	prev := role.active
+	role.active = active
+	role.stateMutex.Unlock()
+	if prev == active {
+		return false
+	}
+	if active == true {
+		role.peer.logger.Info("role enabled", "role", role.name)
+	} else {
+		role.peer.logger.Info("role disabled", "role", role.name)
+	}
+	for _, h := range role.statusHandlers {
+		h()
+	}
+	return true
+}
+
 func (role *Role) emitRequest(ctx *RequestContext) {
 	mwChain := role.mwRequest
 	for _, mw := range mwChain.get("") {
@@ -92,6 +113,32 @@ func (role *Role) emitWriter(ctx *WriterRequestContext) {
 	}
 }
 
+func (role *Role) emitDuplex(ctx *DuplexRequestContext) {
+	mwChain := role.mwDuplex
+	for _, mw := range mwChain.get("") {
+		if ctx.r == true {
+			break
+		}
+		mw(ctx)
+	}
+	for _, mw := range mwChain.get(ctx.event) {
+		if ctx.r == true {
+			break
+		}
+		mw(ctx)
+	}
+	if ctx.r == false {
+		ctx.runCallbacks()
+		if ctx.Err != nil {
+			ctx.Reject(ctx.Err)
+		} else if ctx.Res != nil {
+			ctx.Reply(ctx.Res)
+		} else {
+			ctx.Reject(fmt.Sprintf("Event [%v] is not handled by the peer [%v]", ctx.event, role.peer.id))
+		}
+	}
+}
+
 func (role *Role) emitMsg(im *MessageContext) {
 	mwChain := role.mwMessage
 	for _, mw := range mwChain.get("") {
@@ -18,8 +18,15 @@ type rolesMsg struct {
 	Roles []string `json:"roles"`
 }
 
+//closeConnWithCode sends close frame and closes underlying connection when remote side confirms it, but no later than closeGrace
 func closeConnWithCode(conn *connLocker, code int, message string) error {
-	return conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, message), time.Now().Add(heartBeatTimeout))
+	err := conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, message), time.Now().Add(heartBeatTimeout))
+	if err != nil {
+		conn.close()
+		return err
+	}
+	go conn.closeAfter(closeGrace)
+	return nil
 }
 
 func (unit *Unit) sendRoles(i int, roles []string) error {
@@ -27,7 +34,7 @@ func (unit *Unit) sendRoles(i int, roles []string) error {
 	if err != nil {
 		return err
 	}
-	_, err = unit.writeMsgToSomeConnection(serializeString(typeRoles, string(str)))
+	_, err = unit.writeMsgToSomeConnection(rawFrame(serializeString(typeRoles, string(str))), PriorityControl)
 	return err
 }
 
@@ -45,7 +52,9 @@ func (peer *Peer) introduceUnitToOthers(unit *Unit, addr string) error {
 		if u.friendly == false || u == unit {
 			continue
 		}
-		u.writeMsgToSomeConnection(append([]byte{typeAcquaint}, bin...))
+		if _, err := u.writeMsgToSomeConnection(rawFrame(append([]byte{typeAcquaint}, bin...)), PriorityControl); err != nil {
+			peer.logger.Debug("cannot introduce unit", "unit", u.id, "introduced", unit.id, "error", err)
+		}
 	}
 	return nil
 }
@@ -65,7 +74,9 @@ func (unit *Unit) acquaintWithOthers() error {
 		if err != nil {
 			continue
 		}
-		_, err = unit.writeMsgToSomeConnection(append([]byte{typeAcquaint}, b...))
+		if _, err = unit.writeMsgToSomeConnection(rawFrame(append([]byte{typeAcquaint}, b...)), PriorityControl); err != nil {
+			unit.peer.logger.Debug("cannot acquaint unit with others", "unit", unit.id, "error", err)
+		}
 	}
 	return err
 }
@@ -0,0 +1,114 @@
+package roletalk
+
+import (
+	"context"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+
+	"gotest.tools/assert"
+)
+
+func TestShutdownDrainsRequests(t *testing.T) {
+	started := make(chan struct{})
+	server, client, unit := testPeers(t, PeerOptions{Name: "shutdown server"}, PeerOptions{Name: "shutdown client"}, ConnectOptions{}, func(server *Peer) {
+		server.Role("slow").OnRequest("run", func(ctx *RequestContext) {
+			close(started)
+			time.Sleep(200 * time.Millisecond)
+			ctx.Reply("done")
+		})
+	})
+	sub := client.Subscribe(100)
+	defer sub.Close()
+
+	res := make(chan interface{}, 1)
+	go func() {
+		ctx, err := client.Destination("slow").Request("run", EmitOptions{Unit: unit})
+		if err != nil {
+			res <- err
+			return
+		}
+		res <- ctx.Data
+	}()
+	<-started
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	assert.NilError(t, server.Shutdown(ctx))
+	assert.Equal(t, <-res, "done")
+	waitForEvent(t, sub, EventUnitRemoved)
+	assert.Equal(t, client.Destination("slow").Ready(), false)
+
+	server.WaitForClose()
+	//draining peer does not dial, so address does not matter
+	_, err := server.Connect("ws://localhost:1", ConnectOptions{DoNotReconnect: true})
+	assert.Equal(t, err, errPeerShutdown)
+}
+
+func TestShutdownDrainsStreams(t *testing.T) {
+	server, client, unit := testPeers(t, PeerOptions{Name: "shutdown server"}, PeerOptions{Name: "shutdown client"}, ConnectOptions{}, func(server *Peer) {
+		server.Role("stream").OnWriter("run", func(ctx *WriterRequestContext) {
+			writable, err := ctx.Reply(nil)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			go func() {
+				for i := 0; i < 5; i++ {
+					time.Sleep(40 * time.Millisecond)
+					writable.Write([]byte("chunk"))
+				}
+				writable.Close()
+			}()
+		})
+	})
+
+	_, readable, err := client.Destination("stream").NewReader("run", EmitOptions{Unit: unit})
+	assert.NilError(t, err)
+	read := make(chan []byte, 1)
+	go func() {
+		data, err := ioutil.ReadAll(readable)
+		if err != nil {
+			t.Error(err)
+		}
+		read <- data
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	assert.NilError(t, server.Shutdown(ctx))
+	assert.Equal(t, string(<-read), "chunkchunkchunkchunkchunk")
+}
+
+func TestShutdownDeadline(t *testing.T) {
+	started := make(chan struct{})
+	block := make(chan struct{})
+	defer close(block)
+	server, client, unit := testPeers(t, PeerOptions{Name: "shutdown server"}, PeerOptions{Name: "shutdown client"}, ConnectOptions{}, func(server *Peer) {
+		server.Role("stuck").OnRequest("run", func(ctx *RequestContext) {
+			close(started)
+			<-block
+		})
+	})
+
+	res := make(chan error, 1)
+	go func() {
+		_, err := client.Destination("stuck").Request("run", EmitOptions{Unit: unit})
+		res <- err
+	}()
+	<-started
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	assert.Equal(t, server.Shutdown(ctx), context.DeadlineExceeded)
+	for _, stack := range goroutines() {
+		assert.Assert(t, strings.Contains(stack, "(*Peer).drain") == false, "drain is still running:\n%s", stack)
+	}
+	select {
+	case err := <-res:
+		assert.Assert(t, err != nil)
+	case <-time.After(time.Second):
+		t.Fatal("Request has not failed after the peer was closed")
+	}
+}
@@ -0,0 +1,87 @@
+package roletalk
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"gotest.tools/assert"
+)
+
+func TestJSONTooDeep(t *testing.T) {
+	assert.Assert(t, jsonTooDeep([]byte(`{"a":[1,{"b":2}]}`), 3) == false)
+	assert.Assert(t, jsonTooDeep([]byte(`{"a":[1,{"b":2}]}`), 2) == true)
+	assert.Assert(t, jsonTooDeep([]byte(`{"a":"[[[[\"{{{{"}`), 1) == false)
+	assert.Assert(t, jsonTooDeep([]byte(`[[[]],[[]]]`), 3) == false)
+}
+
+func TestSizeLimitsRequests(t *testing.T) {
+	serverOpts := PeerOptions{Name: "sizes server", Sizes: SizeLimits{MaxName: 8, MaxJSONDepth: 2}}
+	_, client, unit := testPeers(t, serverOpts, PeerOptions{Name: "sizes client"}, ConnectOptions{DoNotReconnect: true}, func(server *Peer) {
+		server.Role("sizes").OnRequest("echo", func(ctx *RequestContext) { ctx.Reply(nil) })
+		server.Role("sizes").OnRequest("very long event", func(ctx *RequestContext) { ctx.Reply(nil) })
+	})
+
+	dest := client.Destination("sizes")
+	_, err := dest.Request("echo", EmitOptions{Data: map[string]interface{}{"a": []int{1}}})
+	assert.NilError(t, err)
+	_, err = dest.Request("very long event", EmitOptions{})
+	assert.ErrorContains(t, err, errStrTooLarge)
+	_, err = dest.Request("echo", EmitOptions{Data: map[string]interface{}{"a": [][]int{{1}}}})
+	assert.ErrorContains(t, err, errStrTooLarge)
+	assert.Assert(t, unit.Connected())
+}
+
+func TestSizeLimitsMessages(t *testing.T) {
+	server := NewPeer(PeerOptions{Name: "sizes server", Sizes: SizeLimits{MaxMessage: 1024, MaxName: 8}})
+	dropping := NewPeer(PeerOptions{Name: "dropping server", Sizes: SizeLimits{MaxName: 8, DropOversize: true}})
+	client := NewPeer(PeerOptions{Name: "sizes client"})
+	defer server.Close()
+	defer dropping.Close()
+	defer client.Close()
+	connect := func(peer *Peer) *Unit {
+		addr, err := peer.Listen("localhost:0")
+		assert.NilError(t, err)
+		unit, err := client.Connect("ws://"+addr.String(), ConnectOptions{DoNotReconnect: true})
+		assert.NilError(t, err)
+		return unit
+	}
+
+	//oversize names are dropped by DropOversize policy
+	unit := connect(dropping)
+	assert.NilError(t, client.Destination("sizes").Send(strings.Repeat("e", 9), EmitOptions{Unit: unit}))
+	_, err := client.Destination("sizes").Request("missing", EmitOptions{Unit: unit})
+	assert.ErrorContains(t, err, "No such role")
+
+	//otherwise they close the connection
+	unit = connect(server)
+	assert.NilError(t, client.Destination("sizes").Send(strings.Repeat("e", 9), EmitOptions{Unit: unit}))
+	waitFor(t, func() bool { return unit.Connected() == false })
+
+	//messages over MaxMessage are not read
+	unit = connect(server)
+	assert.NilError(t, client.Destination("sizes").Send("event", EmitOptions{Unit: unit, Data: bytes.Repeat([]byte{1}, 2048)}))
+	waitFor(t, func() bool { return unit.Connected() == false })
+}
+
+func TestSizeLimitsStreamBuffer(t *testing.T) {
+	readers := make(chan *Readable, 1)
+	serverOpts := PeerOptions{Name: "sizes server", Sizes: SizeLimits{MaxStreamBuffer: 1}}
+	server, client, unit := testPeers(t, serverOpts, PeerOptions{Name: "sizes client"}, ConnectOptions{DoNotReconnect: true}, func(server *Peer) {
+		server.Role("sizes").OnReader("upload", func(ctx *ReaderRequestContext) {
+			r, _ := ctx.Reply(nil)
+			readers <- r
+		})
+	})
+	assert.Equal(t, server.sizeLimits.MaxStreamBuffer, defQuotaSizeBytes)
+	_, w, err := client.Destination("sizes").NewWriter("upload", EmitOptions{Unit: unit})
+	assert.NilError(t, err)
+	<-readers
+
+	//writer ignoring quota overflows the buffer of the stream
+	chunk := append(append([]byte{}, w.pref...), make([]byte, defQuotaSizeBytes)...)
+	for i := 0; i < 2; i++ {
+		w.streamChannel.getConn().writeFrame(rawFrame(chunk), PriorityNormal)
+	}
+	waitFor(t, func() bool { return unit.Connected() == false })
+}
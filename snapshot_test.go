@@ -0,0 +1,59 @@
+package roletalk
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"gotest.tools/assert"
+)
+
+func TestSnapshot(t *testing.T) {
+	server := NewPeer(PeerOptions{Name: "snapshot server"})
+	client := NewPeer(PeerOptions{Name: "snapshot client"})
+	defer server.Close()
+	defer client.Close()
+
+	release := make(chan interface{})
+	server.Role("snapshot").OnRequest("hang", func(ctx *RequestContext) {
+		<-release
+		ctx.Reply(nil)
+	})
+	addr, err := server.Listen("localhost:0")
+	assert.NilError(t, err)
+	unit, err := client.Connect("ws://"+addr.String(), ConnectOptions{DoNotReconnect: true})
+	assert.NilError(t, err)
+	defer unit.Close()
+
+	done := make(chan error)
+	go func() {
+		_, err := client.Destination("snapshot").Request("hang", EmitOptions{})
+		done <- err
+	}()
+	time.Sleep(time.Millisecond * 10)
+
+	snap := client.Snapshot()
+	assert.Equal(t, snap.ID, client.ID())
+	assert.Equal(t, len(snap.Units), 1)
+	assert.Equal(t, snap.Units[0].ID, server.ID())
+	assert.DeepEqual(t, snap.Units[0].Roles, []string{"snapshot"})
+	assert.Equal(t, len(snap.Units[0].Connections), 1)
+	assert.Equal(t, len(snap.Units[0].Requests), 1)
+	assert.Equal(t, len(snap.Destinations), 1)
+	assert.DeepEqual(t, snap.Destinations[0].Units, []string{server.ID()})
+
+	serverSnap := server.Snapshot()
+	assert.Equal(t, len(serverSnap.Roles), 1)
+	assert.DeepEqual(t, serverSnap.Roles[0].RequestEvents, []string{"hang"})
+
+	rec := httptest.NewRecorder()
+	client.SnapshotHandler().ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+	decoded := PeerSnapshot{}
+	assert.NilError(t, json.Unmarshal(rec.Body.Bytes(), &decoded))
+	assert.Equal(t, decoded.Units[0].ID, server.ID())
+
+	close(release)
+	assert.NilError(t, <-done)
+	assert.Equal(t, len(client.Snapshot().Units[0].Requests), 0)
+}
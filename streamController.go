@@ -2,7 +2,10 @@ package roletalk
 
 import (
 	"bytes"
+	"io"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/pkg/errors"
 )
@@ -10,41 +13,97 @@ import (
 type streamController struct {
 	m         map[correlation]*streamChannel
 	mx        *sync.RWMutex
-	ch        chan correlation
+	last      correlation
 	connChans sync.Map //key: *connLocker, value: sync.Map<channel,interface{}>
+	onSize    func(n int)
 }
 
+//streamChannel is local end of a stream. Readable side uses buf, err and signal; writable side uses quota, writeErr and quotaSignal.
+//Duplex uses both sides of one channel, so remote end of writing does not stop local writing
 type streamChannel struct {
-	buf    bytes.Buffer
-	err    error
-	signal chan interface{}
-	quota  int
-	mx     sync.Mutex
+	active      int64 //active is time of the last data transferred in unix nanoseconds. It is first for atomic alignment
+	buf         bytes.Buffer
+	err         error
+	signal      chan interface{}
+	quota       int
+	writeErr    error
+	quotaSignal chan interface{}
+	idle        *time.Timer
+	conn        *connLocker  //conn carries frames of the stream. Resumable stream moves to another connection after this one has been lost
+	resume      *resumeState //resume is nil unless the stream is resumable
+	mx          sync.Mutex
 }
 
-func createStreamController() *streamController {
-	sm := streamController{}
+func createStreamController(onSize func(n int)) *streamController {
+	sm := streamController{onSize: onSize}
 	sm.m = make(map[correlation]*streamChannel)
 	sm.mx = new(sync.RWMutex)
-	sm.ch = make(chan correlation)
-	go produceCorrelation(sm.m, sm.ch, sm.mx)
 	return &sm
 }
 
-func (sm *streamController) createStream() (channel correlation, sc *streamChannel) {
-	channel = <-sm.ch
+//createStream allocates local channel of a stream. State of resumable stream is created before the stream is requested, since its frames can arrive as soon as remote side has responded
+func (sm *streamController) createStream(resumable bool) (channel correlation, sc *streamChannel) {
 	sc = new(streamChannel)
-	sc.signal = make(chan interface{})
+	if resumable == true {
+		sc.resume = new(resumeState)
+	}
+	//buffered, so signal sent while nobody waits is not lost
+	sc.signal = make(chan interface{}, 1)
+	sc.quotaSignal = make(chan interface{}, 1)
 	sm.mx.Lock()
+	channel = nextCorrelation(&sm.last, func(c correlation) bool {
+		_, ok := sm.m[c]
+		return ok
+	})
 	sm.m[channel] = sc
+	sm.onSize(len(sm.m))
 	sm.mx.Unlock()
 	return channel, sc
 }
 
-func (sm *streamController) delete(channel correlation) {
+func (sm *streamController) delete(channel correlation) *streamChannel {
 	sm.mx.Lock()
-	delete(sm.m, channel)
+	sc, ok := sm.m[channel]
+	if ok == true {
+		delete(sm.m, channel)
+		sm.onSize(len(sm.m))
+	}
 	sm.mx.Unlock()
+	if ok == true {
+		sc.mx.Lock()
+		if sc.idle != nil {
+			sc.idle.Stop()
+		}
+		if sc.resume != nil {
+			sc.resume.stop()
+		}
+		sc.mx.Unlock()
+	}
+	return sc
+}
+
+//watchIdle calls destroy with ErrStreamIdle if no data of the stream has been transferred within timeout
+func (sm *streamController) watchIdle(channel correlation, timeout time.Duration, destroy func(kind StreamTimeoutKind, err error)) {
+	sc, ok := sm.getStreamChannel(channel)
+	if ok == false {
+		return
+	}
+	sc.touch()
+	sc.mx.Lock()
+	sc.idle = time.AfterFunc(timeout, func() {
+		if current, ok := sm.getStreamChannel(channel); ok == false || current != sc {
+			return
+		}
+		idle := time.Since(time.Unix(0, atomic.LoadInt64(&sc.active)))
+		if idle < timeout {
+			sc.mx.Lock()
+			sc.idle.Reset(timeout - idle)
+			sc.mx.Unlock()
+			return
+		}
+		destroy(StreamIdle, ErrStreamIdle)
+	})
+	sc.mx.Unlock()
 }
 
 func (sm *streamController) setErr(channel correlation, err error) {
@@ -52,11 +111,26 @@ func (sm *streamController) setErr(channel correlation, err error) {
 	sc, ok := sm.m[channel]
 	sm.mx.RUnlock()
 	if ok == true {
-		sc.setErr(err)
-		sendSignal(sc.signal)
+		sc.fail(err)
+	}
+}
+
+//finish releases stream which is not used by local side anymore. Frames received for the channel afterwards are ignored
+func (sm *streamController) finish(channel correlation) {
+	if sc := sm.delete(channel); sc != nil {
+		if conn := sc.getConn(); conn != nil {
+			sm.unbindConn(conn, channel)
+		}
 	}
 }
 
+//open returns number of streams which are still used by local side
+func (sm *streamController) open() int {
+	sm.mx.RLock()
+	defer sm.mx.RUnlock()
+	return len(sm.m)
+}
+
 func (sm *streamController) getStreamChannel(channel correlation) (*streamChannel, bool) {
 	sm.mx.RLock()
 	sc, ok := sm.m[channel]
@@ -64,10 +138,16 @@ func (sm *streamController) getStreamChannel(channel correlation) (*streamChanne
 	return sc, ok
 }
 
+//bindConn makes conn carry frames of the stream, so the stream fails or is suspended when conn is closed
 func (sm *streamController) bindConn(conn *connLocker, channel correlation) {
 	var c *sync.Map
 	var val interface{}
 	// var ok bool
+	if sc, ok := sm.getStreamChannel(channel); ok == true {
+		sc.mx.Lock()
+		sc.conn = conn
+		sc.mx.Unlock()
+	}
 	val, _ = sm.connChans.Load(conn)
 	if val == nil {
 		c = &sync.Map{}
@@ -90,7 +170,9 @@ func (sm *streamController) unbindConn(conn *connLocker, channel correlation) {
 	c.Delete(channel)
 }
 
-func (sm *streamController) onConnClosed(conn *connLocker, err error) {
+//onConnClosed fails streams carried by conn. Resumable streams are suspended instead if resume is true, they fail unless resumed within timeout.
+//It returns number of suspended streams
+func (sm *streamController) onConnClosed(conn *connLocker, err error, resume bool, timeout time.Duration) (suspended int) {
 	key, ok := sm.connChans.Load(conn)
 	if ok == false {
 		return
@@ -99,14 +181,50 @@ func (sm *streamController) onConnClosed(conn *connLocker, err error) {
 	m := key.(*sync.Map)
 	m.Range(func(key, val interface{}) bool {
 		c := key.(correlation)
-		sm.setErr(c, errors.Wrap(err, "underlying connection closed due to error previously occured"))
+		err := errors.Wrap(err, "underlying connection closed due to error previously occured")
+		if sc, ok := sm.getStreamChannel(c); ok == true && resume == true && sc.suspend(conn, err, timeout) == true {
+			suspended++
+			return true
+		}
+		sm.setErr(c, err)
 		return true
 	})
+	return
+}
+
+//moveConn makes conn carry frames of the stream instead of the previous connection
+func (sm *streamController) moveConn(channel correlation, sc *streamChannel, conn *connLocker) {
+	prev := sc.getConn()
+	if prev == conn {
+		return
+	}
+	if prev != nil {
+		sm.unbindConn(prev, channel)
+	}
+	sm.bindConn(conn, channel)
 }
 
+//resumable returns channels of suspended streams which have not sent resume frame yet
+func (sm *streamController) resumable() []correlation {
+	var channels []correlation
+	sm.mx.RLock()
+	for c, sc := range sm.m {
+		sc.mx.Lock()
+		if sc.resume != nil && sc.resume.waiting == true && sc.resume.resumeSent == false {
+			channels = append(channels, c)
+		}
+		sc.mx.Unlock()
+	}
+	sm.mx.RUnlock()
+	return channels
+}
+
+//setErr keeps the first error, so finished stream is not turned into failed one by subsequent connection close
 func (sc *streamChannel) setErr(err error) {
 	sc.mx.Lock()
-	sc.err = err
+	if sc.err == nil {
+		sc.err = err
+	}
 	sc.mx.Unlock()
 }
 
@@ -116,3 +234,49 @@ func (sc *streamChannel) getErr() error {
 	sc.mx.Unlock()
 	return err
 }
+
+func (sc *streamChannel) getConn() *connLocker {
+	sc.mx.Lock()
+	conn := sc.conn
+	sc.mx.Unlock()
+	return conn
+}
+
+//touch marks that data of the stream has been transferred
+func (sc *streamChannel) touch() {
+	atomic.StoreInt64(&sc.active, time.Now().UnixNano())
+}
+
+func (sc *streamChannel) getWriteErr() error {
+	sc.mx.Lock()
+	err := sc.writeErr
+	sc.mx.Unlock()
+	return err
+}
+
+//fail ends both sides of the stream with err and wakes them up. First errors are kept
+func (sc *streamChannel) fail(err error) {
+	sc.mx.Lock()
+	if sc.err == nil {
+		sc.err = err
+	}
+	if sc.writeErr == nil {
+		sc.writeErr = err
+	}
+	sc.mx.Unlock()
+	sendSignal(sc.signal)
+	sendSignal(sc.quotaSignal)
+}
+
+//streamError returns error received from remote side of a stream. Timeout errors and io.ErrClosedPipe of closed Readable are mapped to their values, so both ends can compare them
+func streamError(text string) error {
+	switch text {
+	case io.ErrClosedPipe.Error():
+		return io.ErrClosedPipe
+	case ErrStreamIdle.Error():
+		return ErrStreamIdle
+	case ErrStreamStalled.Error():
+		return ErrStreamStalled
+	}
+	return errors.New(text)
+}
@@ -0,0 +1,82 @@
+package roletalk
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"math/rand"
+	"testing"
+	"time"
+
+	"gotest.tools/assert"
+)
+
+func TestStreamRemoteChannels(t *testing.T) {
+	data := make([]byte, 4*defQuotaSizeBytes)
+	rand.Read(data)
+	received := make(chan []byte, 1)
+	_, client, _ := testPeers(t, PeerOptions{Name: "channels server"}, PeerOptions{Name: "channels client"}, ConnectOptions{DoNotReconnect: true}, func(server *Peer) {
+		role := server.Role("channels")
+		role.OnWriter("download", func(ctx *WriterRequestContext) {
+			w, err := ctx.Reply(nil)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			w.Write(data)
+			w.Close()
+		})
+		role.OnReader("upload", func(ctx *ReaderRequestContext) {
+			r, err := ctx.Reply(nil)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			b, err := ioutil.ReadAll(r)
+			if err != nil {
+				t.Error(err)
+			}
+			received <- b
+		})
+	})
+	dest := client.Destination("channels")
+
+	//rejected request takes channel of the client only, so channels of the sides differ afterwards
+	_, _, err := dest.NewReader("missing", EmitOptions{})
+	assert.ErrorContains(t, err, "not handled")
+	done := make(chan error, 1)
+	go func() {
+		_, r, err := dest.NewReader("download", EmitOptions{})
+		if err != nil {
+			done <- err
+			return
+		}
+		b, err := ioutil.ReadAll(r)
+		if err != nil {
+			done <- err
+			return
+		}
+		if bytes.Equal(b, data) == false {
+			done <- errors.New("downloaded data differs")
+			return
+		}
+		_, w, err := dest.NewWriter("upload", EmitOptions{})
+		if err != nil {
+			done <- err
+			return
+		}
+		w.Write(data)
+		w.Close()
+		if bytes.Equal(<-received, data) == false {
+			done <- errors.New("uploaded data differs")
+			return
+		}
+		done <- nil
+	}()
+	select {
+	case err = <-done:
+		assert.NilError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("stream frames have not reached remote side")
+	}
+}
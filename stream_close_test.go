@@ -0,0 +1,43 @@
+package roletalk
+
+import (
+	"io/ioutil"
+	"testing"
+
+	"gotest.tools/assert"
+)
+
+func TestStreamEndBeforeConnClose(t *testing.T) {
+	opened := make(chan struct{})
+	server := NewPeer(PeerOptions{Name: "end server"})
+	client := NewPeer(PeerOptions{Name: "end client"})
+	defer server.Close()
+	defer client.Close()
+	server.Role("end").OnWriter("data", func(ctx *WriterRequestContext) {
+		w, err := ctx.Reply(nil)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		w.Write([]byte("data"))
+		w.Close()
+		//connection is closed right after the end of the stream
+		<-opened
+		ctx.Unit().Close()
+	})
+	addr, err := server.Listen("localhost:0")
+	assert.NilError(t, err)
+	_, err = client.Connect("ws://"+addr.String(), ConnectOptions{DoNotReconnect: true})
+	assert.NilError(t, err)
+	sub := client.Subscribe(10)
+	defer sub.Close()
+
+	_, r, err := client.Destination("end").NewReader("data", EmitOptions{})
+	assert.NilError(t, err)
+	close(opened)
+	waitForEvent(t, sub, EventUnitRemoved)
+	//finished stream is not failed by closing of its connection
+	data, err := ioutil.ReadAll(r)
+	assert.NilError(t, err)
+	assert.Equal(t, string(data), "data")
+}
@@ -0,0 +1,49 @@
+package roletalk
+
+import (
+	"testing"
+
+	"gotest.tools/assert"
+)
+
+func TestFrameOfFinishedStream(t *testing.T) {
+	next := make(chan struct{})
+	written := make(chan struct{})
+	server := NewPeer(PeerOptions{Name: "finished server"})
+	client := NewPeer(PeerOptions{Name: "finished client"})
+	defer server.Close()
+	defer client.Close()
+	server.Role("finished").OnWriter("data", func(ctx *WriterRequestContext) {
+		w, err := ctx.Reply(nil)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		w.Write([]byte{1})
+		<-next
+		w.Write([]byte{2})
+		w.Close()
+		close(written)
+	})
+	server.Role("finished").OnRequest("ping", func(ctx *RequestContext) {
+		ctx.Reply("pong")
+	})
+	addr, err := server.Listen("localhost:0")
+	assert.NilError(t, err)
+	unit, err := client.Connect("ws://"+addr.String(), ConnectOptions{DoNotReconnect: true})
+	assert.NilError(t, err)
+
+	_, r, err := client.Destination("finished").NewReader("data", EmitOptions{})
+	assert.NilError(t, err)
+	_, err = r.Read(make([]byte, 1))
+	assert.NilError(t, err)
+	//local side forgets the stream while remote writer still sends to it, as if frames were in flight when it has been destroyed
+	unit.streamCtr.delete(r.c)
+	close(next)
+	<-written
+	//response follows frames of the finished stream over the only connection, so they have been ignored without closing it
+	res, err := client.Destination("finished").Request("ping", EmitOptions{})
+	assert.NilError(t, err)
+	assert.Equal(t, res.Data, "pong")
+	assert.Assert(t, unit.Connected())
+}
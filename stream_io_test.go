@@ -0,0 +1,168 @@
+package roletalk
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"testing"
+	"time"
+
+	"gotest.tools/assert"
+)
+
+//chunkReader records sizes of buffers passed to Read
+type chunkReader struct {
+	r     io.Reader
+	sizes []int
+}
+
+func (c *chunkReader) Read(p []byte) (int, error) {
+	c.sizes = append(c.sizes, len(p))
+	return c.r.Read(p)
+}
+
+func TestStreamCopy(t *testing.T) {
+	data := make([]byte, 1<<20+123)
+	rand.Read(data)
+	received := make(chan []byte, 1)
+	server, client, _ := testPeers(t, PeerOptions{Name: "duplex server"}, PeerOptions{Name: "duplex client"}, ConnectOptions{DoNotReconnect: true}, func(server *Peer) {
+		role := server.Role("duplex")
+		role.OnReader("upload", func(ctx *ReaderRequestContext) {
+			r, err := ctx.Reply(nil)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			var buf bytes.Buffer
+			if _, err = io.Copy(&buf, r); err != nil {
+				t.Error(err)
+			}
+			received <- buf.Bytes()
+		})
+		role.OnWriter("download", func(ctx *WriterRequestContext) {
+			w, err := ctx.Reply(nil)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			f, err := os.Open(ctx.Data.(string))
+			if err != nil {
+				w.Destroy(err)
+				return
+			}
+			defer f.Close()
+			if _, err = io.Copy(w, f); err != nil {
+				t.Error(err)
+			}
+			w.Close()
+		})
+	})
+	dest := client.Destination("duplex")
+
+	src := &chunkReader{r: bytes.NewReader(data)}
+	_, w, err := dest.NewWriter("upload", EmitOptions{})
+	assert.NilError(t, err)
+	n, err := io.Copy(w, src)
+	assert.NilError(t, err)
+	assert.Equal(t, n, int64(len(data)))
+	assert.NilError(t, w.Close())
+	assert.Assert(t, bytes.Equal(<-received, data))
+	//reads are sized to quota, so data is not buffered by Writable
+	for _, size := range src.sizes {
+		assert.Assert(t, size <= maxStreamChunk, size)
+	}
+
+	f, err := ioutil.TempFile("", "roletalk")
+	assert.NilError(t, err)
+	defer os.Remove(f.Name())
+	_, err = f.Write(data)
+	assert.NilError(t, err)
+	assert.NilError(t, f.Close())
+	_, r, err := dest.NewReader("download", EmitOptions{Data: f.Name()})
+	assert.NilError(t, err)
+	var buf bytes.Buffer
+	n, err = r.WriteTo(&buf)
+	assert.NilError(t, err)
+	assert.Equal(t, n, int64(len(data)))
+	assert.Assert(t, bytes.Equal(buf.Bytes(), data))
+	n, err = r.WriteTo(&buf)
+	assert.NilError(t, err)
+	assert.Equal(t, n, int64(0))
+	waitFor(t, func() bool { return client.openStreams() == 0 && server.openStreams() == 0 })
+}
+
+func TestReadableClose(t *testing.T) {
+	writeErr := make(chan error, 1)
+	server, client, _ := testPeers(t, PeerOptions{Name: "duplex server"}, PeerOptions{Name: "duplex client"}, ConnectOptions{DoNotReconnect: true}, func(server *Peer) {
+		role := server.Role("duplex")
+		role.OnWriter("ticks", func(ctx *WriterRequestContext) {
+			w, err := ctx.Reply(nil)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			for err == nil {
+				_, err = w.Write([]byte{1})
+				time.Sleep(time.Millisecond)
+			}
+			writeErr <- err
+		})
+	})
+
+	_, r, err := client.Destination("duplex").NewReader("ticks", EmitOptions{})
+	assert.NilError(t, err)
+	_, err = r.Read(make([]byte, 1))
+	assert.NilError(t, err)
+	//Close wakes up pending WriteTo
+	done := make(chan error, 1)
+	go func() {
+		_, err := r.WriteTo(ioutil.Discard)
+		done <- err
+	}()
+	time.Sleep(20 * time.Millisecond)
+	assert.NilError(t, r.Close())
+	assert.Equal(t, <-done, io.ErrClosedPipe)
+	_, err = r.Read(make([]byte, 1))
+	assert.Equal(t, err, io.ErrClosedPipe)
+	assert.NilError(t, r.Close())
+	select {
+	case err = <-writeErr:
+		assert.Equal(t, err, io.ErrClosedPipe)
+	case <-time.After(time.Second):
+		t.Fatal("writer has not been cancelled")
+	}
+	waitFor(t, func() bool { return client.openStreams() == 0 && server.openStreams() == 0 })
+}
+
+func TestWritableCloseWithError(t *testing.T) {
+	readErr := make(chan error, 1)
+	server, client, _ := testPeers(t, PeerOptions{Name: "duplex server"}, PeerOptions{Name: "duplex client"}, ConnectOptions{DoNotReconnect: true}, func(server *Peer) {
+		role := server.Role("duplex")
+		role.OnReader("upload", func(ctx *ReaderRequestContext) {
+			r, err := ctx.Reply(nil)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			_, err = ioutil.ReadAll(r)
+			readErr <- err
+		})
+	})
+	dest := client.Destination("duplex")
+
+	_, w, err := dest.NewWriter("upload", EmitOptions{})
+	assert.NilError(t, err)
+	_, err = w.Write([]byte("partial"))
+	assert.NilError(t, err)
+	assert.NilError(t, w.CloseWithError(errors.New("disk is full")))
+	assert.ErrorContains(t, <-readErr, "disk is full")
+
+	_, w, err = dest.NewWriter("upload", EmitOptions{})
+	assert.NilError(t, err)
+	assert.NilError(t, w.CloseWithError(nil))
+	assert.NilError(t, <-readErr)
+	waitFor(t, func() bool { return client.openStreams() == 0 && server.openStreams() == 0 })
+}
@@ -0,0 +1,227 @@
+package roletalk
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"testing"
+	"time"
+
+	"gotest.tools/assert"
+)
+
+func countConns(unit *Unit) int {
+	n := 0
+	unit.connections.Range(func(key, value interface{}) bool {
+		n++
+		return true
+	})
+	return n
+}
+
+//dropConn closes underlying connection without websocket close handshake, as if the link has been lost
+func dropConn(sc *streamChannel) *connLocker {
+	conn := sc.getConn()
+	conn.conn.UnderlyingConn().Close()
+	return conn
+}
+
+func TestStreamResumeRedundantConn(t *testing.T) {
+	received := make(chan []byte, 1)
+	server, client, unit := testPeers(t, PeerOptions{Name: "resume server"}, PeerOptions{Name: "resume client"}, ConnectOptions{DoNotReconnect: true}, func(server *Peer) {
+		role := server.Role("resume")
+		role.OnReader("upload", func(ctx *ReaderRequestContext) {
+			r, err := ctx.Reply(nil)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			data, err := ioutil.ReadAll(r)
+			if err != nil {
+				t.Error(err)
+			}
+			received <- data
+		})
+	})
+	//second listener of the same peer gives second connection to the same unit
+	addr, err := server.Listen("localhost:0")
+	assert.NilError(t, err)
+	_, err = client.Connect("ws://"+addr.String(), ConnectOptions{DoNotReconnect: true})
+	assert.NilError(t, err)
+	assert.Equal(t, countConns(unit), 2)
+
+	data := make([]byte, 1<<20)
+	rand.Read(data)
+	_, w, err := client.Destination("resume").NewWriter("upload", EmitOptions{Resumable: true})
+	assert.NilError(t, err)
+	_, err = w.Write(data[:len(data)/2])
+	assert.NilError(t, err)
+	lost := dropConn(w.streamChannel)
+	//the rest is written over the other connection, including data lost in flight
+	_, err = w.Write(data[len(data)/2:])
+	assert.NilError(t, err)
+	assert.NilError(t, w.Close())
+	assert.Assert(t, bytes.Equal(<-received, data))
+	assert.Assert(t, w.streamChannel.getConn() != lost)
+	assert.Equal(t, countConns(unit), 1)
+	waitFor(t, func() bool { return client.openStreams() == 0 && server.openStreams() == 0 })
+
+	unit.meta.Features = []string{featureFragments, featureDuplex}
+	_, _, err = client.Destination("resume").NewWriter("upload", EmitOptions{Resumable: true, Unit: unit})
+	assert.Equal(t, err, ErrResumeUnsupported)
+}
+
+func TestStreamResumeReconnect(t *testing.T) {
+	server, client, unit := testPeers(t, PeerOptions{Name: "resume server"}, PeerOptions{Name: "resume client"}, ConnectOptions{}, func(server *Peer) {
+		role := server.Role("resume")
+		role.OnDuplex("echo", func(ctx *DuplexRequestContext) {
+			d, err := ctx.Reply(nil)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			io.Copy(d, d)
+			d.CloseWrite()
+		})
+	})
+	events := client.Subscribe(16)
+	defer events.Close()
+	closed := make(chan error, 2)
+	unit.OnClose(func(err error) { closed <- err })
+
+	data := make([]byte, 1<<20)
+	rand.Read(data)
+	_, d, err := client.Destination("resume").NewDuplex("echo", EmitOptions{Resumable: true})
+	assert.NilError(t, err)
+	echo := make(chan []byte, 1)
+	go func() {
+		b, err := ioutil.ReadAll(d)
+		if err != nil {
+			t.Error(err)
+		}
+		echo <- b
+	}()
+	_, err = d.Write(data[:len(data)/2])
+	assert.NilError(t, err)
+	//the only connection is lost, so both units are removed until client reconnects
+	dropConn(d.w.streamChannel)
+	for e := range events.C {
+		if e.Type == EventUnitRemoved {
+			break
+		}
+	}
+	assert.Assert(t, <-closed != nil)
+	_, err = d.Write(data[len(data)/2:])
+	assert.NilError(t, err)
+	assert.NilError(t, d.CloseWrite())
+	select {
+	case b := <-echo:
+		assert.Assert(t, bytes.Equal(b, data))
+	case <-time.After(5 * time.Second):
+		t.Fatal("stream has not been resumed")
+	}
+	revived, ok := client.getUnit(unit.id)
+	assert.Assert(t, ok)
+	assert.Assert(t, revived == unit)
+	units := client.Destination("resume").Units()
+	assert.Equal(t, len(units), 1)
+	assert.Assert(t, units[0] == unit)
+	waitFor(t, func() bool { return client.openStreams() == 0 && server.openStreams() == 0 })
+	//close handlers are kept for revived unit and run again when it is closed
+	unit.Close()
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("close handler has not run for revived unit")
+	}
+}
+
+func TestStreamResumeClose(t *testing.T) {
+	_, client, unit := testPeers(t, PeerOptions{Name: "resume server"}, PeerOptions{Name: "resume client"}, ConnectOptions{DoNotReconnect: true}, func(server *Peer) {
+		role := server.Role("resume")
+		role.OnWriter("ticks", func(ctx *WriterRequestContext) {
+			w, err := ctx.Reply(nil)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			for err == nil {
+				time.Sleep(10 * time.Millisecond)
+				_, err = w.Write([]byte{1})
+			}
+		})
+	})
+	events := client.Subscribe(16)
+	defer events.Close()
+
+	_, r, err := client.Destination("resume").NewReader("ticks", EmitOptions{Resumable: true})
+	assert.NilError(t, err)
+	_, err = r.Read(make([]byte, 1))
+	assert.NilError(t, err)
+	dropConn(r.streamChannel)
+	waitForEvent(t, events, EventUnitRemoved)
+	client.detachedMx.Lock()
+	assert.Assert(t, client.detached[unit.id] == unit)
+	client.detachedMx.Unlock()
+
+	//closed peer does not wait for resuming, which would take StreamResume.Timeout
+	client.Close()
+	read := make(chan error, 1)
+	go func() {
+		var err error
+		for err == nil {
+			_, err = r.Read(make([]byte, 1))
+		}
+		read <- err
+	}()
+	select {
+	case err = <-read:
+		assert.Equal(t, err, errPeerShutdown)
+	case <-time.After(5 * time.Second):
+		t.Fatal("suspended stream has not failed after the peer was closed")
+	}
+	client.detachedMx.Lock()
+	assert.Equal(t, len(client.detached), 0)
+	client.detachedMx.Unlock()
+}
+
+func TestStreamResumeTimeout(t *testing.T) {
+	serverErr := make(chan error, 1)
+	server, client, unit := testPeers(t, PeerOptions{Name: "resume server", StreamResume: StreamResume{Timeout: 100 * time.Millisecond}}, PeerOptions{Name: "resume client", StreamResume: StreamResume{Timeout: 100 * time.Millisecond}}, ConnectOptions{DoNotReconnect: true}, func(server *Peer) {
+		role := server.Role("resume")
+		role.OnWriter("ticks", func(ctx *WriterRequestContext) {
+			w, err := ctx.Reply(nil)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			for err == nil {
+				time.Sleep(10 * time.Millisecond)
+				_, err = w.Write([]byte{1})
+			}
+			serverErr <- err
+		})
+	})
+
+	_, r, err := client.Destination("resume").NewReader("ticks", EmitOptions{Resumable: true})
+	assert.NilError(t, err)
+	_, err = r.Read(make([]byte, 1))
+	assert.NilError(t, err)
+	dropConn(r.streamChannel)
+	start := time.Now()
+	for err == nil {
+		_, err = r.Read(make([]byte, 1))
+	}
+	assert.ErrorContains(t, err, "underlying connection closed")
+	assert.Assert(t, time.Since(start) >= 100*time.Millisecond)
+	select {
+	case err = <-serverErr:
+		assert.ErrorContains(t, err, "underlying connection closed")
+	case <-time.After(time.Second):
+		t.Fatal("writer has not failed")
+	}
+	_, ok := client.getUnit(unit.id)
+	assert.Assert(t, ok == false)
+	waitFor(t, func() bool { return client.openStreams() == 0 && server.openStreams() == 0 })
+}
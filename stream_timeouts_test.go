@@ -0,0 +1,126 @@
+package roletalk
+
+import (
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"gotest.tools/assert"
+)
+
+func TestStreamIdleTimeout(t *testing.T) {
+	metrics := newTestCollector()
+	idle := make(chan struct{})
+	serverErr := make(chan error, 1)
+	server, client, _ := testPeers(t, PeerOptions{Name: "timeouts server"}, PeerOptions{Name: "timeouts client", Metrics: metrics}, ConnectOptions{DoNotReconnect: true}, func(server *Peer) {
+		role := server.Role("timeouts")
+		role.OnWriter("silent", func(ctx *WriterRequestContext) {
+			w, err := ctx.Reply(nil)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			<-idle
+			//write fails once remote side has destroyed the stream
+			for err == nil {
+				time.Sleep(10 * time.Millisecond)
+				_, err = w.Write([]byte{1})
+			}
+			serverErr <- err
+		})
+		role.OnWriter("ticks", func(ctx *WriterRequestContext) {
+			w, err := ctx.Reply(nil)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			for i := 0; i < 10; i++ {
+				time.Sleep(20 * time.Millisecond)
+				w.Write([]byte{byte(i)})
+			}
+			w.Close()
+		})
+	})
+
+	_, r, err := client.Destination("timeouts").NewReader("silent", EmitOptions{IdleTimeout: 100 * time.Millisecond})
+	assert.NilError(t, err)
+	start := time.Now()
+	_, err = r.Read(make([]byte, 1))
+	assert.Equal(t, err, ErrStreamIdle)
+	assert.Assert(t, time.Since(start) >= 90*time.Millisecond)
+	close(idle)
+	assert.Equal(t, <-serverErr, ErrStreamIdle)
+	metrics.mx.Lock()
+	assert.Equal(t, metrics.timeouts[StreamIdle], 1)
+	metrics.mx.Unlock()
+
+	//stream with traffic is not idle, even if it lasts longer than timeout
+	_, r, err = client.Destination("timeouts").NewReader("ticks", EmitOptions{IdleTimeout: 100 * time.Millisecond})
+	assert.NilError(t, err)
+	data, err := ioutil.ReadAll(r)
+	assert.NilError(t, err)
+	assert.Equal(t, len(data), 10)
+	waitFor(t, func() bool { return client.openStreams() == 0 && server.openStreams() == 0 })
+}
+
+func TestStreamStallTimeout(t *testing.T) {
+	metrics := newTestCollector()
+	read := make(chan struct{})
+	serverErr := make(chan error, 1)
+	server, client, _ := testPeers(t, PeerOptions{Name: "timeouts server"}, PeerOptions{Name: "timeouts client", Metrics: metrics, StreamStallTimeout: 100 * time.Millisecond}, ConnectOptions{DoNotReconnect: true}, func(server *Peer) {
+		role := server.Role("timeouts")
+		role.OnReader("stuck", func(ctx *ReaderRequestContext) {
+			r, err := ctx.Reply(nil)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			<-read
+			_, err = ioutil.ReadAll(r)
+			serverErr <- err
+		})
+	})
+
+	_, w, err := client.Destination("timeouts").NewWriter("stuck", EmitOptions{})
+	assert.NilError(t, err)
+	n, err := w.Write(make([]byte, 2*defQuotaSizeBytes))
+	assert.Equal(t, err, ErrStreamStalled)
+	assert.Equal(t, n, defQuotaSizeBytes)
+	_, err = w.Write([]byte{1})
+	assert.Equal(t, err, ErrStreamStalled)
+	close(read)
+	assert.Equal(t, <-serverErr, ErrStreamStalled)
+	metrics.mx.Lock()
+	assert.Equal(t, metrics.timeouts[StreamStalled], 1)
+	metrics.mx.Unlock()
+	waitFor(t, func() bool { return client.openStreams() == 0 && server.openStreams() == 0 })
+}
+
+func TestStreamDeadlines(t *testing.T) {
+	write := make(chan struct{})
+	_, client, _ := testPeers(t, PeerOptions{Name: "timeouts server"}, PeerOptions{Name: "timeouts client"}, ConnectOptions{DoNotReconnect: true}, func(server *Peer) {
+		role := server.Role("timeouts")
+		role.OnWriter("late", func(ctx *WriterRequestContext) {
+			w, err := ctx.Reply(nil)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			<-write
+			w.Write([]byte("late"))
+			w.Close()
+		})
+	})
+
+	_, r, err := client.Destination("timeouts").NewReader("late", EmitOptions{})
+	assert.NilError(t, err)
+	assert.NilError(t, r.SetDeadline(time.Now().Add(50*time.Millisecond)))
+	_, err = r.Read(make([]byte, 4))
+	assert.Equal(t, err, ErrDeadlineExceeded)
+	//stream stays open after deadline
+	assert.NilError(t, r.SetReadDeadline(time.Time{}))
+	close(write)
+	data, err := ioutil.ReadAll(r)
+	assert.NilError(t, err)
+	assert.Equal(t, string(data), "late")
+}
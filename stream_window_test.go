@@ -0,0 +1,118 @@
+package roletalk
+
+import (
+	"io"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"gotest.tools/assert"
+)
+
+func TestStreamWindowDefaults(t *testing.T) {
+	w := StreamWindow{}.withDefaults(defMaxStreamBufferBytes)
+	assert.DeepEqual(t, w, StreamWindow{Initial: defQuotaSizeBytes, Max: defMaxStreamBufferBytes, Threshold: defStreamQuotaThreshold})
+	w = StreamWindow{Initial: 1024, Threshold: 2}.withDefaults(defMaxStreamBufferBytes)
+	assert.Equal(t, w.Initial, defQuotaSizeBytes)
+	assert.Equal(t, w.Threshold, defStreamQuotaThreshold)
+	//window does not exceed buffer limit of local peer
+	w = StreamWindow{Initial: 1 << 30, Max: 1 << 30, Threshold: 0.5}.withDefaults(1 << 20)
+	assert.DeepEqual(t, w, StreamWindow{Initial: 1 << 20, Max: 1 << 20, Threshold: 0.5})
+}
+
+func TestStreamWindowInitial(t *testing.T) {
+	const size = 64 * 1024
+	written := make(chan error, 1)
+	read := make(chan []byte, 1)
+	_, client, _ := testPeers(t, PeerOptions{Name: "duplex server"}, PeerOptions{Name: "duplex client"}, ConnectOptions{DoNotReconnect: true}, func(server *Peer) {
+		role := server.Role("duplex")
+		role.OnWriter("burst", func(ctx *WriterRequestContext) {
+			w, err := ctx.Reply(nil)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			_, err = w.Write(make([]byte, size))
+			written <- err
+			w.Close()
+		})
+		role.OnReader("upload", func(ctx *ReaderRequestContext) {
+			ctx.Window = StreamWindow{Initial: size}
+			r, err := ctx.Reply(nil)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			time.Sleep(100 * time.Millisecond)
+			data, _ := ioutil.ReadAll(r)
+			read <- data
+		})
+	})
+	dest := client.Destination("duplex")
+
+	//remote writer does not wait for reading while data fits initial window
+	_, r, err := dest.NewReader("burst", EmitOptions{Window: StreamWindow{Initial: size}})
+	assert.NilError(t, err)
+	select {
+	case err := <-written:
+		assert.NilError(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("writer is blocked by window")
+	}
+	data, err := ioutil.ReadAll(r)
+	assert.NilError(t, err)
+	assert.Equal(t, len(data), size)
+	assert.Equal(t, r.Window(), size)
+
+	_, w, err := dest.NewWriter("upload", EmitOptions{})
+	assert.NilError(t, err)
+	start := time.Now()
+	_, err = w.Write(make([]byte, size))
+	assert.NilError(t, err)
+	assert.Assert(t, time.Since(start) < 100*time.Millisecond)
+	assert.NilError(t, w.Close())
+	assert.Equal(t, len(<-read), size)
+
+	//default window blocks writer until reading
+	_, r, err = dest.NewReader("burst", EmitOptions{})
+	assert.NilError(t, err)
+	select {
+	case <-written:
+		t.Fatal("writer is not blocked by default window")
+	case <-time.After(100 * time.Millisecond):
+	}
+	io.Copy(ioutil.Discard, r)
+	assert.NilError(t, <-written)
+}
+
+func TestStreamWindowAutoTune(t *testing.T) {
+	const size = 2 << 20
+	server := NewPeer(PeerOptions{Name: "window server"})
+	client := NewPeer(PeerOptions{Name: "window client"})
+	defer server.Close()
+	defer client.Close()
+	server.Role("window").OnWriter("download", func(ctx *WriterRequestContext) {
+		w, err := ctx.Reply(nil)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		w.Write(make([]byte, size))
+		w.Close()
+	})
+	addr, err := server.Listen("localhost:0")
+	assert.NilError(t, err)
+	proxy, closeProxy := latencyProxy(t, addr.String(), 5*time.Millisecond)
+	defer closeProxy()
+	_, err = client.Connect("ws://"+proxy, ConnectOptions{DoNotReconnect: true})
+	assert.NilError(t, err)
+
+	window := StreamWindow{Max: 256 * 1024, AutoTune: true}
+	_, r, err := client.Destination("window").NewReader("download", EmitOptions{Window: window})
+	assert.NilError(t, err)
+	n, err := io.Copy(ioutil.Discard, r)
+	assert.NilError(t, err)
+	assert.Equal(t, n, int64(size))
+	assert.Assert(t, r.Window() > defQuotaSizeBytes, r.Window())
+	assert.Assert(t, r.Window() <= window.Max, r.Window())
+}
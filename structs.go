@@ -1,7 +1,9 @@
 package roletalk
 
 import (
+	"sort"
 	"sync"
+	"time"
 )
 
 //presharedKey is used for authentication. id is used to identify the key
@@ -12,8 +14,17 @@ type presharedKey struct {
 
 //PeerOptions provide options to create Peer
 type PeerOptions struct {
-	Name     string
-	Friendly bool
+	Name        string
+	Friendly    bool
+	Metrics     Collector     //Metrics receives counters and gauges of the Peer. Optional
+	Logger      Logger        //Logger receives diagnostic events of the Peer. Optional
+	Admin       *AdminOptions //Admin enables built-in AdminRole. Optional
+	Limits      Limits        //Limits restricts concurrency of all handlers of the Peer. See also Role.SetLimits. Optional
+	Sizes       SizeLimits    //Sizes restricts sizes of incoming messages. Optional, zero fields take defaults
+	Compression Compression   //Compression of outgoing data. Can be overridden by ConnectOptions. Optional
+	//StreamStallTimeout destroys stream if its writer has been waiting for quota from remote reader longer than that. Both ends get ErrStreamStalled. Default is 1 minute, negative disables it
+	StreamStallTimeout time.Duration
+	StreamResume       StreamResume //StreamResume configures streams opened with EmitOptions.Resumable. Optional, zero fields take defaults
 }
 
 type middlewareMessageMap struct {
@@ -38,6 +49,17 @@ func (roleMW *middlewareMessageMap) get(event string) []MessageHandler {
 	return handlers
 }
 
+func (roleMW *middlewareMessageMap) events() []string {
+	roleMW.mx.RLock()
+	events := make([]string, 0, len(roleMW.m))
+	for event := range roleMW.m {
+		events = append(events, event)
+	}
+	roleMW.mx.RUnlock()
+	sort.Strings(events)
+	return events
+}
+
 func (roleMW *middlewareMessageMap) set(event string, handler MessageHandler) {
 	roleMW.mx.Lock()
 	if _, ok := roleMW.m[event]; ok == false {
@@ -60,6 +82,10 @@ type middlewareWriterRequestMap struct {
 	mx sync.RWMutex
 	m  map[string][]WritableRequestHandler
 }
+type middlewareDuplexRequestMap struct {
+	mx sync.RWMutex
+	m  map[string][]DuplexRequestHandler
+}
 
 func createMiddlewareRequestMap() *middlewareRequestMap {
 	return &middlewareRequestMap{m: make(map[string][]RequestHandler)}
@@ -73,6 +99,10 @@ func createMiddlewareWriterMap() *middlewareWriterRequestMap {
 	return &middlewareWriterRequestMap{m: make(map[string][]WritableRequestHandler)}
 }
 
+func createMiddlewareDuplexMap() *middlewareDuplexRequestMap {
+	return &middlewareDuplexRequestMap{m: make(map[string][]DuplexRequestHandler)}
+}
+
 func (roleMW *middlewareRequestMap) get(event string) []RequestHandler {
 	roleMW.mx.RLock()
 	handlers, ok := roleMW.m[event]
@@ -83,6 +113,17 @@ func (roleMW *middlewareRequestMap) get(event string) []RequestHandler {
 	return handlers
 }
 
+func (roleMW *middlewareRequestMap) events() []string {
+	roleMW.mx.RLock()
+	events := make([]string, 0, len(roleMW.m))
+	for event := range roleMW.m {
+		events = append(events, event)
+	}
+	roleMW.mx.RUnlock()
+	sort.Strings(events)
+	return events
+}
+
 func (roleMW *middlewareRequestMap) set(event string, handler RequestHandler) {
 	roleMW.mx.Lock()
 	if _, ok := roleMW.m[event]; ok == false {
@@ -102,6 +143,17 @@ func (roleMW *middlewareWriterRequestMap) get(event string) []WritableRequestHan
 	return handlers
 }
 
+func (roleMW *middlewareWriterRequestMap) events() []string {
+	roleMW.mx.RLock()
+	events := make([]string, 0, len(roleMW.m))
+	for event := range roleMW.m {
+		events = append(events, event)
+	}
+	roleMW.mx.RUnlock()
+	sort.Strings(events)
+	return events
+}
+
 func (roleMW *middlewareWriterRequestMap) set(event string, handler WritableRequestHandler) {
 	roleMW.mx.Lock()
 	if _, ok := roleMW.m[event]; ok == false {
@@ -121,6 +173,17 @@ func (roleMW *middlewareReaderRequestMap) get(event string) []ReadableRequestHan
 	return handlers
 }
 
+func (roleMW *middlewareReaderRequestMap) events() []string {
+	roleMW.mx.RLock()
+	events := make([]string, 0, len(roleMW.m))
+	for event := range roleMW.m {
+		events = append(events, event)
+	}
+	roleMW.mx.RUnlock()
+	sort.Strings(events)
+	return events
+}
+
 func (roleMW *middlewareReaderRequestMap) set(event string, handler ReadableRequestHandler) {
 	roleMW.mx.Lock()
 	if _, ok := roleMW.m[event]; ok == false {
@@ -130,6 +193,36 @@ func (roleMW *middlewareReaderRequestMap) set(event string, handler ReadableRequ
 	roleMW.mx.Unlock()
 }
 
+func (roleMW *middlewareDuplexRequestMap) get(event string) []DuplexRequestHandler {
+	roleMW.mx.RLock()
+	handlers, ok := roleMW.m[event]
+	if ok == false {
+		handlers = []DuplexRequestHandler{}
+	}
+	roleMW.mx.RUnlock()
+	return handlers
+}
+
+func (roleMW *middlewareDuplexRequestMap) events() []string {
+	roleMW.mx.RLock()
+	events := make([]string, 0, len(roleMW.m))
+	for event := range roleMW.m {
+		events = append(events, event)
+	}
+	roleMW.mx.RUnlock()
+	sort.Strings(events)
+	return events
+}
+
+func (roleMW *middlewareDuplexRequestMap) set(event string, handler DuplexRequestHandler) {
+	roleMW.mx.Lock()
+	if _, ok := roleMW.m[event]; ok == false {
+		roleMW.m[event] = []DuplexRequestHandler{}
+	}
+	roleMW.m[event] = append(roleMW.m[event], handler)
+	roleMW.mx.Unlock()
+}
+
 type busyMutex struct {
 	mutex  sync.Mutex
 	busyMX sync.RWMutex
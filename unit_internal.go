@@ -4,9 +4,7 @@ import (
 	"errors"
 	"fmt"
 	"io"
-	"io/ioutil"
 	"os"
-	"runtime"
 	"sync"
 	"time"
 
@@ -16,8 +14,9 @@ import (
 type correlation uint64
 
 type callback struct {
-	ctx *MessageContext
-	err error
+	ctx     *MessageContext
+	err     error
+	timeout bool
 }
 
 type streamCallback struct {
@@ -31,20 +30,29 @@ type emitStruct struct {
 	timeout         time.Duration
 	ignoreUnitClose bool
 	data            interface{}
+	priority        Priority
+	progress        func(sent, total int)
+	idleTimeout     time.Duration
+	window          StreamWindow
+	resumable       bool
 }
 
 func (unit *Unit) send(headers emitStruct) error {
-	marked, err := markDataType(headers.data)
+	t, body, err := encodeData(headers.data)
 	if err != nil {
 		return err
 	}
-	serialized := serializeOneway(headers.role, headers.event, marked)
-	_, err = unit.writeMsgToSomeConnection(serialized)
+	f := onewayFrame(headers.role, headers.event, t, body)
+	f.progress = headers.progress
+	defer f.release()
+	if _, err = unit.writeMsgToSomeConnection(f, headers.priority); err == nil {
+		unit.peer.metrics.MessageSent(headers.role, headers.event)
+	}
 	return err
 }
 
 func (unit *Unit) request(headers emitStruct) (*MessageContext, error) {
-	marked, err := markDataType(headers.data)
+	t, body, err := encodeData(headers.data)
 	if err != nil {
 		return nil, err
 	}
@@ -52,11 +60,19 @@ func (unit *Unit) request(headers emitStruct) (*MessageContext, error) {
 	if headers.timeout != 0 {
 		timeout = headers.timeout
 	}
+	start := time.Now()
 	corr, ch := unit.callbackCtr.prepare(timeout, headers.ignoreUnitClose)
-	if _, err = unit.writeMsgToSomeConnection(serializeRequest(headers.role, headers.event, corr, marked)); err != nil {
-		unit.callbackCtr.respond(corr, &callback{nil, err})
+	f := requestFrame(headers.role, headers.event, corr, t, body)
+	f.progress = headers.progress
+	_, err = unit.writeMsgToSomeConnection(f, headers.priority)
+	f.release()
+	if err != nil {
+		unit.callbackCtr.respond(corr, &callback{err: err})
+	} else {
+		unit.peer.metrics.RequestSent(headers.role, headers.event)
 	}
 	cb := <-ch
+	unit.peer.metrics.RequestFinished(headers.role, headers.event, requestOutcome(cb), time.Since(start))
 	res := cb.ctx
 	if res != nil {
 		res.role = headers.role
@@ -67,7 +83,10 @@ func (unit *Unit) request(headers emitStruct) (*MessageContext, error) {
 
 func (unit *Unit) newReader(headers emitStruct) (*MessageContext, *Readable, error) {
 	var conn *connLocker
-	marked, err := markDataType(headers.data)
+	if headers.resumable == true && hasFeature(unit.meta.Features, featureResume) == false {
+		return nil, nil, ErrResumeUnsupported
+	}
+	t, body, err := encodeData(headers.data)
 	if err != nil {
 		return nil, nil, err
 	}
@@ -75,25 +94,44 @@ func (unit *Unit) newReader(headers emitStruct) (*MessageContext, *Readable, err
 	if headers.timeout != 0 {
 		timeout = headers.timeout
 	}
+	start := time.Now()
 	corr, ch := unit.callbackCtr.prepare(timeout, headers.ignoreUnitClose)
-	channel, _ := unit.streamCtr.createStream()
-	if conn, err = unit.writeMsgToSomeConnection(serializeStreamRequest(typeReader, headers.role, headers.event, corr, channel, marked)); err != nil {
-		unit.callbackCtr.respond(corr, &callback{nil, err})
+	channel, streamChannel := unit.streamCtr.createStream(headers.resumable)
+	f := streamRequestFrame(typeReader, headers.role, headers.event, corr, channel, resumeType(t, headers.resumable), body)
+	f.progress = headers.progress
+	conn, err = unit.writeMsgToSomeConnection(f, headers.priority)
+	f.release()
+	if err != nil {
+		unit.callbackCtr.respond(corr, &callback{err: err})
+	} else {
+		unit.peer.metrics.RequestSent(headers.role, headers.event)
 	}
 	cb := <-ch
+	unit.peer.metrics.RequestFinished(headers.role, headers.event, requestOutcome(cb), time.Since(start))
 	ctx := cb.ctx
 	if ctx != nil {
 		ctx.role = headers.role
 		ctx.event = headers.event
 	}
-	readable := &Readable{c: channel, conn: conn, pref: createStreamPrefix(channel, streamByteQuota), unit: unit, quotaSize: defQuotaSizeBytes, quotaRem: defQuotaSizeBytes}
+	readable := newReadable(unit, channel, remoteChannel(ctx), streamChannel, headers.priority, headers.window)
 	unit.streamCtr.bindConn(conn, channel)
+	if cb.err != nil {
+		unit.streamCtr.finish(channel)
+	} else {
+		readable.open()
+		if headers.idleTimeout > 0 {
+			unit.streamCtr.watchIdle(channel, headers.idleTimeout, readable.destroyOnTimeout)
+		}
+	}
 	return ctx, readable, cb.err
 }
 
 func (unit *Unit) newWriter(headers emitStruct) (*MessageContext, *Writable, error) {
 	var conn *connLocker
-	marked, err := markDataType(headers.data)
+	if headers.resumable == true && hasFeature(unit.meta.Features, featureResume) == false {
+		return nil, nil, ErrResumeUnsupported
+	}
+	t, body, err := encodeData(headers.data)
 	if err != nil {
 		return nil, nil, err
 	}
@@ -101,22 +139,99 @@ func (unit *Unit) newWriter(headers emitStruct) (*MessageContext, *Writable, err
 	if headers.timeout != 0 {
 		timeout = headers.timeout
 	}
+	start := time.Now()
 	corr, ch := unit.callbackCtr.prepare(timeout, headers.ignoreUnitClose)
-	channel, streamChannel := unit.streamCtr.createStream()
-	if conn, err = unit.writeMsgToSomeConnection(serializeStreamRequest(typeWriter, headers.role, headers.event, corr, channel, marked)); err != nil {
-		unit.callbackCtr.respond(corr, &callback{nil, err})
+	channel, streamChannel := unit.streamCtr.createStream(headers.resumable)
+	f := streamRequestFrame(typeWriter, headers.role, headers.event, corr, channel, resumeType(t, headers.resumable), body)
+	f.progress = headers.progress
+	conn, err = unit.writeMsgToSomeConnection(f, headers.priority)
+	f.release()
+	if err != nil {
+		unit.callbackCtr.respond(corr, &callback{err: err})
+	} else {
+		unit.peer.metrics.RequestSent(headers.role, headers.event)
 	}
 	cb := <-ch
+	unit.peer.metrics.RequestFinished(headers.role, headers.event, requestOutcome(cb), time.Since(start))
 	ctx := cb.ctx
 	if ctx != nil {
 		ctx.role = headers.role
 		ctx.event = headers.event
 	}
-	writable := &Writable{unit: unit, conn: conn, pref: createStreamPrefix(channel, streamByteChunk), streamChannel: streamChannel, quotaRem: defQuotaSizeBytes}
+	writable := newWritable(unit, channel, remoteChannel(ctx), streamChannel, headers.priority)
 	unit.streamCtr.bindConn(conn, channel)
+	if cb.err != nil {
+		unit.streamCtr.finish(channel)
+	} else if headers.idleTimeout > 0 {
+		unit.streamCtr.watchIdle(channel, headers.idleTimeout, writable.destroyOnTimeout)
+	}
 	return ctx, writable, cb.err
 }
 
+//remoteChannel returns channel which remote side has assigned to the stream in response ctx. Frames of the stream are addressed to it
+func remoteChannel(ctx *MessageContext) correlation {
+	if ctx == nil {
+		return 0
+	}
+	return ctx.channel
+}
+
+func (unit *Unit) newDuplex(headers emitStruct) (*MessageContext, *Duplex, error) {
+	if hasFeature(unit.meta.Features, featureDuplex) == false {
+		return nil, nil, ErrDuplexUnsupported
+	}
+	if headers.resumable == true && hasFeature(unit.meta.Features, featureResume) == false {
+		return nil, nil, ErrResumeUnsupported
+	}
+	var conn *connLocker
+	t, body, err := encodeData(headers.data)
+	if err != nil {
+		return nil, nil, err
+	}
+	timeout := requestTimeout
+	if headers.timeout != 0 {
+		timeout = headers.timeout
+	}
+	start := time.Now()
+	corr, ch := unit.callbackCtr.prepare(timeout, headers.ignoreUnitClose)
+	channel, streamChannel := unit.streamCtr.createStream(headers.resumable)
+	f := streamRequestFrame(typeDuplex, headers.role, headers.event, corr, channel, resumeType(t, headers.resumable), body)
+	f.progress = headers.progress
+	conn, err = unit.writeMsgToSomeConnection(f, headers.priority)
+	f.release()
+	if err != nil {
+		unit.callbackCtr.respond(corr, &callback{err: err})
+	} else {
+		unit.peer.metrics.RequestSent(headers.role, headers.event)
+	}
+	cb := <-ch
+	unit.peer.metrics.RequestFinished(headers.role, headers.event, requestOutcome(cb), time.Since(start))
+	ctx := cb.ctx
+	if ctx != nil {
+		ctx.role = headers.role
+		ctx.event = headers.event
+	}
+	duplex := newDuplex(unit, headers.role, headers.event, channel, remoteChannel(ctx), streamChannel, headers.priority, headers.window)
+	unit.streamCtr.bindConn(conn, channel)
+	if cb.err != nil {
+		unit.streamCtr.finish(channel)
+	} else {
+		duplex.r.open()
+		if headers.idleTimeout > 0 {
+			unit.streamCtr.watchIdle(channel, headers.idleTimeout, duplex.destroyOnTimeout)
+		}
+	}
+	return ctx, duplex, cb.err
+}
+
+func isResponse(way byte) bool {
+	switch way {
+	case typeResolve, typeReject, typeStreamResolve, typeStreamReject:
+		return true
+	}
+	return false
+}
+
 func createStreamPrefix(channel correlation, streamByte byte) []byte {
 	chanBytes := serializeCorrelation(channel)
 	chanLen := len(chanBytes)
@@ -130,25 +245,44 @@ func (unit *Unit) bindConn(conn *connLocker) {
 	if _, loaded := unit.connections.LoadOrStore(conn, struct{}{}); loaded == true {
 		return
 	}
+	conn.bindMetrics(unit.id, unit.peer.metrics)
 	go unit.readConnMessages(conn, unit.peer.incMsgChan)
 	if os.Getenv("ENV_VAR") != "DEBUG" {
 		go unit.heartBeatConn(conn)
 	} else {
 		// fmt.Println("Running in DEBUG mode. Connections heartbeat disabled")
 	}
+	go unit.resumeStreams()
 }
 
+//deleteConnection closes underlying connection and removes it from the unit. Only the first call for the connection takes effect
 func (unit *Unit) deleteConnection(conn *connLocker, err error) {
 	peer := unit.peer
-	unit.streamCtr.onConnClosed(conn, err)
+	conn.close()
+	resume := unit.resumableClose(err)
+	if conn.release() == false {
+		//streams could be moved to the connection while it was being closed
+		if unit.streamCtr.onConnClosed(conn, err, resume, peer.resume.Timeout) > 0 {
+			go unit.resumeStreams()
+		}
+		return
+	}
+	suspended := unit.streamCtr.onConnClosed(conn, err, resume, peer.resume.Timeout)
 	unit.connections.Delete(conn)
 	size := 0
 	unit.connections.Range(func(key, value interface{}) bool {
 		size++
 		return true
 	})
+	peer.logger.Debug("connection closed", "unit", unit.id, "remote", conn.conn.RemoteAddr().String(), "error", err)
+	peer.emit(Event{Type: EventConnClosed, UnitID: unit.id, UnitName: unit.name, Address: conn.conn.RemoteAddr().String(), CloseCode: closeCode(err), Err: err})
 	if size < 1 {
 		peer.deleteUnit(unit, err)
+		if len(unit.streamCtr.resumable()) > 0 {
+			peer.detachUnit(unit)
+		}
+	} else if suspended > 0 {
+		go unit.resumeStreams()
 	}
 	if addr, ok := peer.addrUnits.loadByConn(conn); ok == true {
 		peer.addrUnits.unbindAddr(addr)
@@ -156,7 +290,8 @@ func (unit *Unit) deleteConnection(conn *connLocker, err error) {
 	}
 }
 
-func (unit *Unit) writeMsgToSomeConnection(msg []byte) (*connLocker, error) {
+//writeMsgToSomeConnection writes f to an idle connection if there is one, otherwise it waits in the write lane of priority p
+func (unit *Unit) writeMsgToSomeConnection(f frame, p Priority) (*connLocker, error) {
 	n := 0
 	var sent *connLocker
 	omittedConns := make([]*connLocker, 0)
@@ -171,7 +306,7 @@ func (unit *Unit) writeMsgToSomeConnection(msg []byte) (*connLocker, error) {
 			omittedConns = append(omittedConns, conn)
 			return true
 		}
-		if err := unit.writeToConn(conn, msg); err == nil {
+		if err := unit.writeToConn(conn, f, p); err == nil {
 			sent = conn
 			return false
 		}
@@ -189,17 +324,25 @@ func (unit *Unit) writeMsgToSomeConnection(msg []byte) (*connLocker, error) {
 		if _, ok := unit.connections.Load(conn); ok == false {
 			break
 		}
-		if err := unit.writeToConn(conn, msg); err == nil {
+		if err := unit.writeToConn(conn, f, p); err == nil {
 			return conn, nil
 		}
 	}
 	return nil, fmt.Errorf("No available connections to send data. Tried connections: %v, unit: %v", n, unit.id)
 }
 
-func (unit *Unit) writeToConn(conn *connLocker, msg []byte) error {
-	// conn.Lock()
-	err := conn.WriteMessage(websocket.BinaryMessage, msg)
-	// conn.Unlock()
+//writeToConn writes f to conn, compressing its payload and fragmenting it as negotiated with the unit
+func (unit *Unit) writeToConn(conn *connLocker, f frame, p Priority) error {
+	if c, ok := conn.compress(f); ok == true {
+		defer c.release()
+		f = c
+	}
+	var err error
+	if unit.fragments == true && f.size() > fragmentThreshold {
+		err = unit.writeFragments(conn, f, p)
+	} else if err = conn.writeFrame(f, p); err == nil && f.progress != nil {
+		f.progress(len(f.body), len(f.body))
+	}
 	if err != nil {
 		unit.deleteConnection(conn, err)
 	}
@@ -207,26 +350,27 @@ func (unit *Unit) writeToConn(conn *connLocker, msg []byte) error {
 }
 
 func (unit *Unit) readConnMessages(conn *connLocker, ch chan<- *MessageContext) {
-	var nBytesRead, chanLen int
 	var way, strFlag byte
 	var channel correlation
 	var ok bool
-	var raw, pas []byte
+	var raw []byte
 	var err error
 	var reader io.Reader
-	// var buf *bytes.Buffer
 	var streamCHannel *streamChannel
 
-	preAllocSlices := [7][]byte{make([]byte, 1), make([]byte, 2), make([]byte, 3), make([]byte, 4), make([]byte, 5), make([]byte, 6), make([]byte, 7)}
-	byteContainer := make([]byte, 1)
+	fragments := reassembler{limit: unit.peer.sizeLimits.MaxReassembly}
+
+	headBuf := make([]byte, maxCorrelationLen)
+	seqBuf := make([]byte, 8)
 
 	//handling close
 	defer func() {
 		if r := recover(); r != nil {
-			// fmt.Println(r)
-			err = fmt.Errorf("%v", r)
-		} else {
-			// fmt.Println("Closing conn without error")
+			if e, ok := r.(error); ok == true {
+				err = e
+			} else {
+				err = fmt.Errorf("%v", r)
+			}
 		}
 		unit.deleteConnection(conn, err)
 	}()
@@ -234,43 +378,56 @@ func (unit *Unit) readConnMessages(conn *connLocker, ch chan<- *MessageContext)
 	for {
 		_, reader, err = conn.NextReader()
 		if err != nil {
-			panic("Error while calling conn.NextReader(): " + err.Error())
+			panic(fmt.Errorf("Error while calling conn.NextReader(): %w", err))
 		}
-		// if mt != websocket.BinaryMessage {
-		// 	closeConnWithCode(conn, errWrongMessageType, errTextMessageReceived)
-		// 	panic("Not binary message")
-		// }
 
-		if nBytesRead, err = reader.Read(byteContainer); err != nil || nBytesRead != 1 {
-			panic(errors.New("Error while reading conn"))
+		if _, err = io.ReadFull(reader, headBuf[:1]); err != nil {
+			if err == io.EOF {
+				err = &FrameError{Field: "type"}
+				unit.peer.closeOnViolation(unit, conn, errIncorrectMessageStructure, err.Error())
+			}
+			panic(err)
 		}
 		//handling stream chunk without allocating new slices
-		way = byteContainer[0]
+		way = headBuf[0]
 		if way == typeStreamData {
-			if nBytesRead, err = reader.Read(byteContainer); err != nil || nBytesRead != 1 {
-				panic(errors.New("Error while reading conn"))
-			}
-			chanLen = int(byteContainer[0])
-			pas = preAllocSlices[chanLen-1]
-
-			if nBytesRead, err = reader.Read(pas); err != nil || nBytesRead != chanLen {
-				panic(errors.New("Error while reading conn"))
-			}
-			channel = sliceToCorrelation(pas)
-
-			if nBytesRead, err = reader.Read(byteContainer); err != nil || nBytesRead != 1 {
-				panic(errors.New("Error while reading conn"))
+			if channel, strFlag, err = readStreamHead(reader, headBuf); err != nil {
+				if _, ok = err.(*FrameError); ok == true {
+					unit.peer.closeOnViolation(unit, conn, errIncorrectMessageStructure, err.Error())
+				}
+				panic(err)
 			}
-			strFlag = byteContainer[0]
+			//frames of finished streams may still be in flight, e.g. quota for closed Writable
 			if streamCHannel, ok = unit.streamCtr.getStreamChannel(channel); ok != true {
-				closeConnWithCode(conn, errWrongMessageType, fmt.Errorf("Cannot find channel %v", channel).Error())
-				panic(fmt.Errorf("Channel not found: %v", channel))
+				unit.peer.logger.Debug("frame of finished stream ignored", "unit", unit.id, "channel", channel)
+				continue
 			}
 			switch strFlag {
-			case streamByteChunk:
+			case streamByteChunk, streamByteSeqChunk:
+				maxBuf := unit.peer.sizeLimits.MaxStreamBuffer
 				streamCHannel.mx.Lock()
-				streamCHannel.buf.ReadFrom(reader)
+				if strFlag == streamByteSeqChunk {
+					//data retransmitted after resuming could be received already
+					if reader, err = streamCHannel.skipReceived(reader, seqBuf); err != nil {
+						streamCHannel.mx.Unlock()
+						unit.peer.closeOnViolation(unit, conn, errIncorrectMessageStructure, err.Error())
+						panic(err)
+					}
+				}
+				n, _ := streamCHannel.buf.ReadFrom(io.LimitReader(reader, int64(maxBuf-streamCHannel.buf.Len()+1)))
+				if streamCHannel.resume != nil {
+					streamCHannel.resume.received += n
+				}
+				overflow := streamCHannel.buf.Len() > maxBuf
 				streamCHannel.mx.Unlock()
+				if overflow == true {
+					//remote writer does not respect quota
+					err = fmt.Errorf("%v: stream buffer exceeds %v bytes", errStrTooLarge, maxBuf)
+					streamCHannel.fail(err)
+					unit.peer.closeOnViolation(unit, conn, errMessageTooBig, err.Error())
+					panic(err)
+				}
+				streamCHannel.touch()
 				sendSignal(streamCHannel.signal)
 			case streamByteFinish:
 				streamCHannel.mx.Lock()
@@ -278,27 +435,76 @@ func (unit *Unit) readConnMessages(conn *connLocker, ch chan<- *MessageContext)
 				streamCHannel.mx.Unlock()
 				sendSignal(streamCHannel.signal)
 			case streamByteError:
-				raw, err = ioutil.ReadAll(reader)
-				streamCHannel.mx.Lock()
-				streamCHannel.err = errors.New(string(raw))
-				streamCHannel.mx.Unlock()
-				sendSignal(streamCHannel.signal)
+				raw, err = readAllPooled(reader)
+				streamCHannel.fail(streamError(string(raw)))
+				streamCHannel.abortStream()
+			case streamByteSeqEnd:
+				if raw, err = readAllPooled(reader); err != nil {
+					panic(err)
+				}
+				if err = unit.receiveEnd(streamCHannel, raw); err != nil {
+					unit.peer.closeOnViolation(unit, conn, errIncorrectMessageStructure, err.Error())
+					panic(err)
+				}
+			case streamByteAck, streamByteResume:
+				if raw, err = readAllPooled(reader); err != nil {
+					panic(err)
+				}
+				if err = unit.receiveAck(conn, channel, streamCHannel, strFlag, raw); err != nil {
+					unit.peer.closeOnViolation(unit, conn, errIncorrectMessageStructure, err.Error())
+					panic(err)
+				}
 			case streamByteQuota:
-				if raw, err = ioutil.ReadAll(reader); err != nil {
+				if raw, err = readAllPooled(reader); err != nil {
 					panic(errors.New("Error while reading"))
 				}
+				if len(raw) < 1 || len(raw) > maxCorrelationLen {
+					err = &FrameError{Type: typeStreamData, Field: "quota", Size: len(raw)}
+					unit.peer.closeOnViolation(unit, conn, errIncorrectMessageStructure, err.Error())
+					panic(err)
+				}
 				q := sliceToInt(raw)
 				streamCHannel.mx.Lock()
 				streamCHannel.quota = streamCHannel.quota + q
 				streamCHannel.mx.Unlock()
-				sendSignal(streamCHannel.signal)
+				sendSignal(streamCHannel.quotaSignal)
 			}
 
 			continue
 		}
 		//handling messages
-		raw, err = ioutil.ReadAll(reader)
-		ch <- &MessageContext{raw: raw, unit: unit, conn: conn, w: way}
+		if way == typeFragment {
+			if raw, err = fragments.read(reader, unit.peer.sizeLimits.MaxMessage); err != nil {
+				switch err.(type) {
+				case *FrameError:
+					unit.peer.closeOnViolation(unit, conn, errIncorrectMessageStructure, err.Error())
+				case *fragmentSizeError:
+					unit.peer.closeOnViolation(unit, conn, errMessageTooBig, err.Error())
+				}
+				panic(err)
+			}
+			if raw == nil {
+				continue
+			}
+			if way = raw[0]; way == typeFragment || way == typeStreamData {
+				err = &FrameError{Type: typeFragment, Field: "type of fragmented frame", Size: len(raw)}
+				unit.peer.closeOnViolation(unit, conn, errIncorrectMessageStructure, err.Error())
+				panic(err)
+			}
+			raw = raw[1:]
+		} else {
+			raw, err = readAllPooled(reader)
+		}
+		//responses are delivered in order with subsequent close of the connection
+		if isResponse(way) == true {
+			unit.peer.serveIncMsg(&MessageContext{raw: raw, unit: unit, conn: conn, w: way})
+			continue
+		}
+		select {
+		case ch <- &MessageContext{raw: raw, unit: unit, conn: conn, w: way}:
+		case <-unit.peer.done:
+			return
+		}
 	}
 }
 
@@ -308,9 +514,11 @@ func (unit *Unit) closeWithCode(code int, msg string) {
 		closeConnWithCode(conn, code, msg)
 		return true
 	})
+	unit.peer.destRWMutex.RLock()
 	for _, dest := range unit.peer.destinations {
 		dest.deleteUnit(unit)
 	}
+	unit.peer.destRWMutex.RUnlock()
 }
 
 type unitConns struct {
@@ -342,56 +550,59 @@ func (unit *Unit) generateAcquaintMsg(addr string) acquaintMsg {
 }
 
 func (unit *Unit) heartBeatConn(conn *connLocker) {
-	pong := make(chan interface{}, 1)
-	conn.SetPongHandler(func(appData string) error {
-		select {
-		case pong <- struct{}{}:
-		default:
-		}
-		return nil
-	})
 	for {
-		time.Sleep(heartBeatInterval)
-		if _, ok := unit.connections.Load(conn); ok == false {
+		interval := time.NewTimer(heartBeatInterval)
+		select {
+		case <-interval.C:
+		case <-conn.done:
+			interval.Stop()
 			return
 		}
-		timeout := time.Now().Add(heartBeatTimeout)
-		if conn.WriteControl(websocket.PingMessage, []byte{}, timeout) != nil {
+		if conn.WriteControl(websocket.PingMessage, []byte{}, time.Now().Add(heartBeatTimeout)) != nil {
 			return
 		}
+		timeout := time.NewTimer(heartBeatTimeout)
 		select {
-		case <-pong:
-		case <-time.After(heartBeatTimeout):
+		case <-conn.pong:
+			timeout.Stop()
+		case <-timeout.C:
+			unit.peer.metrics.HeartbeatFailure(unit.id)
+			unit.peer.logger.Warn("heartbeat timeout", "unit", unit.id, "remote", conn.conn.RemoteAddr().String())
 			closeConnWithCode(conn, errHeartbeatTimeout, "heartbeat timeout")
+			return
+		case <-conn.done:
+			timeout.Stop()
+			return
 		}
 	}
 }
 
 type reqCallbackController struct {
-	m  map[correlation]cbWaiter
-	mx *sync.RWMutex
-	ch chan correlation
+	m      map[correlation]cbWaiter
+	mx     *sync.RWMutex
+	last   correlation
+	onSize func(n int)
 }
 
 type cbWaiter struct {
 	ch           chan *callback
 	timer        *time.Timer
 	ignUnitClose bool
+	created      time.Time
 }
 
-func produceCorrelation(cb interface{}, corrChan chan<- correlation, callbacksMx *sync.RWMutex) {
-	callbacks, _ := cb.(map[correlation]interface{})
-	var i correlation
-	var ok bool
+//nextCorrelation increments last skipping correlations which are still in use. It should be called under lock protecting last
+func nextCorrelation(last *correlation, inUse func(c correlation) bool) correlation {
+	c := *last
 	for {
-		i++
-		if i > maxCorrelation {
-			i = 0
+		c++
+		if c > maxCorrelation {
+			c = 0
 		}
-		if _, ok = callbacks[i]; ok == true {
-			break
+		if inUse(c) == false {
+			*last = c
+			return c
 		}
-		corrChan <- i
 	}
 }
 
@@ -407,27 +618,30 @@ func rangeConnForCloseFunc(key, val interface{}) bool {
 	return true
 }
 
-func createCallbackController() reqCallbackController {
-	rcm := reqCallbackController{}
+func createCallbackController(onSize func(n int)) reqCallbackController {
+	rcm := reqCallbackController{onSize: onSize}
 	rcm.mx = new(sync.RWMutex)
 	rcm.m = make(map[correlation]cbWaiter)
-	rcm.ch = make(chan correlation, runtime.NumCPU()*2)
-	go produceCorrelation(rcm.m, rcm.ch, rcm.mx)
 	return rcm
 }
 
 func (rcm *reqCallbackController) prepare(timeout time.Duration, ignUnitClose bool) (corr correlation, ch chan *callback) {
 	ch = make(chan *callback, 1)
-	corr = <-rcm.ch
+	rcm.mx.Lock()
+	corr = nextCorrelation(&rcm.last, func(c correlation) bool {
+		_, ok := rcm.m[c]
+		return ok
+	})
 	timer := time.AfterFunc(timeout, func() {
-		rcm.respond(corr, &callback{err: fmt.Errorf("Request timeout: %v", timeout)})
+		rcm.respond(corr, &callback{err: fmt.Errorf("Request timeout: %v", timeout), timeout: true})
 	})
-	rcm.mx.Lock()
 	rcm.m[corr] = cbWaiter{
 		ch,
 		timer,
 		ignUnitClose,
+		time.Now(),
 	}
+	rcm.onSize(len(rcm.m))
 	rcm.mx.Unlock()
 	return
 }
@@ -443,25 +657,33 @@ func (rcm *reqCallbackController) respond(corr correlation, cb *callback) {
 	close(cw.ch)
 	cw.timer.Stop()
 	delete(rcm.m, corr)
+	rcm.onSize(len(rcm.m))
 }
 
 func (rcm *reqCallbackController) onClose() {
-	cb := &callback{err: errors.New("Unit closed")}
+	rcm.rejectAll(errors.New("Unit closed"), false)
+}
+
+//rejectAll responds to pending requests with err and stops their timers. Requests with IgnoreUnitClose are skipped unless force is true
+func (rcm *reqCallbackController) rejectAll(err error, force bool) {
+	cb := &callback{err: err}
 	rcm.mx.Lock()
 	defer rcm.mx.Unlock()
 	for corr, cw := range rcm.m {
-		if cw.ignUnitClose == true {
-			break
+		if cw.ignUnitClose == true && force == false {
+			continue
 		}
 		cw.ch <- cb
 		close(cw.ch)
 		cw.timer.Stop()
 		delete(rcm.m, corr)
 	}
+	rcm.onSize(len(rcm.m))
 }
 
-func (unit *Unit) runOnClose(err error) {
-	for _, handler := range unit.closeHandlers {
+//runOnClose runs handlers taken when the unit has been deleted, since revived unit gets new ones
+func (unit *Unit) runOnClose(handlers []func(err error), err error) {
+	for _, handler := range handlers {
 		handler(err)
 	}
 }